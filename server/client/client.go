@@ -8,17 +8,29 @@ import (
 	"bytes"
 	"fmt"
 	"net"
+	"sync"
 	"time"
 )
 
 // A Client is a TCP connection with a peer
 type Client struct {
 	Conn     net.Conn
-	Choked   bool
 	Bitfield bitfield.Bitfield
+	RemoteID [20]byte // The peer's ID from its handshake
 	peer     peers.Peer
 	infoHash [20]byte
 	peerID   [20]byte
+
+	mu    sync.Mutex // Guards flags, which are read while the connection is in use
+	flags Flags
+}
+
+// Flags are the choke and interest state of a connection in both directions
+type Flags struct {
+	AmChoking      bool `json:"am_choking"`
+	AmInterested   bool `json:"am_interested"`
+	PeerChoking    bool `json:"peer_choking"`
+	PeerInterested bool `json:"peer_interested"`
 }
 
 func completeHandshake(conn net.Conn, infohash, peerID [20]byte) (*handshake.Handshake, error) {
@@ -52,7 +64,7 @@ func recvBitfield(conn net.Conn) (bitfield.Bitfield, error) {
 		return nil, err
 	}
 	if msg == nil {
-		err := fmt.Errorf("Expected bitfield but got %s", msg)
+		err := fmt.Errorf("Expected bitfield but got %v", msg)
 		return nil, err
 	}
 	if msg.ID != message.MsgBitfield {
@@ -69,7 +81,7 @@ func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
 	if err != nil {
 		return nil, err
 	}
-	_, err = completeHandshake(conn, infoHash, peerID)
+	res, err := completeHandshake(conn, infoHash, peerID)
 	if err != nil {
 		conn.Close()
 		return nil, err
@@ -83,13 +95,60 @@ func New(peer peers.Peer, peerID, infoHash [20]byte) (*Client, error) {
 
 	return &Client{
 		Conn:     conn,
-		Choked:   true,
 		Bitfield: bf,
+		RemoteID: res.PeerID,
+		peer:     peer,
+		infoHash: infoHash,
+		peerID:   peerID,
+		flags:    Flags{AmChoking: true, PeerChoking: true},
+	}, nil
+
+}
+
+// Accept completes the handshake of an incoming connection whose handshake
+// asking for infoHash was already read from conn. The peer's bitfield is
+// left empty, it arrives later as a message if the peer has any pieces.
+func Accept(conn net.Conn, peer peers.Peer, remoteID, peerID, infoHash [20]byte) (*Client, error) {
+	conn.SetDeadline(time.Now().Add(3 * time.Second))
+	defer conn.SetDeadline(time.Time{}) // Disable the deadline
+
+	if _, err := conn.Write(handshake.New(infoHash, peerID).Serialize()); err != nil {
+		return nil, err
+	}
+	return &Client{
+		Conn:     conn,
+		RemoteID: remoteID,
 		peer:     peer,
 		infoHash: infoHash,
 		peerID:   peerID,
+		flags:    Flags{AmChoking: true, PeerChoking: true},
 	}, nil
+}
+
+// Flags returns the current choke and interest state
+func (c *Client) Flags() Flags {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flags
+}
+
+// Choked reports whether the peer is choking us
+func (c *Client) Choked() bool {
+	return c.Flags().PeerChoking
+}
+
+// SetChoked records a choke or unchoke message from the peer
+func (c *Client) SetChoked(choked bool) {
+	c.mu.Lock()
+	c.flags.PeerChoking = choked
+	c.mu.Unlock()
+}
 
+// SetPeerInterested records an interested or not interested message from the peer
+func (c *Client) SetPeerInterested(interested bool) {
+	c.mu.Lock()
+	c.flags.PeerInterested = interested
+	c.mu.Unlock()
 }
 
 func (c *Client) Read() (*message.Message, error) {
@@ -106,12 +165,51 @@ func (c *Client) SendRequest(index, begin, length int) error {
 func (c *Client) SendInterested() error {
 	msg := message.Message{ID: message.MsgInterested}
 	_, err := c.Conn.Write(msg.Serialize())
+	if err == nil {
+		c.mu.Lock()
+		c.flags.AmInterested = true
+		c.mu.Unlock()
+	}
+	return err
+}
+
+func (c *Client) SendNotInterested() error {
+	msg := message.Message{ID: message.MsgNotInterested}
+	_, err := c.Conn.Write(msg.Serialize())
+	if err == nil {
+		c.mu.Lock()
+		c.flags.AmInterested = false
+		c.mu.Unlock()
+	}
+	return err
+}
+
+// SendKeepAlive sends an empty message so the peer does not drop an idle connection
+func (c *Client) SendKeepAlive() error {
+	var msg *message.Message
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendChoke() error {
+	msg := message.Message{ID: message.MsgChoke}
+	_, err := c.Conn.Write(msg.Serialize())
+	if err == nil {
+		c.mu.Lock()
+		c.flags.AmChoking = true
+		c.mu.Unlock()
+	}
 	return err
 }
 
 func (c *Client) SendUnChoke() error {
 	msg := message.Message{ID: message.MsgUnchoke}
 	_, err := c.Conn.Write(msg.Serialize())
+	if err == nil {
+		c.mu.Lock()
+		c.flags.AmChoking = false
+		c.mu.Unlock()
+	}
 	return err
 }
 
@@ -120,3 +218,16 @@ func (c *Client) SendHave(index int) error {
 	_, err := c.Conn.Write(msg.Serialize())
 	return err
 }
+
+// SendBitfield tells the peer which pieces we have
+func (c *Client) SendBitfield(bf bitfield.Bitfield) error {
+	msg := message.Message{ID: message.MsgBitfield, Payload: bf}
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
+
+func (c *Client) SendPiece(index, begin int, block []byte) error {
+	msg := message.FormatPiece(index, begin, block)
+	_, err := c.Conn.Write(msg.Serialize())
+	return err
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"strconv"
+	"strings"
+)
+
+// azureusClients maps the two letter codes of Azureus style peer IDs,
+// -XXVVVV-, to client names
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"KT": "KTorrent",
+	"LT": "libtorrent",
+	"lt": "libTorrent",
+	"PI": "PicoTorrent",
+	"qB": "qBittorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"TX": "Tixati",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"UW": "µTorrent Web",
+	"WD": "WebTorrent Desktop",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients maps the first character of Shadow style peer IDs, a
+// client letter followed by version characters up to a dash, to client names
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// shadowDigits are the characters of Shadow style versions in order of value
+const shadowDigits = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// ClientName decodes the client name and version from a peer ID in the
+// Azureus or Shadow style, or the Mainline style used by BitTorrent's
+// original client. Other IDs are reported as unknown.
+func ClientName(id [20]byte) string {
+	switch {
+	case id[0] == '-' && id[7] == '-':
+		code := string(id[1:3])
+		name, ok := azureusClients[code]
+		if !ok {
+			name = code
+		}
+		return name + " " + azureusVersion(id[3:7])
+	case id[0] == 'M':
+		version, ok := mainlineVersion(id[1:8])
+		if ok {
+			return "Mainline " + version
+		}
+	case shadowClients[id[0]] != "":
+		if version, ok := shadowVersion(id[1:6]); ok {
+			return shadowClients[id[0]] + " " + version
+		}
+	}
+	return "Unknown"
+}
+
+// azureusVersion reads one version component per character, letters
+// counting from 10, and drops trailing zero components beyond the second
+func azureusVersion(b []byte) string {
+	parts := make([]string, len(b))
+	for i, c := range b {
+		if c >= 'A' && c <= 'Z' {
+			parts[i] = strconv.Itoa(int(c-'A') + 10)
+			continue
+		}
+		parts[i] = string(c)
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+// mainlineVersion reads a version like 4-3-6-- or 10-1-0-
+func mainlineVersion(b []byte) (string, bool) {
+	parts := strings.Split(strings.TrimRight(string(b), "-"), "-")
+	for _, part := range parts {
+		if part == "" || strings.Trim(part, "0123456789") != "" {
+			return "", false
+		}
+	}
+	return strings.Join(parts, "."), true
+}
+
+// shadowVersion reads the version characters up to the first dash
+func shadowVersion(b []byte) (string, bool) {
+	var parts []string
+	for _, c := range b {
+		if c == '-' {
+			break
+		}
+		value := strings.IndexByte(shadowDigits, c)
+		if value < 0 {
+			return "", false
+		}
+		parts = append(parts, strconv.Itoa(value))
+	}
+	if len(parts) == 0 {
+		return "", false
+	}
+	return strings.Join(parts, "."), true
+}
@@ -0,0 +1,32 @@
+package client
+
+import "testing"
+
+func TestClientName(t *testing.T) {
+	tests := []struct {
+		id   string
+		want string
+	}{
+		{"-qB4520-abcdefghijkl", "qBittorrent 4.5.2"},
+		{"-TR3000-abcdefghijkl", "Transmission 3.0"},
+		{"-UT3550-abcdefghijkl", "µTorrent 3.5.5"},
+		{"-LT1B10-abcdefghijkl", "libtorrent 1.11.1"},
+		{"-DE13F0-abcdefghijkl", "Deluge 1.3.15"},
+		{"-XX1000-abcdefghijkl", "XX 1.0"},
+		{"M4-3-6--abcdefghijkl", "Mainline 4.3.6"},
+		{"M10-1-0-abcdefghijkl", "Mainline 10.1.0"},
+		{"Mx-3-6--abcdefghijkl", "Unknown"},
+		{"T03I--abcdefghijklmn", "BitTornado 0.3.18"},
+		{"S587-abcdefghijklmno", "Shadow's client 5.8.7"},
+		{"A---abcdefghijklmnop", "Unknown"},
+		{"abcdefghijklmnopqrst", "Unknown"},
+		{"\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00", "Unknown"},
+	}
+	for _, tt := range tests {
+		var id [20]byte
+		copy(id[:], tt.id)
+		if got := ClientName(id); got != tt.want {
+			t.Errorf("ClientName(%q) = %q, want %q", tt.id, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,484 @@
+package feeds
+
+import (
+	"bit_torrent/magnet"
+	"bit_torrent/session"
+	"bit_torrent/torrent"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults and bounds of feed polling
+const (
+	DefaultInterval = 15 * time.Minute
+	MinInterval     = time.Minute
+	maxFeedSize     = 5 << 20
+	maxSeen         = 1000 // Items remembered per feed
+)
+
+// tickInterval is how often the poller looks for feeds that are due
+const tickInterval = 10 * time.Second
+
+// ErrNotFound is returned for feeds that are not subscribed
+var ErrNotFound = errors.New("feeds: no such feed")
+
+// Feed is an RSS or Atom feed subscription. Items whose title matches one
+// of the Include expressions, or any title when there are none, and none
+// of the Exclude expressions are added with SaveDir and Category. Items
+// link to a .torrent file or to a magnet link, whose metadata is fetched
+// from peers.
+type Feed struct {
+	ID       string
+	URL      string
+	Interval time.Duration
+	Include  []string
+	Exclude  []string
+	SaveDir  string
+	Category string
+
+	LastChecked time.Time
+	LastError   string
+	Seen        []string // Items already handled by GUID, oldest first
+
+	include []*regexp.Regexp
+	exclude []*regexp.Regexp
+}
+
+// feedJSON is Feed with its interval written like "15m0s"
+type feedJSON struct {
+	ID          string    `json:"id"`
+	URL         string    `json:"url"`
+	Interval    string    `json:"interval"`
+	Include     []string  `json:"include,omitempty"`
+	Exclude     []string  `json:"exclude,omitempty"`
+	SaveDir     string    `json:"save_dir,omitempty"`
+	Category    string    `json:"category,omitempty"`
+	LastChecked time.Time `json:"last_checked"`
+	LastError   string    `json:"last_error,omitempty"`
+	Seen        []string  `json:"seen,omitempty"`
+}
+
+func (f Feed) MarshalJSON() ([]byte, error) {
+	return json.Marshal(feedJSON{
+		ID:          f.ID,
+		URL:         f.URL,
+		Interval:    f.Interval.String(),
+		Include:     f.Include,
+		Exclude:     f.Exclude,
+		SaveDir:     f.SaveDir,
+		Category:    f.Category,
+		LastChecked: f.LastChecked,
+		LastError:   f.LastError,
+		Seen:        f.Seen,
+	})
+}
+
+func (f *Feed) UnmarshalJSON(data []byte) error {
+	var j feedJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	interval, err := time.ParseDuration(j.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid feed interval: %v", err)
+	}
+	*f = Feed{
+		ID:          j.ID,
+		URL:         j.URL,
+		Interval:    interval,
+		Include:     j.Include,
+		Exclude:     j.Exclude,
+		SaveDir:     j.SaveDir,
+		Category:    j.Category,
+		LastChecked: j.LastChecked,
+		LastError:   j.LastError,
+		Seen:        j.Seen,
+	}
+	return nil
+}
+
+// compile checks the feed's settings and compiles its rules
+func (f *Feed) compile() error {
+	if !strings.HasPrefix(f.URL, "http://") && !strings.HasPrefix(f.URL, "https://") {
+		return fmt.Errorf("invalid feed url %q", f.URL)
+	}
+	if f.Interval == 0 {
+		f.Interval = DefaultInterval
+	}
+	if f.Interval < MinInterval {
+		return fmt.Errorf("feed interval must be at least %s", MinInterval)
+	}
+	var err error
+	if f.include, err = compileRules(f.Include); err != nil {
+		return err
+	}
+	f.exclude, err = compileRules(f.Exclude)
+	return err
+}
+
+func compileRules(rules []string) ([]*regexp.Regexp, error) {
+	compiled := make([]*regexp.Regexp, len(rules))
+	for i, rule := range rules {
+		re, err := regexp.Compile(rule)
+		if err != nil {
+			return nil, fmt.Errorf("invalid rule %q: %v", rule, err)
+		}
+		compiled[i] = re
+	}
+	return compiled, nil
+}
+
+// Matches reports whether an item title passes the feed's rules
+func (f *Feed) Matches(title string) bool {
+	for _, re := range f.exclude {
+		if re.MatchString(title) {
+			return false
+		}
+	}
+	if len(f.include) == 0 {
+		return true
+	}
+	for _, re := range f.include {
+		if re.MatchString(title) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Feed) seen(guid string) bool {
+	for _, s := range f.Seen {
+		if s == guid {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Feed) markSeen(guid string) {
+	f.Seen = append(f.Seen, guid)
+	if len(f.Seen) > maxSeen {
+		f.Seen = f.Seen[len(f.Seen)-maxSeen:]
+	}
+}
+
+// AddFunc adds the .torrent file or magnet link at url with the feed's
+// settings. It returns an error wrapping session.ErrExists only for
+// torrents the session already has by infohash. A torrent whose name is
+// taken must be added under another name, as the item would otherwise
+// never be added.
+type AddFunc func(url string, feed Feed) error
+
+// A Poller polls its feeds when they are due and keeps them, with the
+// items already handled, in a file across restarts
+type Poller struct {
+	path   string
+	add    AddFunc
+	client *http.Client
+
+	mu    sync.Mutex // Guards feeds and the file
+	feeds []*Feed
+	poll  sync.Mutex // Serializes polls
+}
+
+// Open returns a Poller for the feeds kept at path, which may not exist yet
+func Open(path string, add AddFunc) (*Poller, error) {
+	p := &Poller{path: path, add: add, client: &http.Client{Timeout: torrent.FetchTimeout}}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return p, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &p.feeds); err != nil {
+		return nil, fmt.Errorf("failed to parse feeds file: %v", err)
+	}
+	for _, f := range p.feeds {
+		if err := f.compile(); err != nil {
+			return nil, fmt.Errorf("feed %s: %v", f.URL, err)
+		}
+	}
+	return p, nil
+}
+
+// Feeds returns the subscribed feeds
+func (p *Poller) Feeds() []Feed {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	feeds := make([]Feed, len(p.feeds))
+	for i, f := range p.feeds {
+		feeds[i] = *f
+		feeds[i].Seen = append([]string(nil), f.Seen...)
+	}
+	return feeds
+}
+
+// Subscribe adds a feed, polled straight away in the background
+func (p *Poller) Subscribe(f Feed) (Feed, error) {
+	if err := f.compile(); err != nil {
+		return Feed{}, err
+	}
+	id := make([]byte, 4)
+	if _, err := rand.Read(id); err != nil {
+		return Feed{}, err
+	}
+	f.ID = hex.EncodeToString(id)
+	f.LastChecked, f.LastError, f.Seen = time.Time{}, "", nil
+
+	p.mu.Lock()
+	p.feeds = append(p.feeds, &f)
+	p.saveLocked()
+	p.mu.Unlock()
+	go p.Refresh(f.ID)
+	return f, nil
+}
+
+// Unsubscribe removes a feed. Torrents it added stay.
+func (p *Poller) Unsubscribe(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, f := range p.feeds {
+		if f.ID == id {
+			p.feeds = append(p.feeds[:i:i], p.feeds[i+1:]...)
+			p.saveLocked()
+			return nil
+		}
+	}
+	return ErrNotFound
+}
+
+// Refresh polls a feed now
+func (p *Poller) Refresh(id string) error {
+	p.mu.Lock()
+	var feed *Feed
+	for _, f := range p.feeds {
+		if f.ID == id {
+			feed = f
+		}
+	}
+	p.mu.Unlock()
+	if feed == nil {
+		return ErrNotFound
+	}
+	return p.check(feed)
+}
+
+// Run polls the feeds as they become due until quit is closed
+func (p *Poller) Run(quit <-chan struct{}) {
+	ticker := time.NewTicker(tickInterval)
+	defer ticker.Stop()
+	for {
+		p.mu.Lock()
+		var due []*Feed
+		for _, f := range p.feeds {
+			if time.Since(f.LastChecked) >= f.Interval {
+				due = append(due, f)
+			}
+		}
+		p.mu.Unlock()
+		for _, f := range due {
+			p.check(f)
+		}
+
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// check fetches a feed and adds its new matching items, oldest first.
+// Items that fail to add are tried again at the next poll, unless they
+// can never be added.
+func (p *Poller) check(f *Feed) error {
+	p.poll.Lock()
+	defer p.poll.Unlock()
+
+	p.mu.Lock()
+	snapshot := *f
+	p.mu.Unlock()
+
+	items, err := p.fetch(snapshot.URL)
+	var handled []string
+	if err == nil {
+		for i := len(items) - 1; i >= 0; i-- {
+			item := items[i]
+			if snapshot.seen(item.GUID) || !snapshot.Matches(item.Title) {
+				continue
+			}
+			addErr := p.addItem(item, snapshot)
+			if addErr == nil || permanent(addErr) {
+				handled = append(handled, item.GUID)
+			} else if err == nil {
+				err = addErr
+			}
+		}
+	} else {
+		log.Printf("Failed to poll feed %s: %v", snapshot.URL, err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	f.LastChecked = time.Now()
+	f.LastError = ""
+	if err != nil {
+		f.LastError = err.Error()
+	}
+	for _, guid := range handled {
+		f.markSeen(guid)
+	}
+	p.saveLocked()
+	return err
+}
+
+func (p *Poller) addItem(item Item, f Feed) error {
+	err := p.add(item.URL, f)
+	switch {
+	case errors.Is(err, session.ErrExists):
+		log.Printf("Ignoring %q from feed %s, already added", item.Title, f.URL)
+	case err != nil:
+		log.Printf("Failed to add %q from feed %s: %v", item.Title, f.URL, err)
+	default:
+		log.Printf("Added %q from feed %s", item.Title, f.URL)
+	}
+	return err
+}
+
+// permanent reports whether adding an item failed for good, so it is not
+// tried again: the torrent is already added, or the item can never be
+func permanent(err error) bool {
+	for _, target := range []error{session.ErrExists, torrent.ErrInvalid, torrent.ErrInvalidURL, torrent.ErrTooLarge, magnet.ErrInvalid} {
+		if errors.Is(err, target) {
+			return true
+		}
+	}
+	return false
+}
+
+// saveLocked writes the feeds to the file atomically, p.mu must be held.
+// Failures are logged, polling keeps working without it.
+func (p *Poller) saveLocked() {
+	data, err := json.MarshalIndent(p.feeds, "", "  ")
+	if err == nil {
+		tmp := p.path + ".tmp"
+		if err = os.WriteFile(tmp, data, 0644); err == nil {
+			err = os.Rename(tmp, p.path)
+		}
+	}
+	if err != nil {
+		log.Printf("Error saving feeds: %v", err)
+	}
+}
+
+func (p *Poller) fetch(url string) ([]Item, error) {
+	res, err := p.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching feed: %s", res.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, maxFeedSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxFeedSize {
+		return nil, fmt.Errorf("feed is larger than %d bytes", maxFeedSize)
+	}
+	return Parse(data)
+}
+
+// Item is a feed entry pointing at a torrent
+type Item struct {
+	Title string `json:"title"`
+	GUID  string `json:"guid"` // The URL when the feed gives no id
+	URL   string `json:"url"`
+}
+
+// document holds either an RSS channel or an Atom feed
+type document struct {
+	XMLName xml.Name
+	Channel struct {
+		Items []struct {
+			Title     string `xml:"title"`
+			GUID      string `xml:"guid"`
+			Link      string `xml:"link"`
+			Enclosure struct {
+				URL string `xml:"url,attr"`
+			} `xml:"enclosure"`
+		} `xml:"item"`
+	} `xml:"channel"`
+	Entries []struct {
+		Title string `xml:"title"`
+		ID    string `xml:"id"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+			Type string `xml:"type,attr"`
+		} `xml:"link"`
+	} `xml:"entry"`
+}
+
+// Parse reads the items of an RSS 2.0 or Atom feed, newest first as feeds
+// list them. RSS items link to their torrent through an enclosure or
+// their link, Atom entries through an enclosure or torrent typed link or
+// their first link.
+func Parse(data []byte) ([]Item, error) {
+	var doc document
+	if err := xml.Unmarshal(data, &doc); err != nil {
+		return nil, fmt.Errorf("invalid feed: %v", err)
+	}
+
+	var items []Item
+	switch doc.XMLName.Local {
+	case "rss":
+		for _, it := range doc.Channel.Items {
+			item := Item{Title: it.Title, GUID: it.GUID, URL: it.Enclosure.URL}
+			if item.URL == "" {
+				item.URL = it.Link
+			}
+			items = append(items, item)
+		}
+	case "feed":
+		for _, entry := range doc.Entries {
+			item := Item{Title: entry.Title, GUID: entry.ID}
+			for _, link := range entry.Links {
+				if item.URL == "" || link.Rel == "enclosure" || link.Type == "application/x-bittorrent" {
+					item.URL = link.Href
+				}
+			}
+			items = append(items, item)
+		}
+	default:
+		return nil, fmt.Errorf("invalid feed: unknown root element %q", doc.XMLName.Local)
+	}
+
+	// Items without a link have nothing to add
+	kept := items[:0]
+	for _, item := range items {
+		item.Title, item.GUID, item.URL = strings.TrimSpace(item.Title), strings.TrimSpace(item.GUID), strings.TrimSpace(item.URL)
+		if item.URL == "" {
+			continue
+		}
+		if item.GUID == "" {
+			item.GUID = item.URL
+		}
+		kept = append(kept, item)
+	}
+	return kept, nil
+}
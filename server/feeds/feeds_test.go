@@ -0,0 +1,255 @@
+package feeds
+
+import (
+	"bit_torrent/magnet"
+	"bit_torrent/session"
+	"bit_torrent/torrent"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const rssFeed = `<?xml version="1.0"?>
+<rss version="2.0"><channel>
+	<title>Releases</title>
+	<item>
+		<title>Show S01E02 1080p</title>
+		<guid>show-2</guid>
+		<link>http://example.com/page/2</link>
+		<enclosure url="http://example.com/show-2.torrent" type="application/x-bittorrent"/>
+	</item>
+	<item>
+		<title> Show S01E01 720p </title>
+		<link>http://example.com/show-1.torrent</link>
+	</item>
+	<item><title>No link</title><guid>nothing</guid></item>
+</channel></rss>`
+
+const atomFeed = `<?xml version="1.0"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<entry>
+		<title>Album</title>
+		<id>urn:album</id>
+		<link href="http://example.com/album"/>
+		<link rel="enclosure" href="http://example.com/album.torrent"/>
+	</entry>
+	<entry>
+		<title>Typed</title>
+		<id>urn:typed</id>
+		<link type="application/x-bittorrent" href="http://example.com/typed.torrent"/>
+		<link href="http://example.com/typed"/>
+	</entry>
+	<entry>
+		<title>Plain</title>
+		<link href="http://example.com/plain.torrent"/>
+	</entry>
+</feed>`
+
+func TestParse(t *testing.T) {
+	tests := []struct {
+		name string
+		data string
+		want []Item
+		err  bool
+	}{
+		{"rss", rssFeed, []Item{
+			{Title: "Show S01E02 1080p", GUID: "show-2", URL: "http://example.com/show-2.torrent"},
+			{Title: "Show S01E01 720p", GUID: "http://example.com/show-1.torrent", URL: "http://example.com/show-1.torrent"},
+		}, false},
+		{"atom", atomFeed, []Item{
+			{Title: "Album", GUID: "urn:album", URL: "http://example.com/album.torrent"},
+			{Title: "Typed", GUID: "urn:typed", URL: "http://example.com/typed.torrent"},
+			{Title: "Plain", GUID: "http://example.com/plain.torrent", URL: "http://example.com/plain.torrent"},
+		}, false},
+		{"unknown root", `<html></html>`, nil, true},
+		{"not xml", `{"items": []}`, nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Parse([]byte(tt.data))
+			if (err != nil) != tt.err {
+				t.Fatalf("Parse() error = %v, want error %t", err, tt.err)
+			}
+			if !tt.err && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatches(t *testing.T) {
+	tests := []struct {
+		name    string
+		include []string
+		exclude []string
+		title   string
+		want    bool
+	}{
+		{"no rules", nil, nil, "anything", true},
+		{"included", []string{`S01E\d+`}, nil, "Show S01E01", true},
+		{"not included", []string{`S01E\d+`}, nil, "Show S02E01", false},
+		{"any include", []string{"720p", "1080p"}, nil, "Show 1080p", true},
+		{"excluded", nil, []string{"(?i)cam"}, "Movie CAM", false},
+		{"exclude wins", []string{"Show"}, []string{"720p"}, "Show 720p", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := Feed{URL: "http://example.com/rss", Include: tt.include, Exclude: tt.exclude}
+			if err := f.compile(); err != nil {
+				t.Fatal(err)
+			}
+			if got := f.Matches(tt.title); got != tt.want {
+				t.Errorf("Matches(%q) = %t, want %t", tt.title, got, tt.want)
+			}
+		})
+	}
+}
+
+// testPoller serves body as a feed and returns a poller subscribed to it
+// with feed's rules, adding items through add
+func testPoller(t *testing.T, body string, feed Feed, add AddFunc) (*Poller, *Feed) {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	t.Cleanup(server.Close)
+
+	p, err := Open(filepath.Join(t.TempDir(), "feeds.json"), add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	feed.ID, feed.URL = "test", server.URL
+	if err := feed.compile(); err != nil {
+		t.Fatal(err)
+	}
+	p.feeds = append(p.feeds, &feed)
+	return p, &feed
+}
+
+func TestPollAddsMatchingItemsOldestFirst(t *testing.T) {
+	var added []string
+	p, _ := testPoller(t, rssFeed, Feed{Include: []string{"Show"}, Exclude: []string{"720p"}}, func(url string, feed Feed) error {
+		added = append(added, url)
+		return nil
+	})
+	if err := p.Refresh("test"); err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"http://example.com/show-2.torrent"}; !reflect.DeepEqual(added, want) {
+		t.Errorf("added %v, want %v", added, want)
+	}
+
+	p, _ = testPoller(t, atomFeed, Feed{}, func(url string, feed Feed) error {
+		added = append(added, url)
+		return nil
+	})
+	added = nil
+	if err := p.Refresh("test"); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"http://example.com/plain.torrent", "http://example.com/typed.torrent", "http://example.com/album.torrent"}
+	if !reflect.DeepEqual(added, want) {
+		t.Errorf("added %v, want %v", added, want)
+	}
+}
+
+func TestPollRemembersHandledItems(t *testing.T) {
+	errTransient := errors.New("tracker down")
+	results := map[string][]error{
+		// Added already, and so never tried again
+		"http://example.com/show-2.torrent": {fmt.Errorf("%w: by infohash", session.ErrExists)},
+		// Fails once and is retried at the next poll
+		"http://example.com/show-1.torrent": {errTransient, nil},
+	}
+	tries := make(map[string]int)
+	p, feed := testPoller(t, rssFeed, Feed{}, func(url string, f Feed) error {
+		tries[url]++
+		errs := results[url]
+		if len(errs) == 0 {
+			t.Fatalf("%s added again", url)
+		}
+		results[url] = errs[1:]
+		return errs[0]
+	})
+
+	if err := p.Refresh("test"); !errors.Is(err, errTransient) {
+		t.Errorf("first poll error = %v, want %v", err, errTransient)
+	}
+	if want := []string{"show-2"}; !reflect.DeepEqual(feed.Seen, want) {
+		t.Errorf("seen after the first poll = %v, want %v", feed.Seen, want)
+	}
+	if feed.LastError == "" {
+		t.Error("the failure is not reported")
+	}
+
+	if err := p.Refresh("test"); err != nil {
+		t.Errorf("second poll error = %v", err)
+	}
+	if want := []string{"show-2", "http://example.com/show-1.torrent"}; !reflect.DeepEqual(feed.Seen, want) {
+		t.Errorf("seen after the second poll = %v, want %v", feed.Seen, want)
+	}
+	if feed.LastError != "" {
+		t.Errorf("LastError = %q after a clean poll", feed.LastError)
+	}
+
+	// Everything is handled, a third poll adds nothing
+	if err := p.Refresh("test"); err != nil {
+		t.Errorf("third poll error = %v", err)
+	}
+	if tries["http://example.com/show-2.torrent"] != 1 || tries["http://example.com/show-1.torrent"] != 2 {
+		t.Errorf("tries = %v", tries)
+	}
+
+	// The poller keeps what it has seen across restarts
+	reopened, err := Open(p.path, p.add)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if feeds := reopened.Feeds(); len(feeds) != 1 || !reflect.DeepEqual(feeds[0].Seen, feed.Seen) {
+		t.Errorf("reopened feeds = %+v", feeds)
+	}
+}
+
+func TestPollAddsMagnets(t *testing.T) {
+	const link = "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567"
+	const magnetFeed = `<rss><channel><item>
+		<title>Magnet</title>
+		<link>` + link + `</link>
+	</item></channel></rss>`
+	var added []string
+	p, feed := testPoller(t, magnetFeed, Feed{}, func(url string, f Feed) error {
+		added = append(added, url)
+		return nil
+	})
+	if err := p.Refresh("test"); err != nil {
+		t.Fatal(err)
+	}
+	if len(added) != 1 || added[0] != link {
+		t.Errorf("added %v, want %s", added, link)
+	}
+	if len(feed.Seen) != 1 {
+		t.Errorf("seen = %v, want the magnet handled", feed.Seen)
+	}
+}
+
+func TestPermanent(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{session.ErrExists, true},
+		{fmt.Errorf("%w: by infohash", session.ErrExists), true},
+		{fmt.Errorf("%w: no trackers", magnet.ErrInvalid), true},
+		{fmt.Errorf("fetching: %w", torrent.ErrInvalid), true},
+		{errors.New("connection refused"), false},
+	}
+	for _, tt := range tests {
+		if got := permanent(tt.err); got != tt.want {
+			t.Errorf("permanent(%v) = %t, want %t", tt.err, got, tt.want)
+		}
+	}
+}
@@ -2,10 +2,9 @@ module bit_torrent
 
 go 1.22.1
 
-require github.com/jackpal/bencode-go v1.0.2
-
 require (
-	github.com/gorilla/mux v1.8.1 // indirect
-	github.com/gorilla/websocket v1.5.3 // indirect
-	github.com/rs/cors v1.11.1 // indirect
+	github.com/gorilla/mux v1.8.1
+	github.com/gorilla/websocket v1.5.3
+	github.com/jackpal/bencode-go v1.0.2
+	github.com/rs/cors v1.11.1
 )
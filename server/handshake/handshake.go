@@ -7,10 +7,25 @@ import (
 
 type Handshake struct {
 	Pstr     string
+	Reserved [8]byte // Bits announcing protocol extensions
 	InfoHash [20]byte
 	PeerID   [20]byte
 }
 
+// extensionBit is the reserved bit announcing the extension protocol of
+// BEP 10, set in the sixth reserved byte
+const extensionBit = 0x10
+
+// EnableExtensions announces support for the extension protocol
+func (h *Handshake) EnableExtensions() {
+	h.Reserved[5] |= extensionBit
+}
+
+// SupportsExtensions reports whether the sender supports the extension protocol
+func (h *Handshake) SupportsExtensions() bool {
+	return h.Reserved[5]&extensionBit != 0
+}
+
 func New(infoHash, peerID [20]byte) *Handshake {
 	return &Handshake{
 		Pstr:     "BitTorrent protocol",
@@ -23,7 +38,7 @@ func (h *Handshake) Serialize() []byte {
 	buf[0] = byte(len(h.Pstr))
 	curr := 1
 	curr += copy(buf[curr:], h.Pstr)
-	curr += copy(buf[curr:], make([]byte, 8)) // 8 reserved bytes
+	curr += copy(buf[curr:], h.Reserved[:])
 	curr += copy(buf[curr:], h.InfoHash[:])
 	curr += copy(buf[curr:], h.PeerID[:])
 	return buf
@@ -48,13 +63,16 @@ func Read(r io.Reader) (*Handshake, error) {
 		return nil, err
 	}
 
+	var reserved [8]byte
 	var infoHash, peerID [20]byte
 
+	copy(reserved[:], handshakeBuf[pstrlen:pstrlen+8])
 	copy(infoHash[:], handshakeBuf[pstrlen+8:pstrlen+8+20])
 	copy(peerID[:], handshakeBuf[pstrlen+8+20:])
 
 	h := Handshake{
 		Pstr:     string(handshakeBuf[0:pstrlen]),
+		Reserved: reserved,
 		InfoHash: infoHash,
 		PeerID:   peerID,
 	}
@@ -0,0 +1,280 @@
+package hooks
+
+import (
+	"bit_torrent/session"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Defaults for hooks that do not set their own timeout or retries
+const (
+	DefaultTimeout = 30 * time.Second
+	DefaultRetries = 3
+)
+
+// MaxResults is how many hook results are kept for the API
+const MaxResults = 100
+
+// maxOutput bounds how much of a command's output is kept in its result
+const maxOutput = 4 << 10
+
+// retryDelay is the wait before the first webhook retry, doubled for each
+// one after it
+var retryDelay = time.Second
+
+// waitDelay is how long a command's output is still read once it exits or
+// is killed, for children it started that keep the output open
+const waitDelay = 2 * time.Second
+
+// A Hook runs a command or calls a webhook when a torrent event happens.
+// The arguments of Command may contain {event}, {name}, {infohash},
+// {save_path} and {error}, which are replaced for each run. URL receives
+// a POST with the Payload as JSON and is retried on failure.
+type Hook struct {
+	Event   session.Event
+	Command []string
+	URL     string
+	Timeout time.Duration // Per run or request
+	Retries *int          // Extra webhook attempts after the first fails, DefaultRetries when nil
+}
+
+// hookJSON is Hook with its timeout written like "30s"
+type hookJSON struct {
+	Event   session.Event `json:"event"`
+	Command []string      `json:"command,omitempty"`
+	URL     string        `json:"url,omitempty"`
+	Timeout string        `json:"timeout,omitempty"`
+	Retries *int          `json:"retries,omitempty"`
+}
+
+func (h Hook) MarshalJSON() ([]byte, error) {
+	j := hookJSON{Event: h.Event, Command: h.Command, URL: h.URL, Retries: h.Retries}
+	if h.Timeout > 0 {
+		j.Timeout = h.Timeout.String()
+	}
+	return json.Marshal(j)
+}
+
+func (h *Hook) UnmarshalJSON(data []byte) error {
+	var j hookJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	event, err := session.ParseEvent(string(j.Event))
+	if err != nil {
+		return err
+	}
+	*h = Hook{Event: event, Command: j.Command, URL: j.URL, Retries: j.Retries}
+	if h.Retries != nil && *h.Retries < 0 {
+		return errors.New("hook retries must not be negative")
+	}
+	if j.Timeout != "" {
+		if h.Timeout, err = time.ParseDuration(j.Timeout); err != nil {
+			return fmt.Errorf("invalid hook timeout: %v", err)
+		}
+	}
+	switch {
+	case len(h.Command) == 0 && h.URL == "":
+		return errors.New("hook needs a command or a url")
+	case len(h.Command) > 0 && h.URL != "":
+		return errors.New("hook has both a command and a url")
+	}
+	return nil
+}
+
+// Load reads a JSON list of hooks
+func Load(path string) ([]Hook, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var hooks []Hook
+	if err := json.Unmarshal(data, &hooks); err != nil {
+		return nil, fmt.Errorf("failed to parse hooks file: %v", err)
+	}
+	return hooks, nil
+}
+
+// Payload describes the torrent an event happened to
+type Payload struct {
+	Event    session.Event `json:"event"`
+	Name     string        `json:"name"`
+	InfoHash string        `json:"infohash"`
+	SavePath string        `json:"save_path"`
+	Error    string        `json:"error,omitempty"`
+	Time     time.Time     `json:"time"`
+}
+
+// Result is the outcome of one hook run
+type Result struct {
+	Hook     int           `json:"hook"` // Index in the configured hooks
+	Event    session.Event `json:"event"`
+	Name     string        `json:"name"`
+	InfoHash string        `json:"infohash"`
+	Started  time.Time     `json:"started"`
+	Duration float64       `json:"duration"` // Seconds, over every attempt
+	Attempts int           `json:"attempts"`
+	Output   string        `json:"output,omitempty"` // Command output or response status
+	Error    string        `json:"error,omitempty"`
+}
+
+// A Runner runs the hooks of each event and keeps their latest results
+type Runner struct {
+	hooks  []Hook
+	client *http.Client
+
+	mu      sync.Mutex
+	results []Result // Oldest first
+}
+
+// NewRunner returns a Runner for hooks
+func NewRunner(hooks []Hook) *Runner {
+	return &Runner{hooks: hooks, client: &http.Client{}}
+}
+
+// Hooks returns the configured hooks
+func (r *Runner) Hooks() []Hook {
+	return append([]Hook{}, r.hooks...)
+}
+
+// Results returns the latest hook results, newest first
+func (r *Runner) Results() []Result {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	results := make([]Result, len(r.results))
+	for i, result := range r.results {
+		results[len(results)-1-i] = result
+	}
+	return results
+}
+
+// Fire starts the hooks of event for t in the background
+func (r *Runner) Fire(t *session.Torrent, event session.Event) {
+	payload := Payload{
+		Event:    event,
+		Name:     t.Name,
+		InfoHash: t.HexHash(),
+		SavePath: t.SavePath(),
+		Time:     time.Now(),
+	}
+	if _, err := t.State(); err != nil {
+		payload.Error = err.Error()
+	}
+	for i, h := range r.hooks {
+		if h.Event == event {
+			go r.run(i, h, payload)
+		}
+	}
+}
+
+func (r *Runner) run(index int, h Hook, payload Payload) {
+	result := Result{
+		Hook:     index,
+		Event:    payload.Event,
+		Name:     payload.Name,
+		InfoHash: payload.InfoHash,
+		Started:  time.Now(),
+	}
+	timeout := h.Timeout
+	if timeout <= 0 {
+		timeout = DefaultTimeout
+	}
+
+	var err error
+	if len(h.Command) > 0 {
+		result.Attempts = 1
+		result.Output, err = runCommand(h.Command, payload, timeout)
+	} else {
+		retries := DefaultRetries
+		if h.Retries != nil {
+			retries = *h.Retries
+		}
+		for attempt := 0; attempt <= retries; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(1<<(attempt-1)) * retryDelay)
+			}
+			result.Attempts++
+			result.Output, err = r.post(h.URL, payload, timeout)
+			if err == nil {
+				break
+			}
+		}
+	}
+	result.Duration = time.Since(result.Started).Seconds()
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("Hook %d for %s of %s failed after %d attempts: %v\n", index, payload.Event, payload.Name, result.Attempts, err)
+	} else {
+		log.Printf("Hook %d for %s of %s succeeded\n", index, payload.Event, payload.Name)
+	}
+
+	r.mu.Lock()
+	r.results = append(r.results, result)
+	if len(r.results) > MaxResults {
+		r.results = r.results[len(r.results)-MaxResults:]
+	}
+	r.mu.Unlock()
+}
+
+// runCommand runs a command with its arguments filled in from payload and
+// returns its combined output
+func runCommand(command []string, payload Payload, timeout time.Duration) (string, error) {
+	replacer := strings.NewReplacer(
+		"{event}", string(payload.Event),
+		"{name}", payload.Name,
+		"{infohash}", payload.InfoHash,
+		"{save_path}", payload.SavePath,
+		"{error}", payload.Error,
+	)
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = replacer.Replace(arg)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.WaitDelay = waitDelay
+	output, err := cmd.CombinedOutput()
+	if len(output) > maxOutput {
+		output = output[:maxOutput]
+	}
+	if ctx.Err() != nil {
+		err = fmt.Errorf("timed out after %s", timeout)
+	}
+	return string(output), err
+}
+
+// post sends payload to url and succeeds on any 2xx response
+func (r *Runner) post(url string, payload Payload, timeout time.Duration) (string, error) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	res, err := r.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.Status, fmt.Errorf("webhook responded %s", res.Status)
+	}
+	return res.Status, nil
+}
@@ -0,0 +1,170 @@
+package hooks
+
+import (
+	"bit_torrent/session"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+var testPayload = Payload{
+	Event:    session.EventCompleted,
+	Name:     "debian.iso",
+	InfoHash: "0123456789abcdef0123456789abcdef01234567",
+	SavePath: "/data/debian.iso",
+}
+
+func retries(n int) *int {
+	return &n
+}
+
+func TestUnmarshalHook(t *testing.T) {
+	tests := []struct {
+		name    string
+		json    string
+		want    Hook
+		wantErr bool
+	}{
+		{"command", `{"event":"added","command":["echo","{name}"],"timeout":"5s"}`,
+			Hook{Event: session.EventAdded, Command: []string{"echo", "{name}"}, Timeout: 5 * time.Second}, false},
+		{"default retries", `{"event":"completed","url":"http://localhost/"}`,
+			Hook{Event: session.EventCompleted, URL: "http://localhost/"}, false},
+		{"no retries", `{"event":"completed","url":"http://localhost/","retries":0}`,
+			Hook{Event: session.EventCompleted, URL: "http://localhost/", Retries: retries(0)}, false},
+		{"negative retries", `{"event":"completed","url":"http://localhost/","retries":-1}`, Hook{}, true},
+		{"bad event", `{"event":"paused","command":["true"]}`, Hook{}, true},
+		{"bad timeout", `{"event":"added","command":["true"],"timeout":"soon"}`, Hook{}, true},
+		{"neither", `{"event":"added"}`, Hook{}, true},
+		{"both", `{"event":"added","command":["true"],"url":"http://localhost/"}`, Hook{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Hook
+			err := json.Unmarshal([]byte(tt.json), &h)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Unmarshal() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			got, _ := json.Marshal(h)
+			want, _ := json.Marshal(tt.want)
+			if string(got) != string(want) {
+				t.Errorf("Unmarshal() = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestCommandHook(t *testing.T) {
+	tests := []struct {
+		name    string
+		hook    Hook
+		output  string
+		err     string
+		maxTime time.Duration
+	}{
+		{"arguments filled in", Hook{Command: []string{"echo", "{event}", "{name}", "{infohash}", "{save_path}"}},
+			"completed debian.iso 0123456789abcdef0123456789abcdef01234567 /data/debian.iso\n", "", 5 * time.Second},
+		{"failure", Hook{Command: []string{"sh", "-c", "echo broken; exit 3"}}, "broken\n", "exit status 3", 5 * time.Second},
+		{"timeout", Hook{Command: []string{"sleep", "10"}, Timeout: 100 * time.Millisecond}, "", "timed out after 100ms", 5 * time.Second},
+		// A child left holding the output open does not keep the hook waiting
+		{"timeout with a child", Hook{Command: []string{"sh", "-c", "sleep 10 & sleep 10"}, Timeout: 100 * time.Millisecond},
+			"", "timed out after 100ms", waitDelay + 3*time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewRunner(nil)
+			r.run(0, tt.hook, testPayload)
+			result := r.Results()[0]
+			if result.Output != tt.output || result.Error != tt.err || result.Attempts != 1 {
+				t.Errorf("result = %q, %q after %d attempts, want %q, %q after 1", result.Output, result.Error, result.Attempts, tt.output, tt.err)
+			}
+			if took := time.Duration(result.Duration * float64(time.Second)); took > tt.maxTime {
+				t.Errorf("hook took %s, want at most %s", took, tt.maxTime)
+			}
+		})
+	}
+}
+
+func TestWebhook(t *testing.T) {
+	retryDelay = time.Millisecond
+	defer func() { retryDelay = time.Second }()
+
+	tests := []struct {
+		name     string
+		retries  *int
+		failures int // Requests answered 500 before the first 200
+		attempts int
+		success  bool
+	}{
+		{"first attempt", nil, 0, 1, true},
+		{"default retries", nil, 10, DefaultRetries + 1, false},
+		{"succeeds on a retry", nil, 2, 3, true},
+		{"no retries", retries(0), 1, 1, false},
+		{"two retries", retries(2), 10, 3, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var (
+				mu       sync.Mutex
+				requests int
+				received Payload
+			)
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				mu.Lock()
+				defer mu.Unlock()
+				requests++
+				if req.Header.Get("Content-Type") != "application/json" {
+					t.Errorf("Content-Type = %q", req.Header.Get("Content-Type"))
+				}
+				if err := json.NewDecoder(req.Body).Decode(&received); err != nil {
+					t.Errorf("decoding payload: %v", err)
+				}
+				if requests <= tt.failures {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+			}))
+			defer srv.Close()
+
+			r := NewRunner(nil)
+			r.run(0, Hook{URL: srv.URL, Retries: tt.retries}, testPayload)
+			result := r.Results()[0]
+			if result.Attempts != tt.attempts || requests != tt.attempts {
+				t.Errorf("%d attempts and %d requests, want %d", result.Attempts, requests, tt.attempts)
+			}
+			if (result.Error == "") != tt.success {
+				t.Errorf("result error = %q, want success %v", result.Error, tt.success)
+			}
+			if received != testPayload {
+				t.Errorf("received %+v, want %+v", received, testPayload)
+			}
+		})
+	}
+}
+
+func TestWebhookTimeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		select {
+		case <-release:
+		case <-req.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	r := NewRunner(nil)
+	r.run(0, Hook{URL: srv.URL, Timeout: 100 * time.Millisecond, Retries: retries(0)}, testPayload)
+	result := r.Results()[0]
+	if result.Attempts != 1 || !strings.Contains(result.Error, "deadline exceeded") {
+		t.Errorf("result = %q after %d attempts, want a deadline error after 1", result.Error, result.Attempts)
+	}
+	if result.Duration > 5 {
+		t.Errorf("webhook took %.1fs", result.Duration)
+	}
+}
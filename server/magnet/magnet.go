@@ -0,0 +1,69 @@
+// Package magnet parses magnet links and fetches the metadata they point
+// to from peers, using the extension protocol of BEP 10 and the
+// ut_metadata extension of BEP 9
+package magnet
+
+import (
+	"encoding/base32"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// ErrInvalid is returned for magnet links that cannot be added
+var ErrInvalid = errors.New("invalid magnet link")
+
+// Link is a parsed magnet link
+type Link struct {
+	InfoHash [20]byte
+	Name     string   // Display name, empty if the link has none
+	Trackers []string // Announce URLs in the order given
+}
+
+// Parse reads a magnet link with a BitTorrent infohash in hex or base32
+func Parse(uri string) (Link, error) {
+	u, err := url.Parse(strings.TrimSpace(uri))
+	if err != nil || !strings.EqualFold(u.Scheme, "magnet") {
+		return Link{}, fmt.Errorf("%w: %q", ErrInvalid, uri)
+	}
+	query := u.Query()
+
+	var link Link
+	found := false
+	for _, xt := range query["xt"] {
+		encoded, ok := strings.CutPrefix(strings.ToLower(xt), "urn:btih:")
+		if !ok {
+			continue
+		}
+		var hash []byte
+		switch len(encoded) {
+		case 40:
+			hash, err = hex.DecodeString(encoded)
+		case 32:
+			hash, err = base32.StdEncoding.DecodeString(strings.ToUpper(encoded))
+		default:
+			err = errors.New("wrong length")
+		}
+		if err != nil {
+			return Link{}, fmt.Errorf("%w: bad infohash %q", ErrInvalid, encoded)
+		}
+		copy(link.InfoHash[:], hash)
+		found = true
+		break
+	}
+	if !found {
+		return Link{}, fmt.Errorf("%w: no BitTorrent infohash in %q", ErrInvalid, uri)
+	}
+
+	link.Name = query.Get("dn")
+	seen := make(map[string]bool)
+	for _, tr := range query["tr"] {
+		if tr != "" && !seen[tr] {
+			seen[tr] = true
+			link.Trackers = append(link.Trackers, tr)
+		}
+	}
+	return link, nil
+}
@@ -0,0 +1,46 @@
+package magnet
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestParse(t *testing.T) {
+	hash := [20]byte{0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67, 0x89, 0xab, 0xcd, 0xef, 0x01, 0x23, 0x45, 0x67}
+	tests := []struct {
+		name string
+		uri  string
+		want Link
+		err  bool
+	}{
+		{"hex", "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&dn=debian.iso&tr=udp%3A%2F%2Ftracker.example%3A1337&tr=http%3A%2F%2Ft.example%2Fannounce",
+			Link{InfoHash: hash, Name: "debian.iso", Trackers: []string{"udp://tracker.example:1337", "http://t.example/announce"}}, false},
+		{"upper case hex", "magnet:?xt=urn:btih:0123456789ABCDEF0123456789ABCDEF01234567", Link{InfoHash: hash}, false},
+		{"base32", "magnet:?xt=urn:btih:AERUKZ4JVPG66AJDIVTYTK6N54ASGRLH", Link{InfoHash: hash}, false},
+		{"other hashes first", "magnet:?xt=urn:sha1:abc&xt=urn:btih:0123456789abcdef0123456789abcdef01234567", Link{InfoHash: hash}, false},
+		{"repeated tracker", "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef01234567&tr=udp://a:1&tr=udp://a:1&tr=",
+			Link{InfoHash: hash, Trackers: []string{"udp://a:1"}}, false},
+		{"not a magnet", "http://example.com/debian.torrent", Link{}, true},
+		{"no infohash", "magnet:?dn=debian.iso", Link{}, true},
+		{"short infohash", "magnet:?xt=urn:btih:0123456789abcdef", Link{}, true},
+		{"bad hex", "magnet:?xt=urn:btih:0123456789abcdef0123456789abcdef0123456z", Link{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			link, err := Parse(tt.uri)
+			if tt.err {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("Parse() error = %v, want %v", err, ErrInvalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(link, tt.want) {
+				t.Errorf("Parse() = %+v, want %+v", link, tt.want)
+			}
+		})
+	}
+}
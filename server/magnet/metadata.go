@@ -0,0 +1,310 @@
+package magnet
+
+import (
+	"bit_torrent/handshake"
+	"bit_torrent/message"
+	"bit_torrent/peers"
+	"bit_torrent/torrent"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// Limits on fetching metadata
+const (
+	MaxMetadataSize = 10 << 20
+	FetchTimeout    = 2 * time.Minute
+)
+
+const (
+	// metadataPieceSize is the size of every piece of metadata but the last
+	metadataPieceSize = 16 << 10
+	// metadataID is the id peers send ut_metadata messages to this client with
+	metadataID = 1
+	// extHandshake offers ut_metadata under metadataID
+	extHandshake = "d1:md11:ut_metadatai1eee"
+	// fetchPeers is how many peers are asked for metadata at once
+	fetchPeers = 8
+	// peerTimeout bounds the exchange with a single peer
+	peerTimeout = 30 * time.Second
+)
+
+// ut_metadata message types
+const (
+	metadataRequest = 0
+	metadataData    = 1
+	metadataReject  = 2
+)
+
+// fetchTimeout bounds FetchMetadata, replaced in tests
+var fetchTimeout = FetchTimeout
+
+// FetchMetadata asks the link's trackers for peers and downloads the info
+// dictionary from the first of them that has it. It returns .torrent file
+// contents holding the info dictionary and the tracker that peer came from,
+// along with the parsed metainfo.
+func FetchMetadata(link Link, peerID [20]byte) ([]byte, torrent.TorrentFile, error) {
+	if len(link.Trackers) == 0 {
+		// Peers can only be found through trackers
+		return nil, torrent.TorrentFile{}, fmt.Errorf("%w: no trackers", ErrInvalid)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), fetchTimeout)
+	defer cancel()
+
+	type candidate struct {
+		peer    peers.Peer
+		tracker string
+	}
+	candidates := make(chan candidate)
+	var trackers sync.WaitGroup
+	for _, tr := range link.Trackers {
+		trackers.Add(1)
+		go func(tr string) {
+			defer trackers.Done()
+			meta := torrent.TorrentFile{Announce: tr, InfoHash: link.InfoHash}
+			found, err := meta.RequestPeers(peerID, 0, 0, 1)
+			if err != nil {
+				log.Printf("Failed to get peers for %x from %s: %v\n", link.InfoHash, tr, err)
+				return
+			}
+			for _, peer := range found {
+				select {
+				case candidates <- candidate{peer, tr}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(tr)
+	}
+	go func() {
+		trackers.Wait()
+		close(candidates)
+	}()
+
+	type result struct {
+		info    []byte
+		tracker string
+	}
+	var (
+		results = make(chan result)
+		workers sync.WaitGroup
+		mu      sync.Mutex
+		seen    = make(map[string]bool)
+		lastErr = errors.New("trackers returned no peers")
+	)
+	for i := 0; i < fetchPeers; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for c := range candidates {
+				mu.Lock()
+				tried := seen[c.peer.String()]
+				seen[c.peer.String()] = true
+				mu.Unlock()
+				if tried {
+					continue
+				}
+
+				info, err := fetchFrom(ctx, c.peer, link.InfoHash, peerID)
+				if err != nil {
+					mu.Lock()
+					lastErr = fmt.Errorf("%s: %w", c.peer, err)
+					mu.Unlock()
+					continue
+				}
+				select {
+				case results <- result{info, c.tracker}:
+				case <-ctx.Done():
+				}
+				return
+			}
+		}()
+	}
+	go func() {
+		workers.Wait()
+		close(results)
+	}()
+
+	var r result
+	select {
+	case found, ok := <-results:
+		if !ok {
+			mu.Lock()
+			defer mu.Unlock()
+			return nil, torrent.TorrentFile{}, fmt.Errorf("no peer sent the metadata for %x, last error: %w", link.InfoHash, lastErr)
+		}
+		r = found
+	case <-ctx.Done():
+		return nil, torrent.TorrentFile{}, fmt.Errorf("no peer sent the metadata for %x within %s", link.InfoHash, fetchTimeout)
+	}
+
+	var buf bytes.Buffer
+	buf.WriteString("d8:announce" + strconv.Itoa(len(r.tracker)) + ":" + r.tracker + "4:info")
+	buf.Write(r.info)
+	buf.WriteString("e")
+	meta, err := torrent.Parse(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		return nil, torrent.TorrentFile{}, err
+	}
+	return buf.Bytes(), meta, nil
+}
+
+// fetchFrom downloads the info dictionary of the torrent with infoHash from
+// peer and checks it against the infohash
+func fetchFrom(ctx context.Context, peer peers.Peer, infoHash, peerID [20]byte) ([]byte, error) {
+	dialer := net.Dialer{Timeout: 10 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", peer.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	// Closing the connection ends a read in progress once the fetch is over
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	conn.SetDeadline(time.Now().Add(peerTimeout))
+
+	hs := handshake.New(infoHash, peerID)
+	hs.EnableExtensions()
+	if _, err := conn.Write(hs.Serialize()); err != nil {
+		return nil, err
+	}
+	res, err := handshake.Read(conn)
+	if err != nil {
+		return nil, err
+	}
+	if res.InfoHash != infoHash {
+		return nil, fmt.Errorf("expected infohash %x but got %x", infoHash, res.InfoHash)
+	}
+	if !res.SupportsExtensions() {
+		return nil, errors.New("peer does not support the extension protocol")
+	}
+	if err := sendExtended(conn, 0, []byte(extHandshake)); err != nil {
+		return nil, err
+	}
+
+	var (
+		info     []byte
+		received []bool
+		left     int
+	)
+	for {
+		msg, err := message.Read(conn)
+		if err != nil {
+			return nil, err
+		}
+		if msg == nil || msg.ID != message.MsgExtended || len(msg.Payload) == 0 {
+			continue
+		}
+
+		switch msg.Payload[0] {
+		case 0:
+			if info != nil {
+				continue
+			}
+			remoteID, size, err := parseExtHandshake(msg.Payload[1:])
+			if err != nil {
+				return nil, err
+			}
+			info = make([]byte, size)
+			received = make([]bool, (size+metadataPieceSize-1)/metadataPieceSize)
+			left = len(received)
+			for piece := range received {
+				request := fmt.Sprintf("d8:msg_typei%de5:piecei%dee", metadataRequest, piece)
+				if err := sendExtended(conn, remoteID, []byte(request)); err != nil {
+					return nil, err
+				}
+			}
+		case metadataID:
+			if info == nil {
+				continue
+			}
+			msgType, piece, data, err := parseMetadataMsg(msg.Payload[1:])
+			if err != nil {
+				return nil, err
+			}
+			if msgType == metadataReject {
+				return nil, fmt.Errorf("peer rejected the request for metadata piece %d", piece)
+			}
+			if msgType != metadataData {
+				continue
+			}
+			if piece < 0 || piece >= len(received) {
+				return nil, fmt.Errorf("peer sent metadata piece %d of %d", piece, len(received))
+			}
+			begin := piece * metadataPieceSize
+			if want := min(metadataPieceSize, len(info)-begin); len(data) != want {
+				return nil, fmt.Errorf("metadata piece %d is %d bytes, expected %d", piece, len(data), want)
+			}
+			if received[piece] {
+				continue
+			}
+			copy(info[begin:], data)
+			received[piece] = true
+			left--
+			if left == 0 {
+				if sha1.Sum(info) != infoHash {
+					return nil, errors.New("metadata does not match the infohash")
+				}
+				return info, nil
+			}
+		}
+	}
+}
+
+// sendExtended sends payload as the extension message with id, 0 being
+// the extension handshake
+func sendExtended(conn net.Conn, id int, payload []byte) error {
+	msg := message.Message{ID: message.MsgExtended, Payload: append([]byte{byte(id)}, payload...)}
+	_, err := conn.Write(msg.Serialize())
+	return err
+}
+
+// parseExtHandshake reads the id the peer takes ut_metadata messages under
+// and the size of the metadata from its extension handshake
+func parseExtHandshake(payload []byte) (int, int, error) {
+	decoded, err := bencode.Decode(bytes.NewReader(payload))
+	if err != nil {
+		return 0, 0, fmt.Errorf("bad extension handshake: %w", err)
+	}
+	dict, _ := decoded.(map[string]interface{})
+	extensions, _ := dict["m"].(map[string]interface{})
+	id, _ := extensions["ut_metadata"].(int64)
+	if id <= 0 || id > 255 {
+		return 0, 0, errors.New("peer does not offer metadata")
+	}
+	size, _ := dict["metadata_size"].(int64)
+	if size <= 0 || size > MaxMetadataSize {
+		return 0, 0, fmt.Errorf("peer announced %d bytes of metadata", size)
+	}
+	return int(id), int(size), nil
+}
+
+// parseMetadataMsg reads a ut_metadata message, a dictionary followed by
+// the piece's data for data messages
+func parseMetadataMsg(payload []byte) (msgType, piece int, data []byte, err error) {
+	r := bytes.NewReader(payload)
+	br := bufio.NewReader(r)
+	decoded, err := bencode.Decode(br)
+	if err != nil {
+		return 0, 0, nil, fmt.Errorf("bad metadata message: %w", err)
+	}
+	dict, _ := decoded.(map[string]interface{})
+	t, ok := dict["msg_type"].(int64)
+	p, ok2 := dict["piece"].(int64)
+	if !ok || !ok2 {
+		return 0, 0, nil, errors.New("bad metadata message: missing msg_type or piece")
+	}
+	// Whatever the decoder did not consume follows the dictionary
+	used := len(payload) - r.Len() - br.Buffered()
+	return int(t), int(p), payload[used:], nil
+}
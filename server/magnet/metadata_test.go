@@ -0,0 +1,191 @@
+package magnet
+
+import (
+	"bit_torrent/handshake"
+	"bit_torrent/message"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+var testPeerID = [20]byte{'-', 'T', 'E', '0', '0', '0', '1', '-'}
+
+// testInfo is an info dictionary spanning two pieces of metadata
+var testInfo = "d6:lengthi16384000e4:name10:debian.iso12:piece lengthi16384e6:pieces20000:" + strings.Repeat("x", 20000) + "e"
+
+// fakePeer serves testInfo over ut_metadata, behaving as behaviour says,
+// and returns a tracker URL that hands out its address
+func fakePeer(t *testing.T, infoHash [20]byte, behaviour string) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go servePeer(conn, infoHash, behaviour)
+		}
+	}()
+
+	addr := ln.Addr().(*net.TCPAddr)
+	compact := append(addr.IP.To4(), byte(addr.Port>>8), byte(addr.Port))
+	tracker := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "d8:intervali900e5:peers%d:%se", len(compact), string(compact))
+	}))
+	t.Cleanup(tracker.Close)
+	return tracker.URL + "/announce"
+}
+
+func servePeer(conn net.Conn, infoHash [20]byte, behaviour string) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	if _, err := handshake.Read(r); err != nil {
+		return
+	}
+	hs := handshake.New(infoHash, [20]byte{'-', 'F', 'K'})
+	if behaviour != "no extensions" {
+		hs.EnableExtensions()
+	}
+	conn.Write(hs.Serialize())
+	if behaviour == "no extensions" {
+		return
+	}
+
+	info := []byte(testInfo)
+	if behaviour == "corrupt" {
+		info = bytes.Replace(info, []byte("debian"), []byte("ubuntu"), 1)
+	}
+	// Messages the client does not ask for come first, and are skipped
+	conn.Write(message.FormatHave(0).Serialize())
+	conn.Write((*message.Message)(nil).Serialize())
+	handshake := fmt.Sprintf("d1:md11:ut_metadatai3ee13:metadata_sizei%dee", len(info))
+	conn.Write((&message.Message{ID: message.MsgExtended, Payload: append([]byte{0}, handshake...)}).Serialize())
+
+	for {
+		msg, err := message.Read(r)
+		if err != nil {
+			return
+		}
+		if msg == nil || msg.ID != message.MsgExtended || len(msg.Payload) == 0 || msg.Payload[0] != 3 {
+			continue
+		}
+		var request struct {
+			Type  int `bencode:"msg_type"`
+			Piece int `bencode:"piece"`
+		}
+		if err := bencode.Unmarshal(bytes.NewReader(msg.Payload[1:]), &request); err != nil {
+			return
+		}
+		var payload []byte
+		if behaviour == "reject" {
+			payload = fmt.Appendf([]byte{1}, "d8:msg_typei2e5:piecei%dee", request.Piece)
+		} else {
+			begin := request.Piece * metadataPieceSize
+			end := min(begin+metadataPieceSize, len(info))
+			payload = fmt.Appendf([]byte{1}, "d8:msg_typei1e5:piecei%de10:total_sizei%dee", request.Piece, len(info))
+			payload = append(payload, info[begin:end]...)
+		}
+		conn.Write((&message.Message{ID: message.MsgExtended, Payload: payload}).Serialize())
+	}
+}
+
+func TestFetchMetadata(t *testing.T) {
+	infoHash := sha1.Sum([]byte(testInfo))
+	tests := []struct {
+		behaviour string
+		ok        bool
+	}{
+		{"serves metadata", true},
+		{"no extensions", false},
+		{"corrupt", false},
+		{"reject", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.behaviour, func(t *testing.T) {
+			tracker := fakePeer(t, infoHash, tt.behaviour)
+			link := Link{InfoHash: infoHash, Trackers: []string{tracker}}
+			data, meta, err := FetchMetadata(link, testPeerID)
+			if !tt.ok {
+				if err == nil {
+					t.Fatal("FetchMetadata() succeeded")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.InfoHash != infoHash || meta.Name != "debian.iso" || meta.Announce != tracker || len(meta.PieceHashes) != 1000 {
+				t.Errorf("FetchMetadata() = %+v", meta)
+			}
+			want := "d8:announce" + fmt.Sprint(len(tracker)) + ":" + tracker + "4:info" + testInfo + "e"
+			if string(data) != want {
+				t.Errorf("FetchMetadata() data = %.80q..., want %.80q...", data, want)
+			}
+		})
+	}
+}
+
+func TestFetchMetadataErrors(t *testing.T) {
+	timeout := fetchTimeout
+	fetchTimeout = 200 * time.Millisecond
+	defer func() { fetchTimeout = timeout }()
+
+	// A peer that accepts connections and never answers
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	silent := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		port := binary.BigEndian.AppendUint16(nil, uint16(ln.Addr().(*net.TCPAddr).Port))
+		fmt.Fprintf(w, "d8:intervali900e5:peers6:\x7f\x00\x00\x01%se", port)
+	}))
+	defer silent.Close()
+	empty := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	defer empty.Close()
+
+	tests := []struct {
+		name     string
+		trackers []string
+		err      error
+	}{
+		{"no trackers", nil, ErrInvalid},
+		{"no peers", []string{empty.URL + "/announce"}, nil},
+		{"tracker down", []string{"http://127.0.0.1:1/announce"}, nil},
+		{"silent peer", []string{silent.URL + "/announce"}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			start := time.Now()
+			_, _, err := FetchMetadata(Link{InfoHash: [20]byte{1}, Trackers: tt.trackers}, testPeerID)
+			if err == nil {
+				t.Fatal("FetchMetadata() succeeded")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("FetchMetadata() error = %v, want %v", err, tt.err)
+			}
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("FetchMetadata() took %s", took)
+			}
+		})
+	}
+}
@@ -1,17 +1,31 @@
 package main
 
 import (
+	"bit_torrent/feeds"
+	"bit_torrent/hooks"
+	"bit_torrent/magnet"
 	"bit_torrent/p2p"
+	"bit_torrent/session"
+	"bit_torrent/storage"
 	"bit_torrent/torrent"
+	"bit_torrent/watch"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
@@ -25,16 +39,72 @@ var upgrader = websocket.Upgrader{
 	},
 }
 
+// mu guards clients and writes to them, which a WebSocket connection only
+// allows one at a time
 var mu sync.Mutex
 
 // Clients map to store all WebSocket connections
 var clients = make(map[*websocket.Conn]bool)
 
+// removeClient forgets a WebSocket connection
+func removeClient(ws *websocket.Conn) {
+	mu.Lock()
+	defer mu.Unlock()
+	delete(clients, ws)
+}
+
 // File uploads directory
 const uploadsDir = "./uploads"
 
 const outputDir = "./output"
 
+// File the session keeps its torrent list in across restarts
+const sessionFile = "./session.json"
+
+// File the feed subscriptions and the items they have handled are kept in
+const feedsFile = "./feeds.json"
+
+// Port peers connect to, set on the command line
+var peerPort = flag.Int("port", int(torrent.Port), "TCP port incoming peers connect to, announced to trackers")
+
+// Size of each torrent's write-back disk cache, set on the command line
+var cacheSizeMiB = flag.Int64("cache-size", 64, "write-back disk cache per torrent in MiB, 0 disables it")
+
+// Where data goes while downloading and once complete, set on the command line
+var (
+	incompleteDir = flag.String("incomplete-dir", "", "directory torrents download into, the output directory when empty")
+	completeDir   = flag.String("complete-dir", "", "directory finished torrents move to, none when empty")
+	dataDirs      = flag.String("data-dirs", "", "comma separated directories, besides the output, incomplete and complete ones, torrents may be saved in")
+)
+
+// Folders to add .torrent files from, set on the command line
+var (
+	watchFile     = flag.String("watch", "", "JSON file of folders to add .torrent files from automatically")
+	watchInterval = flag.Duration("watch-interval", watch.DefaultInterval, "how often the watch folders are scanned")
+)
+
+// JSON file listing the hooks run on torrent events, set on the command line
+var hooksFile = flag.String("hooks", "", "JSON file of commands and webhooks to run when torrents are added, complete or fail")
+
+// Whether progress updates over the WebSocket are followed by the piece map
+var pieceMapUpdates = flag.Bool("piece-map-updates", false, "send each torrent's piece map over the WebSocket with its progress")
+
+// Queue and rate limits, set on the command line
+var (
+	maxActiveDownloads = flag.Int("max-active-downloads", 3, "torrents downloading at once, 0 for no limit")
+	maxActiveSeeds     = flag.Int("max-active-seeds", 5, "torrents seeding at once, 0 for no limit")
+	downloadLimit      = flag.Int64("download-limit", 0, "download rate of all torrents together in bytes per second, 0 for no limit")
+	uploadLimit        = flag.Int64("upload-limit", 0, "upload rate of all torrents together in bytes per second, 0 for no limit")
+	altDownloadLimit   = flag.Int64("alt-download-limit", 0, "download rate while the alternative limits apply, in bytes per second")
+	altUploadLimit     = flag.Int64("alt-upload-limit", 0, "upload rate while the alternative limits apply, in bytes per second")
+	altSchedule        = flag.String("alt-schedule", "", `when the alternative limits apply, such as "mon-fri 09:00-18:00; sat 10:00-12:00"`)
+	seedRatio          = flag.Float64("seed-ratio", 0, "share ratio at which torrents stop seeding, 0 for no limit")
+	seedTime           = flag.Duration("seed-time", 0, "seeding time after which torrents stop seeding, 0 for no limit")
+	seedIdleTime       = flag.Duration("seed-idle-time", 0, "time seeding without uploading after which torrents stop seeding, 0 for no limit")
+	seedAction         = flag.String("seed-action", "pause", "what to do with torrents that reach a seeding goal: pause, remove or remove-data")
+	stallTimeout       = flag.Duration("stall-timeout", 2*time.Minute, "time without a finished piece after which a download stops counting against the limit, 0 to never")
+)
+
 // Handle WebSocket connections and register clients
 func wsHandler(w http.ResponseWriter, r *http.Request) {
 	// Upgrade the HTTP connection to a WebSocket
@@ -46,16 +116,20 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 	defer ws.Close()
 
 	// Register the client connection
+	mu.Lock()
 	clients[ws] = true
+	mu.Unlock()
 	log.Println("WebSocket client connected")
 
 	// Ping the client every 30 seconds to keep the connection alive
 	go func() {
 		for {
+			mu.Lock()
 			err := ws.WriteMessage(websocket.PingMessage, nil)
+			mu.Unlock()
 			if err != nil {
 				log.Println("Ping error:", err)
-				delete(clients, ws)
+				removeClient(ws)
 				return
 			}
 			time.Sleep(30 * time.Second) // Ping every 30 seconds
@@ -67,68 +141,267 @@ func wsHandler(w http.ResponseWriter, r *http.Request) {
 		_, _, err := ws.ReadMessage()
 		if err != nil {
 			log.Println("WebSocket read error:", err)
-			delete(clients, ws) // Remove the client on error
+			removeClient(ws) // Remove the client on error
 			break
 		}
 	}
 }
 
-// Torrent initialization function
-func initializeTorrent(filePath string, torrentMap *torrent.TorrentMap, outputFilePath string, uploadFolderPath string, progressFilePath string) {
-	fmt.Printf("Initializing torrent from file: %s\n", filePath)
+// Broadcast progress to all connected WebSocket clients. Every message names
+// its torrent by infohash under "torrentFile".
+func broadcastProgress(progress p2p.ProgressData, infoHash string) {
+	broadcast(map[string]interface{}{
+		"torrentFile": infoHash,
+		"progress":    progress,
+	})
+}
 
-	// Create a progress channel for the current torrent file
-	progressChan := make(chan p2p.ProgressData)
+// Broadcast the piece map of a torrent to all connected WebSocket clients
+func broadcastPieceMap(pieces p2p.PieceMap, infoHash string) {
+	broadcast(map[string]interface{}{
+		"torrentFile": infoHash,
+		"pieces":      pieces,
+	})
+}
 
-	go func() {
-		tf, err := torrent.Open(filePath)
-		if err != nil {
-			log.Println("Torrent download failed:", err)
-			close(progressChan)
-			return
-		}
+// Broadcast recheck progress to all connected WebSocket clients
+func broadcastRecheck(progress p2p.RecheckProgress, infoHash string) {
+	broadcast(map[string]interface{}{
+		"torrentFile": infoHash,
+		"recheck":     progress,
+	})
+}
 
-		// Start downloading and send progress updates
-		err = tf.DownloadToFile(outputFilePath, progressChan, torrentMap, uploadFolderPath, progressFilePath) 
+func broadcast(message map[string]interface{}) {
+	mu.Lock()
+	defer mu.Unlock()
+	for client := range clients {
+		err := client.WriteJSON(message)
 		if err != nil {
-			log.Println("Torrent download failed:", err)
-			close(progressChan)
-			return
+			log.Printf("WebSocket write error: %v", err)
+			client.Close()
+			delete(clients, client)
 		}
+	}
+}
 
-		// Close progress channel when done
-		close(progressChan)
-	}()
+// storageDefaults are the storage options of torrents added without any
+func storageDefaults() storage.Options {
+	opts, _ := parseStorageOptions("", "")
+	return opts
+}
 
-	// Listen for progress updates and broadcast to WebSocket clients
-	for progress := range progressChan {
-		// Include the torrent file name as part of the progress data
-		broadcastProgress(progress, filepath.Base(filePath))
+// parseStorageOptions validates the storage backend and allocation mode of a request
+func parseStorageOptions(kind string, allocation string) (storage.Options, error) {
+	opts := storage.Options{CacheSize: *cacheSizeMiB << 20}
+	var err error
+	opts.Kind, err = storage.ParseKind(kind)
+	if err != nil {
+		return opts, err
 	}
+	opts.Allocation, err = storage.ParseAllocation(allocation)
+	return opts, err
 }
 
-// Broadcast progress to all connected WebSocket clients, with torrent identifier
-func broadcastProgress(progress p2p.ProgressData, torrentFile string) {
-	for client := range clients {
-		// Include the torrentFile in the progress update
-		message := map[string]interface{}{
-			"torrentFile": torrentFile,
-			"progress":    progress,
+// findTorrent resolves the torrent a request refers to, either by its
+// infohash or by the name of its upload folder
+func findTorrent(w http.ResponseWriter, r *http.Request, sess *session.Manager) (*session.Torrent, bool) {
+	var t *session.Torrent
+	var err error
+	if h := r.URL.Query().Get("hash"); h != "" {
+		hash, parseErr := session.ParseHash(h)
+		if parseErr != nil {
+			http.Error(w, parseErr.Error(), http.StatusBadRequest)
+			return nil, false
 		}
+		t, err = sess.Get(hash)
+	} else {
+		f := r.URL.Query().Get("filepath")
+		if f == "" {
+			http.Error(w, "Filepath is required", http.StatusBadRequest)
+			return nil, false
+		}
+		t, err = sess.FindByName(f)
+	}
+	if err != nil {
+		writeSessionError(w, err)
+		return nil, false
+	}
+	return t, true
+}
 
-		mu.Lock() // Lock the mutex before writing
-		err := client.WriteJSON(message)
-		mu.Unlock() // Unlock the mutex after writing
-		if err != nil {
-			log.Printf("WebSocket write error: %v", err)
-			client.Close()
-			delete(clients, client)
+// addUploads adds upload folders the session does not know about yet,
+// such as those from before the session file existed, paused
+func addUploads(sess *session.Manager) {
+	folders, err := os.ReadDir(uploadsDir)
+	if err != nil {
+		log.Printf("Failed to read uploads folder: %v", err)
+		return
+	}
+	storageOpts := storageDefaults()
+	for _, folder := range folders {
+		if !folder.IsDir() {
+			continue
+		}
+		if _, err := sess.FindByName(folder.Name()); err == nil {
+			continue
+		}
+		torrentPath := filepath.Join(uploadsDir, folder.Name(), folder.Name()+".torrent")
+		if _, err := sess.Add(torrentPath, folder.Name(), session.AddOptions{Storage: storageOpts}); err != nil {
+			log.Printf("Skipping upload folder %s: %v", folder.Name(), err)
+		}
+	}
+}
+
+// importTorrent saves the contents of a .torrent file, already decoded
+// into meta, in the uploads folder under name and adds it to the session,
+// paused. Torrents the
+// session already has by infohash are refused with session.ErrExists
+// before anything is written. A name that is already taken gets a number
+// appended instead, the returned torrent has the name it was added under.
+func importTorrent(sess *session.Manager, data []byte, meta torrent.TorrentFile, name string, opts session.AddOptions) (*session.Torrent, error) {
+	if _, err := sess.Get(meta.InfoHash); err == nil {
+		return nil, session.ErrExists
+	}
+
+	name, folder, err := claimFolder(sess, name)
+	if err != nil {
+		return nil, fmt.Errorf("unable to create folder for the torrent file: %v", err)
+	}
+	torrentPath := filepath.Join(folder, name+".torrent")
+	if err := os.WriteFile(torrentPath, data, 0644); err != nil {
+		os.RemoveAll(folder)
+		return nil, fmt.Errorf("unable to save torrent file: %v", err)
+	}
+	t, err := sess.Add(torrentPath, name, opts)
+	if t == nil {
+		// Refused, so it must not come back as an upload folder on restart
+		os.RemoveAll(folder)
+	}
+	return t, err
+}
+
+// claimFolder creates the upload folder of a new torrent called name, or
+// of "name-2", "name-3" and so on when another torrent or folder already
+// has that name. Creating the folder is what claims the name, so two
+// imports never end up sharing one.
+func claimFolder(sess *session.Manager, name string) (string, string, error) {
+	if err := os.MkdirAll(uploadsDir, os.ModePerm); err != nil {
+		return "", "", err
+	}
+	candidate := name
+	for i := 2; ; i++ {
+		if _, err := sess.FindByName(candidate); errors.Is(err, session.ErrNotFound) {
+			folder := filepath.Join(uploadsDir, candidate)
+			err := os.Mkdir(folder, os.ModePerm)
+			if err == nil {
+				return candidate, folder, nil
+			}
+			if !errors.Is(err, os.ErrExist) {
+				return "", "", err
+			}
 		}
+		candidate = fmt.Sprintf("%s-%d", name, i)
+	}
+}
+
+// addFromURL fetches a .torrent file and imports it under the name in its
+// metainfo
+func addFromURL(sess *session.Manager, rawURL string, opts session.AddOptions) (*session.Torrent, error) {
+	data, meta, err := torrent.Fetch(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	return importTorrent(sess, data, meta, torrentName(meta), opts)
+}
+
+// addMagnet fetches the metadata of a magnet link from peers and imports
+// it under the name in that metadata
+func addMagnet(sess *session.Manager, uri string, opts session.AddOptions) (*session.Torrent, error) {
+	link, err := magnet.Parse(uri)
+	if err != nil {
+		return nil, err
+	}
+	// Fetching takes a while, not worth it for a torrent the session has
+	if _, err := sess.Get(link.InfoHash); err == nil {
+		return nil, session.ErrExists
+	}
+	var peerID [20]byte
+	if _, err := rand.Read(peerID[:]); err != nil {
+		return nil, err
+	}
+	data, meta, err := magnet.FetchMetadata(link, peerID)
+	if err != nil {
+		return nil, err
+	}
+	return importTorrent(sess, data, meta, torrentName(meta), opts)
+}
+
+// torrentName turns the name in a torrent's metainfo into a folder name,
+// falling back to the infohash when nothing usable is left
+func torrentName(meta torrent.TorrentFile) string {
+	name := filepath.Base(filepath.Clean(string(filepath.Separator) + meta.Name))
+	if name == "." || name == string(filepath.Separator) {
+		return hex.EncodeToString(meta.InfoHash[:])
+	}
+	return name
+}
+
+// writeImportError reports why a torrent could not be imported, torrent
+// files that do not parse being the client's fault
+func writeImportError(w http.ResponseWriter, err error) {
+	if errors.Is(err, torrent.ErrInvalid) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeSessionError(w, err)
+}
+
+// addWatched adds a file found in a watch folder, a .torrent file or a
+// .magnet file holding a magnet link
+func addWatched(sess *session.Manager, path string, folder watch.Folder) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	opts := session.AddOptions{
+		Storage:  storageDefaults(),
+		SaveDir:  folder.SaveDir,
+		Category: folder.Category,
+		Start:    true,
+	}
+	if strings.EqualFold(filepath.Ext(path), ".magnet") {
+		_, err = addMagnet(sess, string(data), opts)
+		return err
+	}
+	meta, err := torrent.Parse(bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	_, err = importTorrent(sess, data, meta, torrentName(meta), opts)
+	return err
+}
+
+// writeSessionError maps errors from the session to HTTP status codes
+func writeSessionError(w http.ResponseWriter, err error) {
+	var transitionErr *session.TransitionError
+	switch {
+	case errors.Is(err, session.ErrNotFound), errors.Is(err, session.ErrNoCategory):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case errors.Is(err, session.ErrInvalidLabel), errors.Is(err, session.ErrInvalidOptions), errors.Is(err, session.ErrDirNotAllowed):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+	case errors.Is(err, session.ErrExists), errors.Is(err, session.ErrNotRunning), errors.Is(err, storage.ErrDestinationExists), errors.As(err, &transitionErr):
+		http.Error(w, err.Error(), http.StatusConflict)
+	case errors.Is(err, session.ErrOutsideOutputDir):
+		http.Error(w, err.Error(), http.StatusForbidden)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
 	}
 }
 
-// UploadHandler - handles uploading .torrent files via HTTP POST
-func UploadHandler(w http.ResponseWriter, r *http.Request, torrentMap *torrent.TorrentMap) {
+// UploadHandler - handles uploading .torrent files via HTTP POST, with the
+// options read by parseAddOptions
+func UploadHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
 	if r.Method != "POST" {
 		http.Error(w, "Invalid request method", http.StatusMethodNotAllowed)
 		return
@@ -149,39 +422,120 @@ func UploadHandler(w http.ResponseWriter, r *http.Request, torrentMap *torrent.T
 	}
 	defer file.Close()
 
-	fileNameWithoutExt := strings.TrimSuffix(handler.Filename, filepath.Ext(handler.Filename))
-
-	uploadFolderPath := filepath.Join(uploadsDir, fileNameWithoutExt)
+	opts, err := parseAddOptions(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	// Create the uploads directory if it doesn't exist
-	err = os.MkdirAll(uploadFolderPath, os.ModePerm)
+	data, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, "Error reading file", http.StatusBadRequest)
+		return
+	}
+	// The folder is named after the torrent, not whatever the file was called
+	meta, err := torrent.Parse(bytes.NewReader(data))
 	if err != nil {
-		http.Error(w, "Unable to create folder for the uploaded file", http.StatusInternalServerError)
+		writeImportError(w, err)
 		return
 	}
-	// Save the uploaded file to the created folder
-	filePath := filepath.Join(uploadFolderPath, handler.Filename)
-	dst, err := os.Create(filePath)
+	t, err := importTorrent(sess, data, meta, torrentName(meta), opts)
 	if err != nil {
-		http.Error(w, "Unable to save uploaded file", http.StatusInternalServerError)
+		writeImportError(w, err)
 		return
 	}
-	defer dst.Close()
 
-	_, err = io.Copy(dst, file)
+	fmt.Fprintf(w, "File uploaded successfully: %s as %s\n", handler.Filename, t.Name)
+}
+
+// AddURLHandler - fetches the .torrent file at url and adds it under the
+// name in its metainfo, with the same options as an upload
+func AddURLHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	if err := r.ParseForm(); err != nil {
+		http.Error(w, "Unable to parse form data", http.StatusBadRequest)
+		return
+	}
+	opts, err := parseAddOptions(r)
 	if err != nil {
-		http.Error(w, "Error writing file", http.StatusInternalServerError)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rawURL := r.FormValue("url")
+	if rawURL == "" {
+		http.Error(w, "Url is required", http.StatusBadRequest)
 		return
 	}
 
-	progressInfoFilePath := filepath.Join(uploadFolderPath, "torrent_progress_info.json")
+	data, meta, err := torrent.Fetch(rawURL)
+	switch {
+	case errors.Is(err, torrent.ErrInvalidURL), errors.Is(err, torrent.ErrTooLarge), errors.Is(err, torrent.ErrInvalid):
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	case err != nil:
+		http.Error(w, fmt.Sprintf("Failed to fetch torrent file: %v", err), http.StatusBadGateway)
+		return
+	}
+	t, err := importTorrent(sess, data, meta, torrentName(meta), opts)
+	if err != nil {
+		writeImportError(w, err)
+		return
+	}
 
-	outputFilePath := filepath.Join(outputDir, fileNameWithoutExt)
+	fmt.Fprintf(w, "Torrent added: %s\n", t.Name)
+}
 
-	// Start torrent download in the background
-	go initializeTorrent(filePath, torrentMap, outputFilePath, uploadFolderPath, progressInfoFilePath)
+// parseAddOptions reads the options of a torrent being added from a parsed
+// form: storage and allocation, save_path, an absolute directory inside the
+// data directories, category, tags, which may be repeated or a comma
+// separated list, priorities, one per file in a comma separated list,
+// download_limit and upload_limit in bytes per second, sequential,
+// skip_hash_check, and paused to not start it. The session checks them
+// against the torrent.
+func parseAddOptions(r *http.Request) (session.AddOptions, error) {
+	// Optional storage backend and allocation mode, default to plain sparse-growing files
+	storageOpts, err := parseStorageOptions(r.FormValue("storage"), r.FormValue("allocation"))
+	if err != nil {
+		return session.AddOptions{}, err
+	}
+	opts := session.AddOptions{
+		Storage:  storageOpts,
+		SaveDir:  r.FormValue("save_path"),
+		Category: r.FormValue("category"),
+		Tags:     r.Form["tags"],
+	}
 
-	fmt.Fprintf(w, "File uploaded successfully: %s\n", handler.Filename)
+	if v := r.FormValue("priorities"); v != "" {
+		for _, s := range strings.Split(v, ",") {
+			priority, err := p2p.ParsePriority(strings.TrimSpace(s))
+			if err != nil {
+				return session.AddOptions{}, err
+			}
+			opts.Priorities = append(opts.Priorities, priority)
+		}
+	}
+	for param, limit := range map[string]*int64{"download_limit": &opts.Limits.Download, "upload_limit": &opts.Limits.Upload} {
+		v := r.FormValue(param)
+		if v == "" {
+			continue
+		}
+		rate, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || rate < 0 {
+			return session.AddOptions{}, fmt.Errorf("%s must be a number of bytes per second", param)
+		}
+		*limit = rate
+	}
+	paused := false
+	for param, value := range map[string]*bool{"sequential": &opts.Sequential, "skip_hash_check": &opts.SkipHashCheck, "paused": &paused} {
+		v := r.FormValue(param)
+		if v == "" {
+			continue
+		}
+		if *value, err = strconv.ParseBool(v); err != nil {
+			return session.AddOptions{}, fmt.Errorf("%s must be true or false", param)
+		}
+	}
+	opts.Start = !paused
+	return opts, nil
 }
 
 // DownloadHandler - handles the torrent download and triggers WebSocket for progress
@@ -201,75 +555,626 @@ func DownloadHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 // Handler to pause the torrent download
-func PauseDownloadHandler(w http.ResponseWriter, r *http.Request, torrentMap *torrent.TorrentMap) {
-	fmt.Println("Reacheddddddddddd")
-	filePath := r.URL.Query().Get("filepath")
-	if filePath == "" {
-		http.Error(w, "Filepath is required", http.StatusBadRequest)
+func PauseDownloadHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
 		return
 	}
+	if err := sess.Pause(t.InfoHash); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "Torrent paused: %s", t.Name)
+}
 
-	valid := torrent.PauseTorrentDownload(filePath, torrentMap, w)
-	if !valid {
+func ResumeDownloadHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	if err := sess.Resume(t.InfoHash); err != nil {
+		writeSessionError(w, err)
 		return
 	}
 
-	fmt.Fprintf(w, "Torrent paused: %s", filePath)
+	fmt.Fprintf(w, "Torrent resumed: %s", t.Name)
 }
 
-func ResumeDownloadHandler(w http.ResponseWriter, r *http.Request, torrentMap *torrent.TorrentMap) {
-	fmt.Println("Reacheddddddddddd")
-	f := r.URL.Query().Get("filepath")
-	if f == "" {
-		http.Error(w, "Filepath is required", http.StatusBadRequest)
+// RemoveHandler - stops a torrent and deletes its uploaded files, and its
+// downloaded data as well when deleteData is true
+func RemoveHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	deleteData := false
+	if v := r.URL.Query().Get("deleteData"); v != "" {
+		var err error
+		deleteData, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, "DeleteData must be true or false", http.StatusBadRequest)
+			return
+		}
+	}
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	if err := sess.Remove(t.InfoHash, deleteData); err != nil {
+		writeSessionError(w, err)
 		return
 	}
-	outputFilePath := filepath.Join(outputDir, f)
-	uploadFolderPath := filepath.Join(uploadsDir, f)
-	uploadFilePath := filepath.Join(uploadFolderPath, f+".torrent")
-	progressInfoFilePath := filepath.Join(uploadFolderPath, "torrent_progress_info.json")
 
-	initializeTorrent(uploadFilePath, torrentMap, outputFilePath, uploadFolderPath, progressInfoFilePath)
+	fmt.Fprintf(w, "Torrent removed: %s", t.Name)
+}
 
-	fmt.Fprintf(w, "Torrent resumed: %s", f)
+// RecheckHandler - hashes the data already in the output folder against the
+// torrent and rebuilds its progress file, reporting progress over the WebSocket
+func RecheckHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	if err := sess.Recheck(t.InfoHash); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "Recheck started: %s", t.Name)
 }
 
-func GetAllActiveTorrents(w http.ResponseWriter, r *http.Request, torrentMap *torrent.TorrentMap) {
+// TorrentsHandler - lists every torrent of the session with its state,
+// only those in category when it is given, an empty one meaning none, and
+// only those with every tag given
+func TorrentsHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	query := r.URL.Query()
+	statuses := []session.Status{}
+	for _, status := range sess.Statuses() {
+		if query.Has("category") && status.Category != query.Get("category") {
+			continue
+		}
+		if !hasTags(status.Tags, query["tag"]) {
+			continue
+		}
+		statuses = append(statuses, status)
+	}
 
-	type ActiveTorrents struct {
-		Pieces      map[int]bool `json:"pieces"` // Map of index to download status
-		TotalPieces int          `json:"total_pieces"`
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(statuses); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
 	}
-	fmt.Println("ReachedddddddddddActive")
-	files, err := os.ReadDir(uploadsDir)
-	if err != nil {
-		http.Error(w, fmt.Sprintf("Failed to read uploads folder: %v", err), http.StatusInternalServerError)
+}
+
+// hasTags reports whether tags includes every tag of want
+func hasTags(tags []string, want []string) bool {
+	for _, tag := range want {
+		found := false
+		for _, own := range tags {
+			if own == tag {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// CategoriesHandler - lists the categories on GET, creates a category or
+// changes its save_path, absolute and inside the data directories, on POST
+// and deletes one on DELETE, leaving its torrents without a category
+func CategoriesHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	name := r.URL.Query().Get("name")
+	switch r.Method {
+	case "POST":
+		if err := sess.SetCategory(session.Category{Name: name, SavePath: r.URL.Query().Get("save_path")}); err != nil {
+			writeSessionError(w, err)
+			return
+		}
+	case "DELETE":
+		if err := sess.RemoveCategory(name); err != nil {
+			writeSessionError(w, err)
+			return
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sess.Categories()); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// CategoryHandler - puts a torrent in a category, created if it does not
+// exist yet, or in none when category is empty
+func CategoryHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
 		return
 	}
-	progress := make(map[string]p2p.ProgressData)
-	for _, file := range files {
-		path := filepath.Join(uploadsDir, file.Name(), "torrent_progress_info.json")
-		progressFile, err := os.Open(path)
+	category := r.URL.Query().Get("category")
+	if err := sess.SetTorrentCategory(t.InfoHash, category); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Torrent category set: %s to %q", t.Name, category)
+}
+
+// TagsHandler - lists every tag in use, or a torrent's tags when one is
+// given. POST replaces a torrent's tags with tags when it is given, then
+// adds those in add and takes away those in remove. Each may be repeated
+// or a comma separated list.
+func TagsHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	query := r.URL.Query()
+	if r.Method != "POST" && !query.Has("hash") && !query.Has("filepath") {
+		writeTags(w, sess.Tags())
+		return
+	}
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	if r.Method == "POST" {
+		tags := t.Tags()
+		if query.Has("tags") {
+			var err error
+			if tags, err = session.ParseTags(query["tags"]); err != nil {
+				writeSessionError(w, err)
+				return
+			}
+		}
+		remove, err := session.ParseTags(query["remove"])
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error opening file: %v", err), http.StatusInternalServerError)
+			writeSessionError(w, err)
+			return
 		}
-		data, err := io.ReadAll(progressFile)
+		kept := append([]string(nil), query["add"]...)
+		for _, tag := range tags {
+			if !hasTags(remove, []string{tag}) {
+				kept = append(kept, tag)
+			}
+		}
+		if err := t.SetTags(kept); err != nil {
+			writeSessionError(w, err)
+			return
+		}
+	}
+	writeTags(w, t.Tags())
+}
+
+func writeTags(w http.ResponseWriter, tags []string) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(tags); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// QueueHandler - moves a torrent up, down, to the top or to the bottom of the queue
+func QueueHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	move, err := session.ParseQueueMove(r.URL.Query().Get("move"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	if err := sess.Move(t.InfoHash, move); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+
+	fmt.Fprintf(w, "Torrent moved %s to position %d: %s", move, sess.QueuePosition(t.InfoHash), t.Name)
+}
+
+// LimitsHandler - shows and changes the rate limits, in bytes per second
+// with 0 for no limit. They are the session's unless a torrent is given,
+// and the session's alternative ones with alt=true. POST changes only the
+// limits passed. The session's limits are reported with the speed mode.
+func LimitsHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	var t *session.Torrent
+	if r.URL.Query().Has("hash") || r.URL.Query().Has("filepath") {
+		var ok bool
+		if t, ok = findTorrent(w, r, sess); !ok {
+			return
+		}
+	}
+	alt, _ := strconv.ParseBool(r.URL.Query().Get("alt"))
+
+	if r.Method == "POST" {
+		var limits session.Limits
+		switch {
+		case t != nil:
+			limits = t.Limits()
+		case alt:
+			limits = sess.AltLimits()
+		default:
+			limits = sess.Limits()
+		}
+		for param, limit := range map[string]*int64{"download": &limits.Download, "upload": &limits.Upload} {
+			v := r.URL.Query().Get(param)
+			if v == "" {
+				continue
+			}
+			rate, err := strconv.ParseInt(v, 10, 64)
+			if err != nil || rate < 0 {
+				http.Error(w, fmt.Sprintf("%s must be a number of bytes per second", param), http.StatusBadRequest)
+				return
+			}
+			*limit = rate
+		}
+		switch {
+		case t != nil:
+			t.SetLimits(limits)
+		case alt:
+			sess.SetAltLimits(limits)
+		default:
+			sess.SetLimits(limits)
+		}
+	}
+
+	var response interface{} = sess.SpeedStatus()
+	if t != nil {
+		response = t.Limits()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// DirsHandler - gets the data directories, the session's unless a torrent
+// is given. POST sets a torrent's incomplete and complete directories,
+// absolute and inside the data directories, an empty value following the
+// session's.
+func DirsHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	if r.Method == "POST" || r.URL.Query().Has("hash") || r.URL.Query().Has("filepath") {
+		t, ok := findTorrent(w, r, sess)
+		if !ok {
+			return
+		}
+		if r.Method == "POST" {
+			err := sess.SetDirs(t.InfoHash, session.Dirs{
+				Incomplete: r.URL.Query().Get("incomplete"),
+				Complete:   r.URL.Query().Get("complete"),
+			})
+			if err != nil {
+				writeSessionError(w, err)
+				return
+			}
+		}
+		writeDirs(w, t.Dirs(), t.SavePath())
+		return
+	}
+	writeDirs(w, sess.Dirs(), "")
+}
+
+func writeDirs(w http.ResponseWriter, dirs session.Dirs, savePath string) {
+	response := struct {
+		session.Dirs
+		SavePath string `json:"save_path,omitempty"`
+	}{dirs, savePath}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// MoveHandler - moves a torrent's data into another directory
+func MoveHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	dir := r.URL.Query().Get("dir")
+	if dir == "" {
+		http.Error(w, "Dir is required", http.StatusBadRequest)
+		return
+	}
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	if err := sess.MoveStorage(t.InfoHash, dir); err != nil {
+		writeSessionError(w, err)
+		return
+	}
+	fmt.Fprintf(w, "Torrent moved: %s to %s", t.Name, t.SavePath())
+}
+
+// FeedsHandler - lists the feed subscriptions on GET, subscribes to url on
+// POST with optional interval, include and exclude rules, which may be
+// repeated, save_dir and category, and unsubscribes id on DELETE. Items
+// may link to a .torrent file or a magnet link.
+func FeedsHandler(w http.ResponseWriter, r *http.Request, poller *feeds.Poller) {
+	query := r.URL.Query()
+	switch r.Method {
+	case "POST":
+		feed := feeds.Feed{
+			URL:      query.Get("url"),
+			Include:  query["include"],
+			Exclude:  query["exclude"],
+			SaveDir:  query.Get("save_dir"),
+			Category: query.Get("category"),
+		}
+		if v := query.Get("interval"); v != "" {
+			interval, err := time.ParseDuration(v)
+			if err != nil {
+				http.Error(w, "interval must be a duration such as 15m", http.StatusBadRequest)
+				return
+			}
+			feed.Interval = interval
+		}
+		feed, err := poller.Subscribe(feed)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error reading file: %v", err), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(feed)
+	case "DELETE":
+		if err := poller.Unsubscribe(query.Get("id")); err != nil {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		fmt.Fprintf(w, "Feed removed: %s", query.Get("id"))
+	default:
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(poller.Feeds()); err != nil {
+			http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+		}
+	}
+}
+
+// FeedRefreshHandler - polls a feed straight away
+func FeedRefreshHandler(w http.ResponseWriter, r *http.Request, poller *feeds.Poller) {
+	id := r.URL.Query().Get("id")
+	err := poller.Refresh(id)
+	switch {
+	case errors.Is(err, feeds.ErrNotFound):
+		http.Error(w, err.Error(), http.StatusNotFound)
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadGateway)
+	default:
+		fmt.Fprintf(w, "Feed refreshed: %s", id)
+	}
+}
+
+// SeedGoalsHandler - gets or sets the seeding goals, the session's unless a
+// torrent is given. POST changes only the goals passed: ratio, seed-time
+// and idle-time, 0 for none, and action. A torrent given inherit=true
+// follows the session's goals again. A torrent's goals are null while it
+// follows the session's.
+func SeedGoalsHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	var t *session.Torrent
+	if r.URL.Query().Has("hash") || r.URL.Query().Has("filepath") {
+		var ok bool
+		if t, ok = findTorrent(w, r, sess); !ok {
+			return
+		}
+	}
+
+	if r.Method == "POST" {
+		goals := sess.SeedGoals()
+		if t != nil && t.SeedGoals() != nil {
+			goals = *t.SeedGoals()
+		}
+		query := r.URL.Query()
+		if v := query.Get("ratio"); v != "" {
+			ratio, err := strconv.ParseFloat(v, 64)
+			if err != nil || ratio < 0 {
+				http.Error(w, "ratio must be a positive number", http.StatusBadRequest)
+				return
+			}
+			goals.Ratio = ratio
+		}
+		for param, d := range map[string]*time.Duration{"seed-time": &goals.SeedTime, "idle-time": &goals.IdleTime} {
+			v := query.Get(param)
+			if v == "" {
+				continue
+			}
+			duration, err := time.ParseDuration(v)
+			if err != nil || duration < 0 {
+				http.Error(w, fmt.Sprintf("%s must be a duration such as 24h", param), http.StatusBadRequest)
+				return
+			}
+			*d = duration
+		}
+		if v := query.Get("action"); v != "" {
+			action, err := session.ParseGoalAction(v)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			goals.Action = action
+		}
+		inherit, _ := strconv.ParseBool(query.Get("inherit"))
+		switch {
+		case t != nil && inherit:
+			t.SetSeedGoals(nil)
+		case t != nil:
+			t.SetSeedGoals(&goals)
+		default:
+			sess.SetSeedGoals(goals)
+		}
+	}
 
-		// Unmarshal JSON data into the struct
-		var status ActiveTorrents
+	var response interface{} = sess.SeedGoals()
+	if t != nil {
+		response = t.SeedGoals()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
 
-		err = json.Unmarshal(data, &status)
+// HooksHandler - lists the configured hooks and their latest results
+func HooksHandler(w http.ResponseWriter, r *http.Request, runner *hooks.Runner) {
+	response := map[string]interface{}{
+		"hooks":   runner.Hooks(),
+		"results": runner.Results(),
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// SpeedModeHandler - forces the normal or alternative limits, or goes back
+// to following the schedule with mode=auto, and replaces the schedule when
+// one is passed
+func SpeedModeHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	if v := r.URL.Query().Get("mode"); v != "" {
+		mode, err := session.ParseSpeedMode(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		sess.SetSpeedMode(mode)
+	}
+	if r.URL.Query().Has("schedule") {
+		schedule, err := session.ParseSchedule(r.URL.Query().Get("schedule"))
 		if err != nil {
-			http.Error(w, fmt.Sprintf("error unmarshaling json: %v", err), http.StatusInternalServerError)
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
-		fmt.Println(status.TotalPieces)
-		totalProgressPercent := float64(len(status.Pieces)) / float64(status.TotalPieces) * 100
-		progress[file.Name()] = p2p.ProgressData{Progress: float64(totalProgressPercent), Name: file.Name(), Speed: 0, RemainingTime: 0, Paused: true}
+		sess.SetAltSchedule(schedule)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(sess.SpeedStatus()); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// FilesHandler - lists the files of a torrent with their priorities and progress
+func FilesHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.Files()); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// PieceMapHandler - returns the state of every piece of a torrent
+func PieceMapHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(t.PieceMap()); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// PeersHandler - lists the connected peers of a torrent, or of every
+// torrent by infohash when none is given
+func PeersHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	var response interface{}
+	if r.URL.Query().Get("hash") == "" && r.URL.Query().Get("filepath") == "" {
+		all := make(map[string][]p2p.PeerInfo)
+		for _, t := range sess.List() {
+			all[t.HexHash()] = t.Peers()
+		}
+		response = all
+	} else {
+		t, ok := findTorrent(w, r, sess)
+		if !ok {
+			return
+		}
+		response = t.Peers()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		http.Error(w, fmt.Sprintf("Failed to encode response: %v", err), http.StatusInternalServerError)
+	}
+}
+
+// FilePriorityHandler - changes the priority of one file of a torrent
+func FilePriorityHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		http.Error(w, "Index must be a number", http.StatusBadRequest)
+		return
+	}
+	priority, err := p2p.ParsePriority(r.URL.Query().Get("priority"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	if err := t.SetFilePriority(index, priority); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, "Priority of file %d set to %s: %s", index, priority, t.Name)
+}
+
+// SequentialHandler - switches a torrent between in-order and priority downloading
+func SequentialHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	enabled, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+	if err != nil {
+		http.Error(w, "Enabled must be true or false", http.StatusBadRequest)
+		return
+	}
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	t.SetSequential(enabled)
+
+	fmt.Fprintf(w, "Sequential download set to %t: %s", enabled, t.Name)
+}
+
+// StreamHandler - serves one file of a torrent with Range support. While the
+// torrent is running, reads wait for the pieces they need and move them to
+// the front of the queue; otherwise only fully downloaded files are served.
+func StreamHandler(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	index, err := strconv.Atoi(r.URL.Query().Get("index"))
+	if err != nil {
+		http.Error(w, "Index must be a number", http.StatusBadRequest)
+		return
+	}
+	t, ok := findTorrent(w, r, sess)
+	if !ok {
+		return
+	}
+	files := t.Files()
+	if index < 0 || index >= len(files) {
+		http.Error(w, "File index out of range", http.StatusBadRequest)
+		return
+	}
+	name := filepath.Base(files[index].Path)
+
+	reader, err := t.NewFileReader(r.Context(), index)
+	if err == nil {
+		defer reader.Close()
+		http.ServeContent(w, r, name, time.Time{}, reader)
+		return
+	}
+	if !errors.Is(err, session.ErrNotRunning) {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if files[index].Progress < 100 {
+		http.Error(w, "File is not downloaded and the torrent is not running", http.StatusConflict)
+		return
+	}
+	http.ServeFile(w, r, t.FilePath(index))
+}
+
+func GetAllActiveTorrents(w http.ResponseWriter, r *http.Request, sess *session.Manager) {
+	progress := make(map[string]p2p.ProgressData)
+	for _, t := range sess.List() {
+		progress[t.Name] = t.Progress()
 	}
 
 	w.Header().Set("Content-Type", "application/json")
@@ -330,7 +1235,64 @@ func GetTotalDownloadedFilesSize(w http.ResponseWriter, r *http.Request) {
 }
 
 func main() {
-	torrentMap := torrent.NewTorrentMap()
+	flag.Parse()
+	schedule, err := session.ParseSchedule(*altSchedule)
+	if err != nil {
+		log.Fatalf("Invalid alternative speed schedule: %v", err)
+	}
+	action, err := session.ParseGoalAction(*seedAction)
+	if err != nil {
+		log.Fatalf("Invalid seeding goal action: %v", err)
+	}
+	var watchFolders []watch.Folder
+	if *watchFile != "" {
+		if watchFolders, err = watch.Load(*watchFile); err != nil {
+			log.Fatalf("Failed to load watch folders: %v", err)
+		}
+	}
+	var hookList []hooks.Hook
+	if *hooksFile != "" {
+		if hookList, err = hooks.Load(*hooksFile); err != nil {
+			log.Fatalf("Failed to load hooks: %v", err)
+		}
+	}
+	hookRunner := hooks.NewRunner(hookList)
+	var extraDirs []string
+	for _, dir := range strings.Split(*dataDirs, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			extraDirs = append(extraDirs, dir)
+		}
+	}
+	sess := session.New(session.Config{
+		OutputDir: outputDir,
+		StatePath: sessionFile,
+
+		MaxActiveDownloads: *maxActiveDownloads,
+		MaxActiveSeeds:     *maxActiveSeeds,
+		StallTimeout:       *stallTimeout,
+		Limits:             session.Limits{Download: *downloadLimit, Upload: *uploadLimit},
+		AltLimits:          session.Limits{Download: *altDownloadLimit, Upload: *altUploadLimit},
+		AltSchedule:        schedule,
+		Dirs:               session.Dirs{Incomplete: *incompleteDir, Complete: *completeDir},
+		DataDirs:           extraDirs,
+		SeedGoals: session.SeedGoals{
+			Ratio:    *seedRatio,
+			SeedTime: *seedTime,
+			IdleTime: *seedIdleTime,
+			Action:   action,
+		},
+
+		Progress: func(t *session.Torrent, progress p2p.ProgressData) {
+			broadcastProgress(progress, t.HexHash())
+			if *pieceMapUpdates {
+				broadcastPieceMap(t.PieceMap(), t.HexHash())
+			}
+		},
+		Recheck: func(t *session.Torrent, progress p2p.RecheckProgress) {
+			broadcastRecheck(progress, t.HexHash())
+		},
+		Events: hookRunner.Fire,
+	})
 	r := mux.NewRouter()
 
 	// Ensure uploads and output directories are created
@@ -342,25 +1304,153 @@ func main() {
 		log.Fatalf("Failed to create output directory: %v", err)
 	}
 
+	// Accept incoming peers, without them torrents only seed to the peers
+	// they connect to themselves
+	torrent.Port = uint16(*peerPort)
+	if err := sess.Listen(fmt.Sprintf(":%d", *peerPort)); err != nil {
+		log.Printf("Not accepting incoming peers: %v", err)
+	}
+
+	// Bring back the torrents of the last run, restarting those that were running
+	if err := sess.Restore(); err != nil {
+		log.Printf("Failed to restore session: %v", err)
+	}
+	addUploads(sess)
+
+	stopWatching := make(chan struct{})
+	poller, err := feeds.Open(feedsFile, func(url string, feed feeds.Feed) error {
+		opts := session.AddOptions{
+			Storage:  storageDefaults(),
+			SaveDir:  feed.SaveDir,
+			Category: feed.Category,
+			Start:    true,
+		}
+		var err error
+		if strings.HasPrefix(url, "magnet:") {
+			_, err = addMagnet(sess, url, opts)
+		} else {
+			_, err = addFromURL(sess, url, opts)
+		}
+		return err
+	})
+	if err != nil {
+		log.Fatalf("Failed to load feeds: %v", err)
+	}
+	go poller.Run(stopWatching)
+	if len(watchFolders) > 0 {
+		watcher := watch.New(watchFolders, *watchInterval, func(path string, folder watch.Folder) error {
+			return addWatched(sess, path, folder)
+		})
+		go watcher.Run(stopWatching)
+	}
+
 	// Define the routes
 	r.HandleFunc("/download", DownloadHandler).Methods("GET")
 	r.HandleFunc("/progress", wsHandler)
 
-	// Wrap the handlers to pass the `torrentMap`
+	// Wrap the handlers to pass the session
 	r.HandleFunc("/upload", func(w http.ResponseWriter, r *http.Request) {
-		UploadHandler(w, r, torrentMap)
+		UploadHandler(w, r, sess)
+	}).Methods("POST")
+
+	r.HandleFunc("/add-url", func(w http.ResponseWriter, r *http.Request) {
+		AddURLHandler(w, r, sess)
 	}).Methods("POST")
 
 	r.HandleFunc("/pause", func(w http.ResponseWriter, r *http.Request) {
-		PauseDownloadHandler(w, r, torrentMap)
+		PauseDownloadHandler(w, r, sess)
 	}).Methods("POST")
 
 	r.HandleFunc("/resume", func(w http.ResponseWriter, r *http.Request) {
-		ResumeDownloadHandler(w, r, torrentMap)
+		ResumeDownloadHandler(w, r, sess)
+	}).Methods("POST")
+
+	r.HandleFunc("/remove", func(w http.ResponseWriter, r *http.Request) {
+		RemoveHandler(w, r, sess)
+	}).Methods("DELETE")
+
+	r.HandleFunc("/recheck", func(w http.ResponseWriter, r *http.Request) {
+		RecheckHandler(w, r, sess)
+	}).Methods("POST")
+
+	r.HandleFunc("/torrents", func(w http.ResponseWriter, r *http.Request) {
+		TorrentsHandler(w, r, sess)
+	}).Methods("GET")
+
+	r.HandleFunc("/categories", func(w http.ResponseWriter, r *http.Request) {
+		CategoriesHandler(w, r, sess)
+	}).Methods("GET", "POST", "DELETE")
+
+	r.HandleFunc("/category", func(w http.ResponseWriter, r *http.Request) {
+		CategoryHandler(w, r, sess)
+	}).Methods("POST")
+
+	r.HandleFunc("/tags", func(w http.ResponseWriter, r *http.Request) {
+		TagsHandler(w, r, sess)
+	}).Methods("GET", "POST")
+
+	r.HandleFunc("/queue", func(w http.ResponseWriter, r *http.Request) {
+		QueueHandler(w, r, sess)
 	}).Methods("POST")
 
+	r.HandleFunc("/limits", func(w http.ResponseWriter, r *http.Request) {
+		LimitsHandler(w, r, sess)
+	}).Methods("GET", "POST")
+
+	r.HandleFunc("/speed-mode", func(w http.ResponseWriter, r *http.Request) {
+		SpeedModeHandler(w, r, sess)
+	}).Methods("GET", "POST")
+
+	r.HandleFunc("/dirs", func(w http.ResponseWriter, r *http.Request) {
+		DirsHandler(w, r, sess)
+	}).Methods("GET", "POST")
+
+	r.HandleFunc("/move", func(w http.ResponseWriter, r *http.Request) {
+		MoveHandler(w, r, sess)
+	}).Methods("POST")
+
+	r.HandleFunc("/feeds", func(w http.ResponseWriter, r *http.Request) {
+		FeedsHandler(w, r, poller)
+	}).Methods("GET", "POST", "DELETE")
+
+	r.HandleFunc("/feeds/refresh", func(w http.ResponseWriter, r *http.Request) {
+		FeedRefreshHandler(w, r, poller)
+	}).Methods("POST")
+
+	r.HandleFunc("/hooks", func(w http.ResponseWriter, r *http.Request) {
+		HooksHandler(w, r, hookRunner)
+	}).Methods("GET")
+
+	r.HandleFunc("/seed-goals", func(w http.ResponseWriter, r *http.Request) {
+		SeedGoalsHandler(w, r, sess)
+	}).Methods("GET", "POST")
+
+	r.HandleFunc("/files", func(w http.ResponseWriter, r *http.Request) {
+		FilesHandler(w, r, sess)
+	}).Methods("GET")
+
+	r.HandleFunc("/pieces", func(w http.ResponseWriter, r *http.Request) {
+		PieceMapHandler(w, r, sess)
+	}).Methods("GET")
+
+	r.HandleFunc("/peers", func(w http.ResponseWriter, r *http.Request) {
+		PeersHandler(w, r, sess)
+	}).Methods("GET")
+
+	r.HandleFunc("/file-priority", func(w http.ResponseWriter, r *http.Request) {
+		FilePriorityHandler(w, r, sess)
+	}).Methods("POST")
+
+	r.HandleFunc("/sequential", func(w http.ResponseWriter, r *http.Request) {
+		SequentialHandler(w, r, sess)
+	}).Methods("POST")
+
+	r.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		StreamHandler(w, r, sess)
+	}).Methods("GET")
+
 	r.HandleFunc("/active-torrents", func(w http.ResponseWriter, r *http.Request) {
-		GetAllActiveTorrents(w, r, torrentMap)
+		GetAllActiveTorrents(w, r, sess)
 	}).Methods("GET")
 
 	r.HandleFunc("/total-downloaded", func(w http.ResponseWriter, r *http.Request) {
@@ -376,6 +1466,17 @@ func main() {
 
 	handler := corsHandler.Handler(r)
 
+	// Flush cached pieces and resume data of running torrents before exiting
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		<-sig
+		log.Println("Shutting down")
+		close(stopWatching)
+		sess.Shutdown()
+		os.Exit(0)
+	}()
+
 	// Start the server
 	log.Println("Server starting at :8080")
 	if err := http.ListenAndServe(":8080", handler); err != nil {
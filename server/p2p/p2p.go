@@ -1,17 +1,21 @@
 package p2p
 
 import (
+	"bit_torrent/bitfield"
 	"bit_torrent/client"
 	"bit_torrent/message"
 	"bit_torrent/peers"
+	"bit_torrent/ratelimit"
+	"bit_torrent/resume"
+	"bit_torrent/stats"
+	"bit_torrent/storage"
 	"bytes"
 	"crypto/sha1"
-	"encoding/json"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"log"
-	"os"
-	"runtime"
+	"sync"
 	"time"
 )
 
@@ -21,6 +25,23 @@ const MaxBlockSize = 16384
 // MaxBacklog is the number of unfulfilled requests a client can have in its pipeline
 const MaxBacklog = 5
 
+// ErrAlreadyDownloaded is returned by Download with StopWhenComplete when
+// every piece is already verified
+var ErrAlreadyDownloaded = errors.New("file Already Downloaded")
+
+// ErrPaused is returned when a torrent was paused before its download started
+var ErrPaused = errors.New("download paused")
+
+// ErrStopped is returned by Download when the torrent was stopped
+var ErrStopped = errors.New("download stopped")
+
+// ResumeInterval bounds how often resume data is written while downloading
+// or seeding
+const ResumeInterval = 5 * time.Second
+
+// KeepAliveInterval is how often idle peer connections are kept alive
+const KeepAliveInterval = 90 * time.Second
+
 type Torrent struct {
 	Peers       []peers.Peer
 	PeerID      [20]byte
@@ -30,14 +51,50 @@ type Torrent struct {
 	Length      int
 	Name        string
 	Status      map[int]bool
-	Paused      bool // Tracks if paused
-	PauseChan   chan struct{}
+	Storage     storage.Storage
+	Files       []string // Paths of the files in Storage, checked against resume data
+	Layout      storage.Info
+	// Per file priorities in Layout order, nil downloads every file normally
+	FilePriorities []Priority
+	Sequential     bool // Download pieces in order, for previewing files
+	// All-time payload and overhead bytes restored from resume data, this
+	// run's traffic is counted separately and reported by Stats
+	Uploaded           int64
+	Downloaded         int64
+	UploadedOverhead   int64
+	DownloadedOverhead int64
+	Paused             bool // Tracks if paused
+	// StopWhenComplete makes Download return once every wanted piece is
+	// verified rather than carry on seeding
+	StopWhenComplete bool
+	// Limiters every peer connection's reads and writes wait on, usually
+	// the torrent's own followed by the session's
+	DownloadLimiters []*ratelimit.Limiter
+	UploadLimiters   []*ratelimit.Limiter
+
+	mu        sync.Mutex // Guards Status, partial, the totals, FilePriorities, Sequential, Paused and conns
+	stop      chan struct{}
+	ended     bool       // Set by Stop and when Download returns, readers stop waiting for pieces
+	pieceDone *sync.Cond // Broadcast on mu when a piece is verified or the download ends
+	picker    *picker
+	results   chan *pieceResult     // Where workers hand in pieces while Download runs
+	haves     []int                 // Pieces verified since Download started, in order
+	partial   []resume.PartialPiece // Blocks on disk of unverified pieces, kept by the picker while Download runs
+	conns     map[*peerConn]struct{}
+	workers   sync.WaitGroup // The current Download's workers, incoming peers included
+
+	// This run's traffic of every peer together
+	downPayload stats.Meter
+	downWire    stats.Meter
+	upPayload   stats.Meter
+	upWire      stats.Meter
 }
 
 type pieceWork struct {
 	index  int
 	hash   [20]byte
 	length int
+	blocks bitfield.Bitfield // Blocks an earlier attempt left on disk, owned by the worker it is handed to
 }
 
 type pieceResult struct {
@@ -46,17 +103,98 @@ type pieceResult struct {
 }
 
 type pieceProgress struct {
+	torrent    *Torrent
 	index      int
+	peer       *peerConn
 	client     *client.Client
 	buf        []byte
+	blocks     bitfield.Bitfield // Blocks in buf
 	downloaded int
 	requested  int
 	backlog    int
 }
 
+// Pause stops requesting pieces but keeps the peer connections and the
+// download running, so Resume can carry on straight away. Pieces already
+// being downloaded are finished. Pausing a paused torrent does nothing.
 func (t *Torrent) Pause() {
-	t.Paused = true
-	close(t.PauseChan) // Signal to pause all download workers
+	t.setPaused(true)
+}
+
+// Resume undoes Pause
+func (t *Torrent) Resume() {
+	t.setPaused(false)
+}
+
+func (t *Torrent) setPaused(paused bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Paused = paused
+	if t.picker != nil {
+		t.picker.setPaused(paused)
+	}
+}
+
+// IsPaused reports whether the torrent is paused
+func (t *Torrent) IsPaused() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Paused
+}
+
+// IsStopped reports whether Stop has been called
+func (t *Torrent) IsStopped() bool {
+	select {
+	case <-t.stopChan():
+		return true
+	default:
+		return false
+	}
+}
+
+// Stop makes Download disconnect from every peer and return ErrStopped.
+// It is safe to call more than once, and before Download has started.
+func (t *Torrent) Stop() {
+	stop := t.stopChan()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case <-stop:
+	default:
+		close(stop)
+	}
+	t.ended = true
+	t.pieceDoneCond().Broadcast()
+}
+
+func (t *Torrent) stopChan() chan struct{} {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.stop == nil {
+		t.stop = make(chan struct{})
+	}
+	return t.stop
+}
+
+// HasPiece reports whether piece index has been downloaded and verified
+func (t *Torrent) HasPiece(index int) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.Status[index]
+}
+
+// Totals returns the all-time payload bytes uploaded and downloaded and
+// how many bytes are left to verify, as reported to trackers
+func (t *Torrent) Totals() (uploaded, downloaded, left int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	left = int64(t.Length)
+	for index, done := range t.Status {
+		if done {
+			left -= int64(t.calculatePieceSize(index))
+		}
+	}
+	return t.Uploaded + t.upPayload.Total(), t.Downloaded + t.downPayload.Total(), left
 }
 
 func (t *Torrent) calculateBoundsForPiece(index int) (begin int, end int) {
@@ -73,71 +211,207 @@ func (t *Torrent) calculatePieceSize(index int) int {
 	return end - begin
 }
 
-func (state *pieceProgress) readMessage() error {
-	msg, err := state.client.Read()
+func (state *pieceProgress) readMessage(msg *message.Message) error {
+	if msg.ID != message.MsgPiece {
+		return state.torrent.handleMessage(state.peer, msg)
+	}
+	n, err := message.ParsePiece(state.index, state.buf, msg)
 	if err != nil {
 		return err
 	}
-
-	if msg == nil {
-		return nil
+	// Only whole blocks as requested are worth keeping if the piece fails
+	begin := int(binary.BigEndian.Uint32(msg.Payload[4:8]))
+	if begin%MaxBlockSize == 0 && n == min(MaxBlockSize, len(state.buf)-begin) {
+		state.blocks.SetPiece(begin / MaxBlockSize)
 	}
+	state.peer.downPayload.Add(n)
+	state.downloaded += n
+	state.peer.received.Store(int32(state.downloaded))
+	state.backlog--
+	return nil
+}
+
+// handleMessage acts on a message from the peer other than a block of the
+// piece being downloaded. Blocks arriving outside a download are dropped.
+func (t *Torrent) handleMessage(p *peerConn, msg *message.Message) error {
 	switch msg.ID {
 	case message.MsgUnchoke:
-		state.client.Choked = false
+		p.client.SetChoked(false)
 	case message.MsgChoke:
-		state.client.Choked = true
+		p.client.SetChoked(true)
+	case message.MsgInterested:
+		p.client.SetPeerInterested(true)
+	case message.MsgNotInterested:
+		p.client.SetPeerInterested(false)
 	case message.MsgHave:
 		index, err := message.ParseHave(msg)
 		if err != nil {
 			return err
 		}
-		state.client.Bitfield.SetPiece(index)
-	case message.MsgPiece:
-		n, err := message.ParsePiece(state.index, state.buf, msg)
-		if err != nil {
-			return err
-		}
-		state.downloaded += n
-		state.backlog--
+		p.setPiece(index)
+	case message.MsgBitfield:
+		p.replaceBitfield(msg.Payload, len(t.PieceHashes))
+	case message.MsgRequest:
+		return t.serveRequest(p, msg)
 	}
 	return nil
 }
 
-func attemptDownloadPiece(c *client.Client, pw *pieceWork) ([]byte, error) {
-	state := pieceProgress{
-		index:  pw.index,
-		client: c,
-		buf:    make([]byte, pw.length),
+// serveRequest uploads a block the peer asked for if its piece is verified.
+// Requests we cannot serve, or get while choking the peer, are ignored.
+func (t *Torrent) serveRequest(p *peerConn, msg *message.Message) error {
+	index, begin, length, err := message.ParseRequest(msg)
+	if err != nil {
+		return err
+	}
+	if p.client.Flags().AmChoking || length > MaxBlockSize || !t.HasPiece(index) || begin+length > t.calculatePieceSize(index) {
+		return nil
 	}
 
-	c.Conn.SetDeadline(time.Now().Add(30 * time.Second))
-	defer c.Conn.SetDeadline(time.Time{}) // Disable the deadline
+	block := make([]byte, length)
+	_, err = t.Storage.ReadAt(index, block, int64(begin))
+	if err != nil {
+		return err
+	}
+	if err := p.client.SendPiece(index, begin, block); err != nil {
+		return err
+	}
+	p.upPayload.Add(length)
+	return nil
+}
 
+// PieceTimeout is how long a piece download waits for the peer's next message
+const PieceTimeout = 30 * time.Second
+
+// attemptDownloadPiece downloads a piece from the peer, requesting only the
+// blocks earlier attempts did not leave on disk. When it fails, the blocks
+// that arrived are written to storage and recorded in pw for the next one.
+func (t *Torrent) attemptDownloadPiece(p *peerConn, pw *pieceWork, quit <-chan struct{}) (buf []byte, err error) {
+	c := p.client
+	state := pieceProgress{
+		torrent: t,
+		index:   pw.index,
+		peer:    p,
+		client:  c,
+		buf:     make([]byte, pw.length),
+	}
+	state.blocks, state.downloaded = t.loadBlocks(pw, state.buf)
+	defer func() {
+		if err != nil {
+			t.keepBlocks(pw, &state)
+		}
+	}()
+
+	p.received.Store(int32(state.downloaded))
+	p.piece.Store(int32(pw.index))
+	defer func() {
+		p.piece.Store(-1)
+		p.requests.Store(0)
+	}()
+
+	// The timeout is per message rather than per piece, as rate limits can
+	// make a whole piece take longer
+	timeout := time.NewTimer(PieceTimeout)
+	defer timeout.Stop()
 	for state.downloaded < pw.length {
-		if !state.client.Choked {
+		if !state.client.Choked() {
 			for state.backlog < MaxBacklog && state.requested < pw.length {
+				begin := state.requested
 				blockSize := MaxBlockSize
 				// Last block might be shorter than the typical block
-				if pw.length-state.requested < blockSize {
-					blockSize = pw.length - state.requested
+				if pw.length-begin < blockSize {
+					blockSize = pw.length - begin
 				}
-				err := c.SendRequest(pw.index, state.requested, blockSize)
+				state.requested += blockSize
+				if state.blocks.HasPiece(begin / MaxBlockSize) {
+					continue // Loaded from disk
+				}
+				err := c.SendRequest(pw.index, begin, blockSize)
 				if err != nil {
 					return nil, err
 				}
 				state.backlog++
-				state.requested += blockSize
 			}
 		}
-		err := state.readMessage()
-		if err != nil {
-			return nil, err
+		p.requests.Store(int32(state.backlog))
+
+		select {
+		case msg, ok := <-p.msgs:
+			if !ok {
+				return nil, p.readErr
+			}
+			if !timeout.Stop() {
+				<-timeout.C
+			}
+			timeout.Reset(PieceTimeout)
+			if err := state.readMessage(msg); err != nil {
+				return nil, err
+			}
+		case <-timeout.C:
+			return nil, fmt.Errorf("no message from %s for %s", p.peer.IP, PieceTimeout)
+		case <-quit:
+			return nil, ErrStopped
 		}
 	}
 	return state.buf, nil
 }
 
+// blockBounds returns where block of a piece of the given length starts and ends
+func blockBounds(block int, length int) (begin int, end int) {
+	begin = block * MaxBlockSize
+	return begin, min(begin+MaxBlockSize, length)
+}
+
+// loadBlocks reads the blocks of the piece an earlier attempt left on disk
+// into buf, returning which ones it read and their size. Blocks that cannot
+// be read are dropped from pw and fetched again.
+func (t *Torrent) loadBlocks(pw *pieceWork, buf []byte) (bitfield.Bitfield, int) {
+	numBlocks := (pw.length + MaxBlockSize - 1) / MaxBlockSize
+	blocks := make(bitfield.Bitfield, (numBlocks+7)/8)
+	loaded := 0
+	for block := 0; block < numBlocks; block++ {
+		if !pw.blocks.HasPiece(block) {
+			continue
+		}
+		begin, end := blockBounds(block, pw.length)
+		if _, err := t.Storage.ReadAt(pw.index, buf[begin:end], int64(begin)); err != nil {
+			continue
+		}
+		blocks.SetPiece(block)
+		loaded += end - begin
+	}
+	pw.blocks = nil
+	if loaded > 0 {
+		pw.blocks = append(bitfield.Bitfield(nil), blocks...)
+	}
+	return blocks, loaded
+}
+
+// keepBlocks writes the blocks of a failed piece download that are not on
+// disk yet to storage, and records the ones on disk in pw
+func (t *Torrent) keepBlocks(pw *pieceWork, state *pieceProgress) {
+	kept := make(bitfield.Bitfield, len(state.blocks))
+	count := 0
+	for block := 0; block < len(state.blocks)*8; block++ {
+		if !state.blocks.HasPiece(block) {
+			continue
+		}
+		if !pw.blocks.HasPiece(block) {
+			begin, end := blockBounds(block, pw.length)
+			if _, err := t.Storage.WriteAt(pw.index, state.buf[begin:end], int64(begin)); err != nil {
+				log.Printf("Error keeping block %d of piece #%d: %v", block, pw.index, err)
+				continue
+			}
+		}
+		kept.SetPiece(block)
+		count++
+	}
+	pw.blocks = nil
+	if count > 0 {
+		pw.blocks = kept
+	}
+}
+
 func checkIntegrity(pw *pieceWork, buf []byte) error {
 	hash := sha1.Sum(buf)
 	if !bytes.Equal(hash[:], pw.hash[:]) {
@@ -146,176 +420,428 @@ func checkIntegrity(pw *pieceWork, buf []byte) error {
 	return nil
 }
 
-func (t *Torrent) startDownloadWorker(peer peers.Peer, workQueue chan *pieceWork, result chan *pieceResult) {
-	c, err := client.New(peer, t.PeerID, t.InfoHash)
+func (t *Torrent) startDownloadWorker(peer peers.Peer, picker *picker, result chan *pieceResult) {
+	defer t.workers.Done()
+	p, err := t.connect(peer)
 	if err != nil {
 		fmt.Println(err.Error())
 		log.Printf("Could not handshake with %s. Disconnecting\n", peer.IP)
 		return
 	}
-	defer c.Conn.Close()
 	log.Printf("Completed handshake with %s\n", peer.IP)
+	t.runPeer(p, picker, result)
+}
 
-	c.SendUnChoke()
-	c.SendInterested()
+// runPeer downloads the wanted pieces the peer has and answers its
+// requests, for as long as the connection lasts or until the picker is
+// closed. Between pieces, and once there is nothing left to get from the
+// peer, it keeps serving the peer and keeps the connection alive.
+func (t *Torrent) runPeer(p *peerConn, picker *picker, result chan<- *pieceResult) {
+	defer t.disconnect(p)
+	c := p.client
+	go p.readLoop()
+
+	if err := t.sendBitfield(p); err != nil {
+		log.Println("Exiting", err)
+		return
+	}
+	keepAlive := time.NewTicker(KeepAliveInterval)
+	defer keepAlive.Stop()
 
-	for pw := range workQueue {
-		if !c.Bitfield.HasPiece(pw.index) {
-			workQueue <- pw
+	for {
+		if err := t.sendHaves(p); err != nil {
+			log.Println("Exiting", err)
+			return
+		}
+		changed := picker.changed()
+		pw := picker.next(c.Bitfield)
+		if pw == nil {
+			// Paused, done with this peer or the picker is closed. The peer
+			// is choked while paused so nothing is uploaded either.
+			if err := setPeerState(c, picker.isPaused(), false); err != nil {
+				log.Println("Exiting", err)
+				return
+			}
+			select {
+			case <-picker.quit:
+				return
+			case <-changed:
+			case msg, ok := <-p.msgs:
+				if !ok {
+					log.Println("Exiting", p.readErr)
+					return
+				}
+				if err := t.handleMessage(p, msg); err != nil {
+					log.Println("Exiting", err)
+					return
+				}
+			case <-keepAlive.C:
+				if err := c.SendKeepAlive(); err != nil {
+					log.Println("Exiting", err)
+					return
+				}
+			}
 			continue
 		}
 
-		buf, err := attemptDownloadPiece(c, pw)
+		if err := setPeerState(c, false, true); err != nil {
+			log.Println("Exiting", err)
+			picker.putBack(pw)
+			return
+		}
+		buf, err := t.attemptDownloadPiece(p, pw, picker.quit)
 		if err != nil {
 			log.Println("Exiting", err)
-			workQueue <- pw // Put piece back on the queue
+			picker.putBack(pw) // Put piece back on the queue
 			return
 		}
 
 		err = checkIntegrity(pw, buf)
 		if err != nil {
 			log.Printf("Piece #%d failed integrity check\n", pw.index)
-			workQueue <- pw // Put piece back on the queue
+			// Put piece back on the queue, all of it as any block may be bad
+			pw.blocks = nil
+			picker.putBack(pw)
 			continue
 		}
 
-		c.SendHave(pw.index)
-		result <- &pieceResult{pw.index, buf}
+		select {
+		case result <- &pieceResult{pw.index, buf}:
+		case <-picker.quit:
+			return
+		}
+	}
+}
 
+// setPeerState chokes or unchokes the peer and tells it whether we are
+// interested, sending only what changed
+func setPeerState(c *client.Client, choking, interested bool) error {
+	flags := c.Flags()
+	var err error
+	if choking != flags.AmChoking {
+		if choking {
+			err = c.SendChoke()
+		} else {
+			err = c.SendUnChoke()
+		}
 	}
+	if err == nil && interested != flags.AmInterested {
+		if interested {
+			err = c.SendInterested()
+		} else {
+			err = c.SendNotInterested()
+		}
+	}
+	return err
+}
+
+// sendBitfield tells a new peer which pieces we have. Pieces verified from
+// now on reach it through sendHaves.
+func (t *Torrent) sendBitfield(p *peerConn) error {
+	t.mu.Lock()
+	bf := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	for index, done := range t.Status {
+		if done {
+			bf.SetPiece(index)
+		}
+	}
+	p.sentHaves = len(t.haves)
+	t.mu.Unlock()
+	return p.client.SendBitfield(bf)
+}
+
+// sendHaves tells the peer about the pieces verified since it was last
+// told, skipping the ones it has itself
+func (t *Torrent) sendHaves(p *peerConn) error {
+	t.mu.Lock()
+	pending := t.haves[p.sentHaves:]
+	p.sentHaves = len(t.haves)
+	t.mu.Unlock()
+	for _, index := range pending {
+		if p.client.Bitfield.HasPiece(index) {
+			continue
+		}
+		if err := p.client.SendHave(index); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 type ProgressData struct {
 	Name          string  `json:"name"`
 	Progress      float64 `json:"progress"`
-	Speed         float64 `json:"speed"` // Download speed in KB/s
-	RemainingTime float64 `json:"remaining_time"`
+	Speed         float64 `json:"speed"`          // Download speed in KB/s over the last 5 seconds
+	RemainingTime float64 `json:"remaining_time"` // Seconds left at the speed over the last minute
 	Paused        bool    `json:"paused"`
-}
+	Seeding       bool    `json:"seeding"`         // Every wanted piece is verified and Download carries on uploading
+	Error         string  `json:"error,omitempty"` // Why the torrent stopped, if it failed
 
-func (t *Torrent) Download(progressChan chan<- ProgressData, outputPath string, progressFilePath string) ([]byte, error) {
-	log.Println("Starting download for", t.Name)
-
-	// Open the file for writing (or create if it doesn't exist)
-	existingIndex := []int{}
-	for index, _ := range t.PieceHashes {
-		if _, ok := t.Status[index]; ok {
-			existingIndex = append(existingIndex, index)
-		}
+	Cache *storage.CacheStats `json:"cache,omitempty"`
+	Stats *TransferStats      `json:"stats,omitempty"`
+}
 
+// StatsInterval is how often Download reports progress when no piece arrives
+const StatsInterval = time.Second
+
+// progress builds the progress report sent while downloading. Speed and
+// remaining time are zero while paused, as only pieces that were in
+// flight when pausing still arrive.
+func (t *Torrent) progress(picker *picker, paused bool) ProgressData {
+	donePieces, wantedPieces := picker.progress()
+	stats := t.Stats()
+	progress := ProgressData{
+		Name:     t.Name,
+		Progress: 100,
+		Paused:   paused,
+		Seeding:  donePieces == wantedPieces && !t.StopWhenComplete,
+		Stats:    &stats,
+	}
+	if wantedPieces > 0 {
+		progress.Progress = float64(donePieces) / float64(wantedPieces) * 100
 	}
-	if len(existingIndex) == len(t.PieceHashes) {
-		progressChan <- ProgressData{
-			Name:          t.Name,
-			Progress:      100,
-			Speed:         0,
-			RemainingTime: 0,
-			Paused:        true,
+	if !paused {
+		progress.Speed = stats.Download.ShortRate / 1024
+		if stats.Download.Rate > 0 {
+			progress.RemainingTime = float64(picker.remaining()) / stats.Download.Rate
 		}
-		return []byte{}, errors.New("file Already Downloaded")
 	}
-	outFile, err := os.OpenFile(outputPath, os.O_WRONLY|os.O_CREATE, 0666)
-	if err != nil {
-		return []byte{}, err
+	if cache, ok := t.Storage.(*storage.Cache); ok {
+		cacheStats := cache.Stats()
+		progress.Cache = &cacheStats
+	}
+	return progress
+}
+
+// Complete reports whether every wanted piece is verified
+func (t *Torrent) Complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for index, priority := range t.piecePriorities() {
+		if priority != PrioritySkip && !t.Status[index] {
+			return false
+		}
 	}
+	return true
+}
 
-	defer outFile.Close()
-	workQueue := make(chan *pieceWork, len(t.PieceHashes))
+// Download fetches the wanted pieces from Peers and then seeds them: it
+// keeps the connections open, accepts new ones through Accept and answers
+// requests until Stop is called, when it returns ErrStopped. With
+// StopWhenComplete set it returns as soon as the download completes
+// instead, or ErrAlreadyDownloaded if it already has.
+func (t *Torrent) Download(progressChan chan<- ProgressData, resumeFilePath string) error {
+	log.Println("Starting download for", t.Name)
+
+	stop := t.stopChan()
 	results := make(chan *pieceResult)
-	t.PauseChan = make(chan struct{})
-	for index, hash := range t.PieceHashes {
-		if !t.Status[index] {
-			length := t.calculatePieceSize(index)
-			workQueue <- &pieceWork{index, hash, length}
+	t.mu.Lock()
+	picker := newPicker(t, t.piecePriorities())
+	picker.sequential = t.Sequential
+	picker.setPaused(t.Paused)
+	t.picker, t.results, t.haves = picker, results, nil
+	storage.SkipFiles(t.Storage, t.skippedFiles())
+	t.mu.Unlock()
+	var saver *resume.Saver
+	defer func() {
+		t.mu.Lock()
+		t.picker, t.results = nil, nil
+		t.ended = true
+		t.pieceDoneCond().Broadcast()
+		t.mu.Unlock()
+		picker.close()
+		t.disconnectAll()
+		// Workers write out the blocks of the pieces they were on as they
+		// stop, which the resume data has to include
+		t.workers.Wait()
+		t.mu.Lock()
+		t.partial = picker.partialPieces()
+		t.mu.Unlock()
+		// Flush any cached pieces and save the resume data however the download ends
+		if saver != nil {
+			if err := t.saveResumeData(saver); err != nil {
+				log.Printf("Error saving resume data: %v", err)
+			}
 		}
+	}()
+
+	donePieces, wantedPieces := picker.progress()
+	seeding := donePieces == wantedPieces
+	if seeding && t.StopWhenComplete {
+		progressChan <- t.progress(picker, true)
+		return ErrAlreadyDownloaded
 	}
+	saver = resume.NewSaver(resumeFilePath, ResumeInterval)
 
 	for _, peer := range t.Peers {
-		go t.startDownloadWorker(peer, workQueue, results)
+		t.workers.Add(1)
+		go t.startDownloadWorker(peer, picker, results)
 	}
 
-	buf := make([]byte, t.Length)
-	donePieces := len(existingIndex)
-	totalPieces := len(t.PieceHashes)
-	startTime := time.Now()
-	totalDownloaded := 0
-	for donePieces < len(t.PieceHashes) {
+	paused := picker.isPaused()
+	ticker := time.NewTicker(StatsInterval)
+	defer ticker.Stop()
+	for {
 		select {
-		// Pause download when signal received
-		case <-t.PauseChan:
-			log.Println("Download paused.")
-			progressChan <- ProgressData{
-				Name:          t.Name,
-				Progress:      0,
-				Speed:         0,
-				RemainingTime: 0,
-				Paused:        true,
+		// Disconnect from every peer when stopped
+		case <-stop:
+			log.Println("Download stopped.")
+			return ErrStopped
+		// Skipping files may have finished the download, and pausing
+		// or resuming is reported straight away
+		case <-picker.updated:
+			donePieces, wantedPieces = picker.progress()
+			if picker.isPaused() == paused {
+				break
+			}
+			paused = !paused
+			log.Printf("Download paused: %t\n", paused)
+			// Write everything out, a paused torrent may sit idle for long
+			if paused {
+				if err := t.saveResumeData(saver); err != nil {
+					log.Printf("Error saving resume data: %v", err)
+				}
+			}
+			progressChan <- t.progress(picker, paused)
+		// Keep the rates current between pieces, and the upload totals in
+		// the resume data while seeding
+		case <-ticker.C:
+			progressChan <- t.progress(picker, paused)
+			if seeding && saver.Due() {
+				if err := t.saveResumeData(saver); err != nil {
+					log.Printf("Error saving resume data: %v", err)
+				}
 			}
-			return nil, errors.New("download paused")
 		// Process download results
 		case res := <-results:
-			begin, _ := t.calculateBoundsForPiece(res.index)
-
-			// Write downloaded piece to file
-			_, err := outFile.WriteAt(res.buf, int64(begin))
+			// Write downloaded piece to storage
+			_, err := t.Storage.WriteAt(res.index, res.buf, 0)
+			if err == nil {
+				err = t.Storage.MarkComplete(res.index)
+			}
 			if err != nil {
-				log.Printf("Error writing piece #%d to file: %v", res.index, err)
-				return nil, err
+				log.Printf("Error writing piece #%d to storage: %v", res.index, err)
+				return err
 			}
 
-			// Mark piece as downloaded and update status map
-			donePieces++
-			totalDownloaded += len(res.buf)
+			// Mark piece as downloaded and update status map, the workers
+			// tell their peers about it
+			t.mu.Lock()
 			t.Status[res.index] = true
-
-			// Save the download status map
-			var status DownloadStatus
-			status.Pieces = t.Status
-			status.TotalPieces = totalPieces
-			if err := saveDownloadStatus(progressFilePath, status); err != nil {
-				log.Printf("Error saving download map: %v", err)
-				return nil, err
+			t.haves = append(t.haves, res.index)
+			t.pieceDoneCond().Broadcast()
+			t.mu.Unlock()
+			picker.markDone(res.index)
+
+			// Save the resume data, rate limited by the saver
+			if saver.Due() {
+				if err := t.saveResumeData(saver); err != nil {
+					log.Printf("Error saving resume data: %v", err)
+					return err
+				}
 			}
 
-			// Report download progress
-			percent := float64(donePieces) / float64(totalPieces) * 100
-			elapsedTime := time.Since(startTime).Seconds()
-			speed := float64(totalDownloaded) / 1024.0 / elapsedTime
-			remainingBytes := t.Length - totalDownloaded
-			remainingTime := float64(remainingBytes) / 1024.0 / speed
-
-			numWorkers := runtime.NumGoroutine() - 1 // subtract 1 for main thread
-			log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", percent, res.index, numWorkers)
-			progressChan <- ProgressData{
-				Name:          t.Name,
-				Progress:      percent,
-				Speed:         speed,
-				RemainingTime: remainingTime,
-				Paused:        false,
+			// Report download progress over the wanted pieces, which may
+			// have changed with the file priorities
+			donePieces, wantedPieces = picker.progress()
+			progress := t.progress(picker, paused)
+			log.Printf("(%0.2f%%) Downloaded piece #%d from %d peers\n", progress.Progress, res.index, progress.Stats.Peers.Connected)
+			progressChan <- progress
+		}
+
+		// Start seeding once every wanted piece is in, and go back to
+		// downloading when more are wanted
+		if complete := donePieces == wantedPieces; complete != seeding {
+			seeding = complete
+			if !seeding {
+				continue
+			}
+			log.Printf("Download of %s complete\n", t.Name)
+			if err := t.saveResumeData(saver); err != nil {
+				log.Printf("Error saving resume data: %v", err)
+			}
+			if t.StopWhenComplete {
+				return nil
 			}
 		}
 	}
+}
 
-	close(workQueue)
-	return buf, nil
+// saveResumeData flushes cached pieces to disk so the snapshot taken
+// afterwards matches the files' modification times, then writes it
+func (t *Torrent) saveResumeData(saver *resume.Saver) error {
+	if err := storage.Flush(t.Storage); err != nil {
+		return err
+	}
+	data, err := t.ResumeData()
+	if err != nil {
+		return err
+	}
+	return saver.Save(data)
 }
 
-type DownloadStatus struct {
-	Pieces      map[int]bool `json:"pieces"` // Map of index to download status
-	TotalPieces int          `json:"total_pieces"`
+// SetStatus replaces the set of verified pieces
+func (t *Torrent) SetStatus(status map[int]bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Status = status
 }
 
-func saveDownloadStatus(filePath string, status DownloadStatus) error {
-	file, err := os.Create(filePath)
-	if err != nil {
-		return fmt.Errorf("failed to create download status file: %v", err)
+// SetPartial replaces the blocks on disk of unverified pieces, which
+// Download carries on from. Pieces already verified or out of range, and
+// block lists of the wrong size, are ignored.
+func (t *Torrent) SetPartial(pieces []resume.PartialPiece) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.partial = nil
+	for _, piece := range pieces {
+		if piece.Index < 0 || piece.Index >= len(t.PieceHashes) || t.Status[piece.Index] {
+			continue
+		}
+		numBlocks := (t.calculatePieceSize(piece.Index) + MaxBlockSize - 1) / MaxBlockSize
+		if len(piece.Blocks) != (numBlocks+7)/8 {
+			continue
+		}
+		t.partial = append(t.partial, piece)
 	}
-	defer file.Close()
+}
 
-	encoder := json.NewEncoder(file)
-	if err := encoder.Encode(status); err != nil {
-		return fmt.Errorf("failed to encode download status: %v", err)
-	}
+// RestoreTotals carries the transfer totals saved in data over to the torrent
+func (t *Torrent) RestoreTotals(data *resume.Data) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Uploaded, t.Downloaded = data.Uploaded, data.Downloaded
+	t.UploadedOverhead, t.DownloadedOverhead = data.UploadedOverhead, data.DownloadedOverhead
+}
 
-	return nil
+// ResumeData snapshots the torrent's progress together with the current
+// state of its files on disk
+func (t *Torrent) ResumeData() (*resume.Data, error) {
+	files, err := resume.StatFiles(t.Files...)
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	bf := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	for index, done := range t.Status {
+		if done {
+			bf.SetPiece(index)
+		}
+	}
+	partial := t.partial
+	if t.picker != nil {
+		partial = t.picker.partialPieces()
+	}
+	return &resume.Data{
+		InfoHash:           t.InfoHash,
+		NumPieces:          len(t.PieceHashes),
+		Bitfield:           bf,
+		Files:              files,
+		Uploaded:           t.Uploaded + t.upPayload.Total(),
+		Downloaded:         t.Downloaded + t.downPayload.Total(),
+		Partial:            partial,
+		UploadedOverhead:   t.UploadedOverhead + t.upWire.Total() - t.upPayload.Total(),
+		DownloadedOverhead: t.DownloadedOverhead + t.downWire.Total() - t.downPayload.Total(),
+	}, nil
 }
@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"bit_torrent/bitfield"
+	"bit_torrent/resume"
+	"bit_torrent/storage"
+	"bytes"
+	"reflect"
+	"testing"
+)
+
+// blockTorrent returns a torrent of one piece of three blocks, the last one
+// short, kept in memory
+func blockTorrent(t *testing.T) *Torrent {
+	t.Helper()
+	length := 2*MaxBlockSize + 100
+	info := storage.Info{PieceLength: length, Length: int64(length), Files: []storage.File{{Length: int64(length)}}}
+	store, err := storage.Open(storage.KindMemory, "", info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Torrent{
+		PieceHashes: make([][20]byte, 1),
+		PieceLength: length,
+		Length:      length,
+		Status:      make(map[int]bool),
+		Storage:     store,
+		Layout:      info,
+	}
+}
+
+func TestPartialPieceSurvivesRestart(t *testing.T) {
+	tor := blockTorrent(t)
+	data := make([]byte, tor.Length)
+	for i := range data {
+		data[i] = byte(i)
+	}
+
+	// An attempt gets blocks 0 and 2 before the peer goes away
+	p := newPicker(tor, []Priority{PriorityNormal})
+	pw := p.next(has(1))
+	state := pieceProgress{buf: append([]byte(nil), data...), blocks: bitfield.Bitfield{0b10100000}}
+	tor.keepBlocks(pw, &state)
+	p.putBack(pw)
+
+	tor.picker = p
+	saved, err := tor.ResumeData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []resume.PartialPiece{{Index: 0, Blocks: bitfield.Bitfield{0b10100000}}}
+	if !reflect.DeepEqual(saved.Partial, want) {
+		t.Fatalf("resume data partial = %v, want %v", saved.Partial, want)
+	}
+
+	// After a restart only the middle block is left to fetch
+	restarted := blockTorrent(t)
+	restarted.Storage = tor.Storage
+	restarted.SetPartial(saved.Partial)
+	pw = newPicker(restarted, []Priority{PriorityNormal}).next(has(1))
+	buf := make([]byte, restarted.Length)
+	blocks, loaded := restarted.loadBlocks(pw, buf)
+	if !bytes.Equal(blocks, bitfield.Bitfield{0b10100000}) || loaded != MaxBlockSize+100 {
+		t.Errorf("loadBlocks() = %08b, %d, want blocks 0 and 2 of %d bytes", blocks, loaded, MaxBlockSize+100)
+	}
+	if !bytes.Equal(buf[:MaxBlockSize], data[:MaxBlockSize]) || !bytes.Equal(buf[2*MaxBlockSize:], data[2*MaxBlockSize:]) {
+		t.Error("loadBlocks() did not read back the kept blocks")
+	}
+}
+
+func TestSetPartialIgnoresInvalidPieces(t *testing.T) {
+	tor := &Torrent{
+		PieceHashes: make([][20]byte, 3),
+		PieceLength: 4 * MaxBlockSize,
+		Length:      3 * 4 * MaxBlockSize,
+		Status:      map[int]bool{1: true},
+	}
+	good := resume.PartialPiece{Index: 2, Blocks: bitfield.Bitfield{0b10000000}}
+	tor.SetPartial([]resume.PartialPiece{
+		{Index: 1, Blocks: bitfield.Bitfield{0b10000000}}, // Verified already
+		{Index: 3, Blocks: bitfield.Bitfield{0b10000000}}, // Out of range
+		{Index: 0, Blocks: bitfield.Bitfield{0, 0}},       // Too many blocks
+		good,
+	})
+	if want := []resume.PartialPiece{good}; !reflect.DeepEqual(tor.partial, want) {
+		t.Errorf("partial = %v, want %v", tor.partial, want)
+	}
+}
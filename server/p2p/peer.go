@@ -0,0 +1,314 @@
+package p2p
+
+import (
+	"bit_torrent/bitfield"
+	"bit_torrent/client"
+	"bit_torrent/message"
+	"bit_torrent/peers"
+	"bit_torrent/ratelimit"
+	"bit_torrent/stats"
+	"encoding/hex"
+	"errors"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Windows of the short and smoothed transfer rates
+const (
+	ShortRateWindow  = 5 * time.Second
+	SmoothRateWindow = 60 * time.Second
+)
+
+// PeerTimeout is how long a peer may stay silent before it is dropped. Peers
+// keep idle connections alive with a message every two minutes or less.
+const PeerTimeout = 3 * time.Minute
+
+// ErrNotRunning is returned by Accept when the torrent is not downloading
+// or seeding
+var ErrNotRunning = errors.New("torrent is not running")
+
+// peerConn is a connected peer and its transfer counters. Its client is
+// only used by the worker that owns the connection, except for the
+// bitfield which others may read under bitfieldMu. Messages from the peer
+// arrive on msgs, read by readLoop.
+type peerConn struct {
+	peer       peers.Peer
+	client     *client.Client
+	incoming   bool
+	msgs       chan *message.Message
+	readErr    error         // Why msgs was closed
+	closed     chan struct{} // Closed by disconnect
+	closeOnce  sync.Once
+	sentHaves  int // How much of the torrent's haves the peer has been told about
+	bitfieldMu sync.Mutex
+	have       atomic.Int64 // Pieces the peer has, from its bitfield and haves
+	requests   atomic.Int32 // Block requests sent and not answered yet
+	piece      atomic.Int32 // Piece being downloaded, -1 when none
+	received   atomic.Int32 // Bytes of that piece received so far
+
+	downPayload *stats.Meter
+	downWire    *stats.Meter
+	upPayload   *stats.Meter
+	upWire      *stats.Meter
+}
+
+// connect handshakes with peer and registers the connection
+func (t *Torrent) connect(peer peers.Peer) (*peerConn, error) {
+	c, err := client.New(peer, t.PeerID, t.InfoHash)
+	if err != nil {
+		return nil, err
+	}
+	return t.register(c, peer, false), nil
+}
+
+// Accept takes over an incoming connection whose handshake, from the peer
+// with ID remoteID, asked for this torrent. The connection is answered and
+// served like the ones Download makes, or closed when the torrent is not
+// running.
+func (t *Torrent) Accept(conn net.Conn, remoteID [20]byte) error {
+	t.mu.Lock()
+	picker, results := t.picker, t.results
+	if picker != nil {
+		t.workers.Add(1)
+	}
+	t.mu.Unlock()
+	if picker == nil {
+		conn.Close()
+		return ErrNotRunning
+	}
+
+	var peer peers.Peer
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		peer = peers.Peer{IP: addr.IP, Port: uint16(addr.Port)}
+	}
+	c, err := client.Accept(conn, peer, remoteID, t.PeerID, t.InfoHash)
+	if err != nil {
+		conn.Close()
+		t.workers.Done()
+		return err
+	}
+	c.Bitfield = make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	log.Printf("Accepted peer %s for %s\n", peer.IP, t.Name)
+	go func() {
+		defer t.workers.Done()
+		t.runPeer(t.register(c, peer, true), picker, results)
+	}()
+	return nil
+}
+
+// register counts the connection's traffic towards the torrent's, limits it
+// with the torrent's limiters and adds it to the connected peers
+func (t *Torrent) register(c *client.Client, peer peers.Peer, incoming bool) *peerConn {
+	p := &peerConn{
+		peer:        peer,
+		client:      c,
+		incoming:    incoming,
+		msgs:        make(chan *message.Message),
+		closed:      make(chan struct{}),
+		downPayload: stats.NewMeter(&t.downPayload),
+		downWire:    stats.NewMeter(&t.downWire),
+		upPayload:   stats.NewMeter(&t.upPayload),
+		upWire:      stats.NewMeter(&t.upWire),
+	}
+	p.piece.Store(-1)
+	c.Conn = stats.NewConn(c.Conn, p.downWire, p.upWire)
+	c.Conn = ratelimit.NewConn(c.Conn, t.DownloadLimiters, t.UploadLimiters)
+	p.setBitfield(c.Bitfield, len(t.PieceHashes))
+
+	t.mu.Lock()
+	if t.conns == nil {
+		t.conns = make(map[*peerConn]struct{})
+	}
+	t.conns[p] = struct{}{}
+	t.mu.Unlock()
+	return p
+}
+
+// disconnect closes the connection and forgets about it. It is safe to call
+// more than once.
+func (t *Torrent) disconnect(p *peerConn) {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		p.client.Conn.Close()
+	})
+	t.mu.Lock()
+	delete(t.conns, p)
+	t.mu.Unlock()
+}
+
+// disconnectAll closes every peer connection
+func (t *Torrent) disconnectAll() {
+	t.mu.Lock()
+	conns := make([]*peerConn, 0, len(t.conns))
+	for p := range t.conns {
+		conns = append(conns, p)
+	}
+	t.mu.Unlock()
+	for _, p := range conns {
+		t.disconnect(p)
+	}
+}
+
+// readLoop passes the peer's messages to msgs until the connection fails,
+// goes silent for PeerTimeout or is closed
+func (p *peerConn) readLoop() {
+	defer close(p.msgs)
+	for {
+		p.client.Conn.SetReadDeadline(time.Now().Add(PeerTimeout))
+		msg, err := p.client.Read()
+		if err != nil {
+			p.readErr = err
+			return
+		}
+		if msg == nil {
+			continue // Keep-alive
+		}
+		select {
+		case p.msgs <- msg:
+		case <-p.closed:
+			p.readErr = net.ErrClosed
+			return
+		}
+	}
+}
+
+func (p *peerConn) setBitfield(bf bitfield.Bitfield, numPieces int) {
+	have := 0
+	for index := 0; index < numPieces; index++ {
+		if bf.HasPiece(index) {
+			have++
+		}
+	}
+	p.have.Store(int64(have))
+}
+
+// replaceBitfield records a bitfield message from the peer
+func (p *peerConn) replaceBitfield(bf bitfield.Bitfield, numPieces int) {
+	p.bitfieldMu.Lock()
+	copy(p.client.Bitfield, bf)
+	p.bitfieldMu.Unlock()
+	p.setBitfield(p.client.Bitfield, numPieces)
+}
+
+// setPiece records a have message from the peer
+func (p *peerConn) setPiece(index int) {
+	if !p.client.Bitfield.HasPiece(index) {
+		p.bitfieldMu.Lock()
+		p.client.Bitfield.SetPiece(index)
+		p.bitfieldMu.Unlock()
+		p.have.Add(1)
+	}
+}
+
+// current returns the piece being downloaded from the peer and how many
+// of its bytes have arrived
+func (p *peerConn) current() (index int, received int) {
+	return int(p.piece.Load()), int(p.received.Load())
+}
+
+// PeerCounts counts a torrent's connected peers, split into those that have
+// every piece and those that do not
+type PeerCounts struct {
+	Connected int `json:"connected"`
+	Seeds     int `json:"seeds"`
+	Leeches   int `json:"leeches"`
+}
+
+// TransferTotals are byte counters for one direction. Payload is piece
+// data and overhead is everything else sent over the wire. Rates are
+// payload bytes per second.
+type TransferTotals struct {
+	Payload   int64   `json:"payload"` // All-time
+	Overhead  int64   `json:"overhead"`
+	ShortRate float64 `json:"rate_5s"`
+	Rate      float64 `json:"rate_60s"`
+}
+
+// TransferStats are a torrent's transfer counters and rates
+type TransferStats struct {
+	Download TransferTotals `json:"download"`
+	Upload   TransferTotals `json:"upload"`
+	Peers    PeerCounts     `json:"peers"`
+}
+
+// Stats returns the torrent's transfer counters, including those restored
+// from resume data, its current rates and its connected peers
+func (t *Torrent) Stats() TransferStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := TransferStats{
+		Download: TransferTotals{
+			Payload:   t.Downloaded + t.downPayload.Total(),
+			Overhead:  t.DownloadedOverhead + t.downWire.Total() - t.downPayload.Total(),
+			ShortRate: t.downPayload.Rate(ShortRateWindow),
+			Rate:      t.downPayload.Rate(SmoothRateWindow),
+		},
+		Upload: TransferTotals{
+			Payload:   t.Uploaded + t.upPayload.Total(),
+			Overhead:  t.UploadedOverhead + t.upWire.Total() - t.upPayload.Total(),
+			ShortRate: t.upPayload.Rate(ShortRateWindow),
+			Rate:      t.upPayload.Rate(SmoothRateWindow),
+		},
+	}
+	for p := range t.conns {
+		s.Peers.Connected++
+		if int(p.have.Load()) == len(t.PieceHashes) {
+			s.Peers.Seeds++
+		} else {
+			s.Peers.Leeches++
+		}
+	}
+	return s
+}
+
+// PeerInfo describes a connected peer for the API. Connections are always
+// plain TCP for now, so Encrypted and UTP are false.
+type PeerInfo struct {
+	Address string `json:"address"`
+	PeerID  string `json:"peer_id"`
+	Client  string `json:"client"`
+	client.Flags
+	Encrypted bool `json:"encrypted"`
+	UTP       bool `json:"utp"`
+	Incoming  bool `json:"incoming"`
+
+	Progress     float64 `json:"progress"`      // Share of the pieces the peer has
+	DownloadRate float64 `json:"download_rate"` // Payload bytes per second over the last 5 seconds
+	UploadRate   float64 `json:"upload_rate"`
+	Downloaded   int64   `json:"downloaded"` // Payload bytes over this connection
+	Uploaded     int64   `json:"uploaded"`
+	Requests     int     `json:"outstanding_requests"`
+}
+
+// ConnectedPeers describes the torrent's connected peers, by address
+func (t *Torrent) ConnectedPeers() []PeerInfo {
+	t.mu.Lock()
+	conns := make([]*peerConn, 0, len(t.conns))
+	for p := range t.conns {
+		conns = append(conns, p)
+	}
+	t.mu.Unlock()
+
+	infos := make([]PeerInfo, len(conns))
+	for i, p := range conns {
+		infos[i] = PeerInfo{
+			Address:      p.peer.String(),
+			PeerID:       hex.EncodeToString(p.client.RemoteID[:]),
+			Client:       client.ClientName(p.client.RemoteID),
+			Flags:        p.client.Flags(),
+			Progress:     float64(p.have.Load()) / float64(len(t.PieceHashes)) * 100,
+			DownloadRate: p.downPayload.Rate(ShortRateWindow),
+			UploadRate:   p.upPayload.Rate(ShortRateWindow),
+			Downloaded:   p.downPayload.Total(),
+			Uploaded:     p.upPayload.Total(),
+			Requests:     int(p.requests.Load()),
+			Incoming:     p.incoming,
+		}
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Address < infos[j].Address })
+	return infos
+}
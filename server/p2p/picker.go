@@ -0,0 +1,233 @@
+package p2p
+
+import (
+	"bit_torrent/bitfield"
+	"bit_torrent/resume"
+	"sync"
+)
+
+// picker hands pieces out to download workers, highest priority first and
+// lowest index first among equals, finishing partly downloaded pieces
+// before starting new ones. Pieces with PrioritySkip are never handed out.
+// In sequential mode priorities are ignored and pieces go strictly in order,
+// and while a stream is reading, the window of pieces ahead of its cursor
+// goes before everything else.
+type picker struct {
+	mu       sync.Mutex
+	wake     chan struct{} // Closed and replaced whenever next may return something new
+	work     []*pieceWork
+	priority []Priority
+	done     []bool
+	inFlight []bool
+	partial  []bitfield.Bitfield // Blocks on disk of pieces not verified yet
+	closed   bool
+	quit     chan struct{} // Closed with the picker
+	updated  chan struct{} // Signalled when the priorities or the pause state change
+	paused   bool
+
+	sequential bool
+	cursor     int // First piece of the streaming window, -1 when not streaming
+	window     int
+}
+
+func newPicker(t *Torrent, priorities []Priority) *picker {
+	p := &picker{
+		work:     make([]*pieceWork, len(t.PieceHashes)),
+		priority: priorities,
+		done:     make([]bool, len(t.PieceHashes)),
+		inFlight: make([]bool, len(t.PieceHashes)),
+		partial:  make([]bitfield.Bitfield, len(t.PieceHashes)),
+		quit:     make(chan struct{}),
+		updated:  make(chan struct{}, 1),
+		wake:     make(chan struct{}),
+		cursor:   -1,
+		window:   streamWindowBytes / t.PieceLength,
+	}
+	if p.window < 2 {
+		p.window = 2
+	}
+	for index, hash := range t.PieceHashes {
+		p.work[index] = &pieceWork{index: index, hash: hash, length: t.calculatePieceSize(index)}
+		p.done[index] = t.Status[index]
+	}
+	for _, piece := range t.partial {
+		p.partial[piece.Index] = piece.Blocks
+	}
+	return p
+}
+
+// next returns a wanted piece the peer has that is neither downloaded nor
+// being downloaded by another worker. It returns nil when there is none,
+// or the picker is paused or closed; changed tells when to try again.
+func (p *picker) next(bf bitfield.Bitfield) *pieceWork {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed || p.paused {
+		return nil
+	}
+	best := -1
+	for index := range p.work {
+		if p.done[index] || p.inFlight[index] || p.priority[index] == PrioritySkip || !bf.HasPiece(index) {
+			continue
+		}
+		if best == -1 || p.rank(index) > p.rank(best) ||
+			p.rank(index) == p.rank(best) && p.partial[index] != nil && p.partial[best] == nil {
+			best = index
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	p.inFlight[best] = true
+	p.work[best].blocks = p.partial[best]
+	return p.work[best]
+}
+
+// changed returns a channel closed the next time the pieces next hands out
+// may change. Take it before calling next so no change is missed.
+func (p *picker) changed() <-chan struct{} {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.wake
+}
+
+// wakeAll closes the channel returned by changed. Must be called with p.mu held.
+func (p *picker) wakeAll() {
+	close(p.wake)
+	p.wake = make(chan struct{})
+}
+
+// rank orders the pieces handed out by next, higher first
+func (p *picker) rank(index int) Priority {
+	if p.cursor >= 0 && index >= p.cursor && index < p.cursor+p.window {
+		return PriorityHigh + 1
+	}
+	if p.sequential {
+		return PriorityNormal
+	}
+	return p.priority[index]
+}
+
+// putBack returns a piece that failed to download so another worker can
+// try, carrying on from the blocks recorded in pw
+func (p *picker) putBack(pw *pieceWork) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight[pw.index] = false
+	p.partial[pw.index] = pw.blocks
+	p.wakeAll()
+}
+
+// markDone records a verified piece. Workers are woken so they can tell
+// their peers about it.
+func (p *picker) markDone(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.done[index] = true
+	p.inFlight[index] = false
+	p.partial[index] = nil
+	p.wakeAll()
+}
+
+// partialPieces lists the pieces with blocks on disk, for the resume data
+func (p *picker) partialPieces() []resume.PartialPiece {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var pieces []resume.PartialPiece
+	for index, blocks := range p.partial {
+		if blocks != nil && !p.done[index] {
+			pieces = append(pieces, resume.PartialPiece{Index: index, Blocks: blocks})
+		}
+	}
+	return pieces
+}
+
+// progress counts the wanted pieces and how many of them are downloaded
+func (p *picker) progress() (done int, wanted int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for index := range p.work {
+		if p.priority[index] == PrioritySkip {
+			continue
+		}
+		wanted++
+		if p.done[index] {
+			done++
+		}
+	}
+	return done, wanted
+}
+
+// remaining counts the bytes of wanted pieces not downloaded yet
+func (p *picker) remaining() int64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var left int64
+	for index, pw := range p.work {
+		if p.priority[index] != PrioritySkip && !p.done[index] {
+			left += int64(pw.length)
+		}
+	}
+	return left
+}
+
+func (p *picker) setPriorities(priorities []Priority) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.priority = priorities
+	p.wakeAll()
+	p.notify()
+}
+
+// setPaused stops or restarts handing out pieces
+func (p *picker) setPaused(paused bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.paused == paused {
+		return
+	}
+	p.paused = paused
+	p.wakeAll()
+	p.notify()
+}
+
+func (p *picker) isPaused() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.paused
+}
+
+// notify signals updated without blocking. Must be called with p.mu held.
+func (p *picker) notify() {
+	select {
+	case p.updated <- struct{}{}:
+	default:
+	}
+}
+
+func (p *picker) setSequential(sequential bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.sequential = sequential
+	p.wakeAll()
+}
+
+// setCursor moves the streaming window to start at piece index, -1 ends it
+func (p *picker) setCursor(index int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cursor != index {
+		p.cursor = index
+		p.wakeAll()
+	}
+}
+
+// close makes next return nil from now on and closes quit
+func (p *picker) close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	close(p.quit)
+	p.wakeAll()
+}
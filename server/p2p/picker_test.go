@@ -0,0 +1,208 @@
+package p2p
+
+import (
+	"bit_torrent/bitfield"
+	"bit_torrent/resume"
+	"reflect"
+	"testing"
+)
+
+// testPieceLength makes the streaming window its minimum of two pieces
+const testPieceLength = streamWindowBytes
+
+// testPicker returns a picker over n pieces, the last one short, of which
+// done are already downloaded
+func testPicker(n int, priorities []Priority, done ...int) *picker {
+	t := &Torrent{
+		PieceHashes: make([][20]byte, n),
+		PieceLength: testPieceLength,
+		Length:      n*testPieceLength - 10,
+		Status:      make(map[int]bool),
+	}
+	for _, index := range done {
+		t.Status[index] = true
+	}
+	if priorities == nil {
+		priorities = make([]Priority, n)
+		for i := range priorities {
+			priorities[i] = PriorityNormal
+		}
+	}
+	return newPicker(t, priorities)
+}
+
+// has returns a bitfield of n pieces with the given ones set, or all of
+// them when none are given
+func has(n int, pieces ...int) bitfield.Bitfield {
+	bf := make(bitfield.Bitfield, (n+7)/8)
+	if len(pieces) == 0 {
+		for i := 0; i < n; i++ {
+			pieces = append(pieces, i)
+		}
+	}
+	for _, index := range pieces {
+		bf.SetPiece(index)
+	}
+	return bf
+}
+
+// drain takes pieces from p until it has none left for bf
+func drain(p *picker, bf bitfield.Bitfield) []int {
+	var order []int
+	for pw := p.next(bf); pw != nil; pw = p.next(bf) {
+		order = append(order, pw.index)
+	}
+	return order
+}
+
+func TestPickerOrder(t *testing.T) {
+	const (
+		S = PrioritySkip
+		L = PriorityLow
+		N = PriorityNormal
+		H = PriorityHigh
+	)
+	tests := []struct {
+		name       string
+		priorities []Priority
+		done       []int
+		peerHas    []int
+		sequential bool
+		cursor     int
+		want       []int
+	}{
+		{"index order", []Priority{N, N, N, N}, nil, nil, false, -1, []int{0, 1, 2, 3}},
+		{"priority first", []Priority{L, N, H, N}, nil, nil, false, -1, []int{2, 1, 3, 0}},
+		{"skipped never", []Priority{S, N, S, L}, nil, nil, false, -1, []int{1, 3}},
+		{"done never", []Priority{N, N, N, N}, []int{0, 2}, nil, false, -1, []int{1, 3}},
+		{"only what the peer has", []Priority{N, N, N, N}, nil, []int{1, 3}, false, -1, []int{1, 3}},
+		{"sequential ignores priorities", []Priority{L, N, H, N}, nil, nil, true, -1, []int{0, 1, 2, 3}},
+		{"sequential still skips", []Priority{N, S, H, N}, nil, nil, true, -1, []int{0, 2, 3}},
+		{"stream window first", []Priority{N, N, N, H, N, N}, nil, nil, false, 1, []int{1, 2, 3, 0, 4, 5}},
+		{"stream window over sequential", []Priority{N, N, N, N, N, N}, nil, nil, true, 4, []int{4, 5, 0, 1, 2, 3}},
+		{"stream window skips", []Priority{N, S, N, N}, nil, nil, false, 1, []int{2, 0, 3}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			n := len(tt.priorities)
+			p := testPicker(n, tt.priorities, tt.done...)
+			p.setSequential(tt.sequential)
+			p.setCursor(tt.cursor)
+			if got := drain(p, has(n, tt.peerHas...)); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("order = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPickerHandsOutOnce(t *testing.T) {
+	p := testPicker(3, nil)
+	first := p.next(has(3))
+	if got := drain(p, has(3)); !reflect.DeepEqual(got, []int{1, 2}) {
+		t.Fatalf("other workers got %v, want [1 2]", got)
+	}
+
+	// A failed piece goes back to the next worker, and wakes idle ones
+	changed := p.changed()
+	p.putBack(first)
+	select {
+	case <-changed:
+	default:
+		t.Error("putBack did not wake idle workers")
+	}
+	if got := drain(p, has(3)); !reflect.DeepEqual(got, []int{0}) {
+		t.Errorf("after putBack got %v, want [0]", got)
+	}
+
+	changed = p.changed()
+	p.markDone(0)
+	select {
+	case <-changed:
+	default:
+		t.Error("markDone did not wake workers")
+	}
+	if pw := p.next(has(3)); pw != nil {
+		t.Errorf("next() = piece %d, want none", pw.index)
+	}
+}
+
+func TestPickerPausedAndClosed(t *testing.T) {
+	p := testPicker(2, nil)
+	changed := p.changed()
+	p.setPaused(true)
+	if pw := p.next(has(2)); pw != nil {
+		t.Errorf("paused next() = piece %d, want none", pw.index)
+	}
+	select {
+	case <-changed:
+	default:
+		t.Error("pausing did not wake workers")
+	}
+
+	p.setPaused(false)
+	if pw := p.next(has(2)); pw == nil || pw.index != 0 {
+		t.Errorf("resumed next() = %v, want piece 0", pw)
+	}
+
+	p.close()
+	if pw := p.next(has(2)); pw != nil {
+		t.Errorf("closed next() = piece %d, want none", pw.index)
+	}
+	select {
+	case <-p.quit:
+	default:
+		t.Error("close did not close quit")
+	}
+}
+
+func TestPickerFinishesPartialPieces(t *testing.T) {
+	tor := &Torrent{
+		PieceHashes: make([][20]byte, 4),
+		PieceLength: testPieceLength,
+		Length:      4 * testPieceLength,
+		partial:     []resume.PartialPiece{{Index: 2, Blocks: bitfield.Bitfield{0b10000000}}},
+	}
+	p := newPicker(tor, []Priority{PriorityNormal, PriorityNormal, PriorityNormal, PriorityHigh})
+	// Priorities still come first
+	if pw := p.next(has(4)); pw.index != 3 {
+		t.Fatalf("next() = piece %d, want 3", pw.index)
+	}
+	pw := p.next(has(4))
+	if pw.index != 2 || !reflect.DeepEqual(pw.blocks, bitfield.Bitfield{0b10000000}) {
+		t.Fatalf("next() = piece %d with blocks %v, want the partial piece 2", pw.index, pw.blocks)
+	}
+
+	// A failed attempt hands its blocks back, a verified piece drops them
+	pw.blocks = bitfield.Bitfield{0b11000000}
+	p.putBack(pw)
+	want := []resume.PartialPiece{{Index: 2, Blocks: bitfield.Bitfield{0b11000000}}}
+	if got := p.partialPieces(); !reflect.DeepEqual(got, want) {
+		t.Errorf("partialPieces() = %v, want %v", got, want)
+	}
+	p.next(has(4))
+	p.markDone(2)
+	if got := p.partialPieces(); got != nil {
+		t.Errorf("partialPieces() after markDone = %v, want none", got)
+	}
+}
+
+func TestPickerProgress(t *testing.T) {
+	p := testPicker(4, []Priority{PriorityNormal, PrioritySkip, PriorityHigh, PriorityLow}, 0)
+	if done, wanted := p.progress(); done != 1 || wanted != 3 {
+		t.Errorf("progress() = %d, %d, want 1, 3", done, wanted)
+	}
+	// Pieces 2 and 3 are left, the last one 10 bytes short
+	if got, want := p.remaining(), int64(2*testPieceLength-10); got != want {
+		t.Errorf("remaining() = %d, want %d", got, want)
+	}
+
+	p.setPriorities([]Priority{PriorityNormal, PriorityNormal, PrioritySkip, PrioritySkip})
+	if done, wanted := p.progress(); done != 1 || wanted != 2 {
+		t.Errorf("progress() after skipping = %d, %d, want 1, 2", done, wanted)
+	}
+	select {
+	case <-p.updated:
+	default:
+		t.Error("setPriorities did not signal updated")
+	}
+}
@@ -0,0 +1,104 @@
+package p2p
+
+import (
+	"strconv"
+	"strings"
+)
+
+// PieceState is the download state of a piece, encoded as one letter
+type PieceState byte
+
+const (
+	PieceMissing   PieceState = 'm'
+	PieceRequested PieceState = 'r' // Handed to a peer, no block received yet
+	PiecePartial   PieceState = 'p' // Some blocks received, not verified yet
+	PieceVerified  PieceState = 'v'
+)
+
+// PieceMap is the state and swarm availability of every piece, run-length
+// encoded so it stays small for torrents with many pieces. States is a
+// run count followed by a state letter per run, e.g. "120v3r1p876m".
+// Availability is comma separated count:peers runs, e.g. "120:2,880:0",
+// counting the connected peers that have each piece.
+type PieceMap struct {
+	NumPieces    int    `json:"num_pieces"`
+	States       string `json:"states"`
+	Availability string `json:"availability"`
+}
+
+// NewPieceMap encodes the states and availability of each piece
+func NewPieceMap(states []PieceState, availability []int) PieceMap {
+	var b strings.Builder
+	for start := 0; start < len(states); {
+		end := start + 1
+		for end < len(states) && states[end] == states[start] {
+			end++
+		}
+		b.WriteString(strconv.Itoa(end - start))
+		b.WriteByte(byte(states[start]))
+		start = end
+	}
+
+	var runs []string
+	for start := 0; start < len(availability); {
+		end := start + 1
+		for end < len(availability) && availability[end] == availability[start] {
+			end++
+		}
+		runs = append(runs, strconv.Itoa(end-start)+":"+strconv.Itoa(availability[start]))
+		start = end
+	}
+
+	return PieceMap{
+		NumPieces:    len(states),
+		States:       b.String(),
+		Availability: strings.Join(runs, ","),
+	}
+}
+
+// PieceMap reports the state of every piece and how many connected peers
+// have it
+func (t *Torrent) PieceMap() PieceMap {
+	numPieces := len(t.PieceHashes)
+	states := make([]PieceState, numPieces)
+	availability := make([]int, numPieces)
+
+	t.mu.Lock()
+	picker := t.picker
+	for index := range states {
+		states[index] = PieceMissing
+		if t.Status[index] {
+			states[index] = PieceVerified
+		}
+	}
+	conns := make([]*peerConn, 0, len(t.conns))
+	for p := range t.conns {
+		conns = append(conns, p)
+	}
+	t.mu.Unlock()
+
+	if picker != nil {
+		picker.mu.Lock()
+		for index, inFlight := range picker.inFlight {
+			if inFlight && states[index] == PieceMissing {
+				states[index] = PieceRequested
+			}
+		}
+		picker.mu.Unlock()
+	}
+
+	for _, p := range conns {
+		if index, received := p.current(); index >= 0 && received > 0 && states[index] == PieceRequested {
+			states[index] = PiecePartial
+		}
+		p.bitfieldMu.Lock()
+		for index := range availability {
+			if p.client.Bitfield.HasPiece(index) {
+				availability[index]++
+			}
+		}
+		p.bitfieldMu.Unlock()
+	}
+
+	return NewPieceMap(states, availability)
+}
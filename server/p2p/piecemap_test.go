@@ -0,0 +1,36 @@
+package p2p
+
+import "testing"
+
+func TestNewPieceMap(t *testing.T) {
+	m, r, p, v := PieceMissing, PieceRequested, PiecePartial, PieceVerified
+	tests := []struct {
+		name         string
+		states       []PieceState
+		availability []int
+		want         PieceMap
+	}{
+		{"empty", nil, nil, PieceMap{NumPieces: 0, States: "", Availability: ""}},
+		{"single piece", []PieceState{v}, []int{3}, PieceMap{NumPieces: 1, States: "1v", Availability: "1:3"}},
+		{"runs", []PieceState{v, v, v, r, p, m, m}, []int{2, 2, 2, 2, 0, 0, 1},
+			PieceMap{NumPieces: 7, States: "3v1r1p2m", Availability: "4:2,2:0,1:1"}},
+		{"alternating", []PieceState{v, m, v, m}, []int{1, 0, 1, 0},
+			PieceMap{NumPieces: 4, States: "1v1m1v1m", Availability: "1:1,1:0,1:1,1:0"}},
+		{"long run", repeatState(m, 120), make([]int, 120), PieceMap{NumPieces: 120, States: "120m", Availability: "120:0"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := NewPieceMap(tt.states, tt.availability); got != tt.want {
+				t.Errorf("NewPieceMap() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func repeatState(state PieceState, n int) []PieceState {
+	states := make([]PieceState, n)
+	for i := range states {
+		states[i] = state
+	}
+	return states
+}
@@ -0,0 +1,129 @@
+package p2p
+
+import (
+	"bit_torrent/storage"
+	"encoding/json"
+	"fmt"
+)
+
+// Priority decides whether and how early the pieces of a file are downloaded
+type Priority int
+
+const (
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high"}
+
+func (p Priority) String() string {
+	if p < PrioritySkip || p > PriorityHigh {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority parses one of skip, low, normal or high
+func ParsePriority(s string) (Priority, error) {
+	for i, name := range priorityNames {
+		if s == name {
+			return Priority(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown priority %q", s)
+}
+
+func (p Priority) MarshalJSON() ([]byte, error) {
+	return json.Marshal(p.String())
+}
+
+func (p *Priority) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return err
+	}
+	parsed, err := ParsePriority(s)
+	if err != nil {
+		return err
+	}
+	*p = parsed
+	return nil
+}
+
+// piecePriorities gives every piece the highest priority of the files it
+// overlaps. Must be called with t.mu held.
+func (t *Torrent) piecePriorities() []Priority {
+	priorities := make([]Priority, len(t.PieceHashes))
+	if len(t.FilePriorities) == 0 {
+		for index := range priorities {
+			priorities[index] = PriorityNormal
+		}
+		return priorities
+	}
+	for i, priority := range t.FilePriorities {
+		first, last, ok := t.Layout.FilePieces(i)
+		if !ok {
+			continue
+		}
+		for index := first; index <= last; index++ {
+			if priority > priorities[index] {
+				priorities[index] = priority
+			}
+		}
+	}
+	return priorities
+}
+
+// skippedFiles reports which files are not wanted at all. Must be called
+// with t.mu held.
+func (t *Torrent) skippedFiles() []bool {
+	skip := make([]bool, len(t.FilePriorities))
+	for i, priority := range t.FilePriorities {
+		skip[i] = priority == PrioritySkip
+	}
+	return skip
+}
+
+// Priorities returns the priority of every file of the torrent
+func (t *Torrent) Priorities() []Priority {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	priorities := make([]Priority, len(t.Layout.Files))
+	for i := range priorities {
+		priorities[i] = PriorityNormal
+		if i < len(t.FilePriorities) {
+			priorities[i] = t.FilePriorities[i]
+		}
+	}
+	return priorities
+}
+
+// SetFilePriority changes the priority of file i. It takes effect straight
+// away when the torrent is downloading.
+func (t *Torrent) SetFilePriority(i int, priority Priority) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if i < 0 || i >= len(t.Layout.Files) {
+		return fmt.Errorf("file index %d out of range", i)
+	}
+	if priority < PrioritySkip || priority > PriorityHigh {
+		return fmt.Errorf("invalid priority %d", priority)
+	}
+	if len(t.FilePriorities) == 0 {
+		t.FilePriorities = make([]Priority, len(t.Layout.Files))
+		for j := range t.FilePriorities {
+			t.FilePriorities[j] = PriorityNormal
+		}
+	}
+	t.FilePriorities[i] = priority
+
+	if t.picker != nil {
+		t.picker.setPriorities(t.piecePriorities())
+	}
+	storage.SkipFiles(t.Storage, t.skippedFiles())
+	return nil
+}
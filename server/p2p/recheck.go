@@ -0,0 +1,93 @@
+package p2p
+
+import (
+	"bit_torrent/resume"
+	"crypto/sha1"
+	"log"
+	"runtime"
+)
+
+// RecheckProgress reports how far a forced recheck has got
+type RecheckProgress struct {
+	Name     string  `json:"name"`
+	Checked  int     `json:"checked"`
+	Valid    int     `json:"valid"`
+	Total    int     `json:"total"`
+	Progress float64 `json:"progress"`
+	Done     bool    `json:"done"`
+}
+
+type recheckResult struct {
+	index int
+	valid bool
+}
+
+// Recheck hashes every piece in Storage against PieceHashes, rebuilds Status
+// from the pieces that verify and saves the resume data to resumeFilePath.
+// progressChan may be nil when nobody is listening.
+func (t *Torrent) Recheck(progressChan chan<- RecheckProgress, resumeFilePath string) error {
+	log.Println("Starting recheck for", t.Name)
+
+	t.SetStatus(make(map[int]bool))
+	t.SetPartial(nil)
+	totalPieces := len(t.PieceHashes)
+
+	indexes := make(chan int, totalPieces)
+	for index := range t.PieceHashes {
+		indexes <- index
+	}
+	close(indexes)
+
+	results := make(chan recheckResult)
+	for i := 0; i < runtime.NumCPU(); i++ {
+		go t.startRecheckWorker(indexes, results)
+	}
+
+	checked, valid := 0, 0
+	for checked < totalPieces {
+		res := <-results
+		checked++
+		if res.valid {
+			valid++
+			t.mu.Lock()
+			t.Status[res.index] = true
+			t.mu.Unlock()
+		}
+		if progressChan == nil {
+			continue
+		}
+		progressChan <- RecheckProgress{
+			Name:     t.Name,
+			Checked:  checked,
+			Valid:    valid,
+			Total:    totalPieces,
+			Progress: float64(checked) / float64(totalPieces) * 100,
+			Done:     checked == totalPieces,
+		}
+	}
+
+	log.Printf("Recheck for %s found %d of %d pieces\n", t.Name, valid, totalPieces)
+
+	data, err := t.ResumeData()
+	if err != nil {
+		return err
+	}
+	return resume.Save(resumeFilePath, data)
+}
+
+func (t *Torrent) startRecheckWorker(indexes <-chan int, results chan<- recheckResult) {
+	buf := make([]byte, t.PieceLength)
+	for index := range indexes {
+		results <- recheckResult{index, t.verifyPiece(index, buf)}
+	}
+}
+
+// verifyPiece reads a piece from storage and compares it to its expected
+// hash. A missing file or a short read counts as a failed piece.
+func (t *Torrent) verifyPiece(index int, buf []byte) bool {
+	piece := buf[:t.calculatePieceSize(index)]
+	if _, err := t.Storage.ReadAt(index, piece, 0); err != nil {
+		return false
+	}
+	return sha1.Sum(piece) == t.PieceHashes[index]
+}
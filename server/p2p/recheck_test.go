@@ -0,0 +1,95 @@
+package p2p
+
+import (
+	"bit_torrent/resume"
+	"bit_torrent/storage"
+	"crypto/sha1"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRecheckDropsCorruptPiece(t *testing.T) {
+	const pieceLength, numPieces = 1024, 5
+	data := make([]byte, numPieces*pieceLength-100)
+	for i := range data {
+		data[i] = byte(i * 7)
+	}
+	dir := t.TempDir()
+	path := filepath.Join(dir, "data.bin")
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	info := storage.Info{PieceLength: pieceLength, Length: int64(len(data)), Files: []storage.File{{Length: int64(len(data))}}}
+	store, err := storage.Open(storage.KindFile, path, info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	tor := &Torrent{
+		PieceLength: pieceLength,
+		Length:      len(data),
+		Storage:     store,
+		Files:       []string{path},
+	}
+	for begin := 0; begin < len(data); begin += pieceLength {
+		tor.PieceHashes = append(tor.PieceHashes, sha1.Sum(data[begin:min(begin+pieceLength, len(data))]))
+	}
+	resumePath := filepath.Join(dir, "torrent.resume")
+
+	check := func(want map[int]bool) {
+		t.Helper()
+		var progress []RecheckProgress
+		progressChan := make(chan RecheckProgress)
+		done := make(chan struct{})
+		go func() {
+			for p := range progressChan {
+				progress = append(progress, p)
+			}
+			close(done)
+		}()
+		err := tor.Recheck(progressChan, resumePath)
+		close(progressChan)
+		<-done
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(tor.Status, want) {
+			t.Errorf("Status = %v, want %v", tor.Status, want)
+		}
+		last := progress[len(progress)-1]
+		if len(progress) != numPieces || !last.Done || last.Valid != len(want) || last.Total != numPieces {
+			t.Errorf("%d progress reports ending with %+v", len(progress), last)
+		}
+
+		// The resume data saved matches the files on disk
+		saved, err := resume.Load(resumePath)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files, err := resume.StatFiles(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := resume.Validate(saved, tor.InfoHash, numPieces, files); err != nil {
+			t.Errorf("saved resume data: %v", err)
+		}
+		if saved.CompletedPieces() != len(want) {
+			t.Errorf("saved resume data has %d pieces, want %d", saved.CompletedPieces(), len(want))
+		}
+	}
+	check(map[int]bool{0: true, 1: true, 2: true, 3: true, 4: true})
+
+	// Corrupt one byte in the middle of piece 2
+	file, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := file.WriteAt([]byte{data[2*pieceLength+10] ^ 0xff}, 2*pieceLength+10); err != nil {
+		t.Fatal(err)
+	}
+	file.Close()
+	check(map[int]bool{0: true, 1: true, 3: true, 4: true})
+}
@@ -0,0 +1,140 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// streamWindowBytes is how far ahead of a stream's read position pieces are
+// fetched before anything else
+const streamWindowBytes = 16 << 20
+
+// SetSequential switches the torrent between downloading pieces in order and
+// by file priority
+func (t *Torrent) SetSequential(sequential bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Sequential = sequential
+	if t.picker != nil {
+		t.picker.setSequential(sequential)
+	}
+}
+
+// pieceDoneCond returns the condition broadcast when a piece is verified,
+// creating it on first use. Must be called with t.mu held.
+func (t *Torrent) pieceDoneCond() *sync.Cond {
+	if t.pieceDone == nil {
+		t.pieceDone = sync.NewCond(&t.mu)
+	}
+	return t.pieceDone
+}
+
+// waitForPiece blocks until piece index is verified, ctx is done or the
+// download ends, which returns ErrNotRunning
+func (t *Torrent) waitForPiece(ctx context.Context, index int) error {
+	stop := context.AfterFunc(ctx, func() {
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.pieceDoneCond().Broadcast()
+	})
+	defer stop()
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for !t.Status[index] {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		if t.ended {
+			return ErrNotRunning
+		}
+		t.pieceDoneCond().Wait()
+	}
+	return nil
+}
+
+// setStreamCursor moves the streaming window to piece index
+func (t *Torrent) setStreamCursor(index int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.picker != nil {
+		t.picker.setCursor(index)
+	}
+}
+
+// FileReader reads one file of a torrent while it downloads. Reads block
+// until the pieces they need are verified and pull those pieces to the
+// front of the download queue.
+type FileReader struct {
+	t      *Torrent
+	ctx    context.Context
+	begin  int64 // Offset of the file within the torrent
+	length int64
+	pos    int64
+}
+
+// NewFileReader returns a reader for file i that gives up when ctx is done
+// or the download ends. Reads of a skipped file block until it is given a
+// priority again.
+func (t *Torrent) NewFileReader(ctx context.Context, i int) (*FileReader, error) {
+	if i < 0 || i >= len(t.Layout.Files) {
+		return nil, fmt.Errorf("file index %d out of range", i)
+	}
+
+	var begin int64
+	for _, f := range t.Layout.Files[:i] {
+		begin += f.Length
+	}
+	return &FileReader{t: t, ctx: ctx, begin: begin, length: t.Layout.Files[i].Length}, nil
+}
+
+func (r *FileReader) Read(p []byte) (int, error) {
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if rest := r.length - r.pos; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	// Read at most up to the end of the current piece
+	offset := r.begin + r.pos
+	index := int(offset / int64(r.t.PieceLength))
+	pieceOffset := offset - int64(index)*int64(r.t.PieceLength)
+	if rest := int64(r.t.calculatePieceSize(index)) - pieceOffset; int64(len(p)) > rest {
+		p = p[:rest]
+	}
+
+	r.t.setStreamCursor(index)
+	if err := r.t.waitForPiece(r.ctx, index); err != nil {
+		return 0, err
+	}
+	n, err := r.t.Storage.ReadAt(index, p, pieceOffset)
+	r.pos += int64(n)
+	return n, err
+}
+
+func (r *FileReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return 0, errors.New("invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("negative position")
+	}
+	r.pos = offset
+	return offset, nil
+}
+
+// Close ends the streaming window so the torrent goes back to its normal order
+func (r *FileReader) Close() error {
+	r.t.setStreamCursor(-1)
+	return nil
+}
@@ -0,0 +1,67 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestFileReaderEndsWithDownload(t *testing.T) {
+	tests := []struct {
+		name     string
+		download bool // Whether Download is running when the torrent stops
+	}{
+		{"download stopped", true},
+		{"stopped before downloading", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tor := blockTorrent(t)
+			downloaded := make(chan error, 1)
+			if tt.download {
+				progressChan := make(chan ProgressData)
+				go func() {
+					for range progressChan {
+					}
+				}()
+				go func() {
+					downloaded <- tor.Download(progressChan, filepath.Join(t.TempDir(), "torrent.resume"))
+					close(progressChan)
+				}()
+			}
+
+			reader, err := tor.NewFileReader(context.Background(), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer reader.Close()
+			read := make(chan error, 1)
+			go func() {
+				_, err := reader.Read(make([]byte, 10))
+				read <- err
+			}()
+			select {
+			case err := <-read:
+				t.Fatalf("Read() of a missing piece returned %v", err)
+			case <-time.After(50 * time.Millisecond):
+			}
+
+			tor.Stop()
+			select {
+			case err := <-read:
+				if !errors.Is(err, ErrNotRunning) {
+					t.Errorf("Read() error = %v, want ErrNotRunning", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Read() still waiting after the torrent stopped")
+			}
+			if tt.download {
+				if err := <-downloaded; !errors.Is(err, ErrStopped) {
+					t.Errorf("Download() error = %v, want ErrStopped", err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,45 @@
+package ratelimit
+
+import "net"
+
+// chunkSize bounds a single read or write so one connection cannot take a
+// large share of a limiter at once. It fits a whole block message.
+const chunkSize = 16<<10 + 13
+
+type conn struct {
+	net.Conn
+	read  []*Limiter
+	write []*Limiter
+}
+
+// NewConn wraps c so that reads wait on the read limiters and writes on the
+// write limiters
+func NewConn(c net.Conn, read []*Limiter, write []*Limiter) net.Conn {
+	return &conn{Conn: c, read: read, write: write}
+}
+
+// Read reads first and charges the bytes it got, as it cannot know in
+// advance how many will arrive
+func (c *conn) Read(p []byte) (int, error) {
+	if len(p) > chunkSize {
+		p = p[:chunkSize]
+	}
+	n, err := c.Conn.Read(p)
+	Wait(n, c.read...)
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), chunkSize)]
+		Wait(len(chunk), c.write...)
+		n, err := c.Conn.Write(chunk)
+		written += n
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
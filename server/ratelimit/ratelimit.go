@@ -0,0 +1,97 @@
+package ratelimit
+
+import (
+	"sync"
+	"time"
+)
+
+// Limiter is a token bucket of bytes per second shared by any number of
+// connections. Tokens are handed out in the order they are asked for, so
+// connections sharing a limiter get an even share of it. A nil Limiter or
+// a rate of 0 does not limit.
+type Limiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64 // Negative while callers are waiting for tokens
+	last   time.Time
+}
+
+// New returns a Limiter allowing rate bytes per second, 0 for no limit
+func New(rate int64) *Limiter {
+	l := &Limiter{burst: chunkSize}
+	l.SetRate(rate)
+	l.tokens = l.burst
+	return l
+}
+
+// SetRate changes the limit, taking effect for the next transfer. 0 removes it.
+func (l *Limiter) SetRate(rate int64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if rate < 0 {
+		rate = 0
+	}
+	if float64(rate) == l.rate {
+		return
+	}
+	// Keep what was earned at the old rate. Without a limit the bucket is
+	// full, debts from an earlier limit are long paid.
+	now := time.Now()
+	if l.rate > 0 {
+		l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	}
+	l.last = now
+	wasUnlimited := l.rate == 0
+	l.rate = float64(rate)
+	// One second of traffic, but always at least a full chunk so no
+	// transfer can wait forever
+	l.burst = max(l.rate, chunkSize)
+	if wasUnlimited {
+		l.tokens = l.burst
+	}
+	l.tokens = min(l.tokens, l.burst)
+}
+
+// Rate returns the limit in bytes per second, 0 when there is none
+func (l *Limiter) Rate() int64 {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return int64(l.rate)
+}
+
+// reserve takes n tokens and returns how long the caller has to wait until
+// they are available
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.rate == 0 {
+		return 0
+	}
+
+	now := time.Now()
+	l.tokens = min(l.burst, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+// Wait blocks until n bytes may be transferred under every limiter
+func Wait(n int, limiters ...*Limiter) {
+	var delay time.Duration
+	for _, l := range limiters {
+		delay = max(delay, l.reserve(n))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
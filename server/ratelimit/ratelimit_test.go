@@ -0,0 +1,108 @@
+package ratelimit
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// near reports whether got is within 50ms of want, leaving room for the
+// time that passes between reservations
+func near(got, want time.Duration) bool {
+	return got >= want-50*time.Millisecond && got <= want+50*time.Millisecond
+}
+
+func TestReserve(t *testing.T) {
+	tests := []struct {
+		name  string
+		rate  int64
+		takes []int           // Reserved one after another
+		want  []time.Duration // Wait for each
+	}{
+		{"no limit", 0, []int{1 << 20, 1 << 20}, []time.Duration{0, 0}},
+		{"within the burst", 1 << 20, []int{1 << 19, 1 << 19}, []time.Duration{0, 0}},
+		{"past the burst", 1 << 20, []int{1 << 20, 1 << 19}, []time.Duration{0, 500 * time.Millisecond}},
+		{"waiters queue up", 1 << 20, []int{1 << 20, 1 << 19, 1 << 19}, []time.Duration{0, 500 * time.Millisecond, time.Second}},
+		// Below one chunk per second the burst is still a full chunk
+		{"slow rate", 1000, []int{chunkSize, 500}, []time.Duration{0, 500 * time.Millisecond}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := New(tt.rate)
+			for i, n := range tt.takes {
+				if got := l.reserve(n); !near(got, tt.want[i]) {
+					t.Errorf("reserve(%d) #%d = %v, want %v", n, i, got, tt.want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNilLimiter(t *testing.T) {
+	var l *Limiter
+	if d := l.reserve(1 << 30); d != 0 {
+		t.Errorf("nil reserve() = %v, want 0", d)
+	}
+	if r := l.Rate(); r != 0 {
+		t.Errorf("nil Rate() = %d, want 0", r)
+	}
+}
+
+func TestSetRate(t *testing.T) {
+	l := New(1 << 20)
+	l.reserve(2 << 20) // A second in debt
+	l.SetRate(0)
+	if d := l.reserve(1 << 30); d != 0 {
+		t.Errorf("reserve() after removing the limit = %v, want 0", d)
+	}
+	if r := l.Rate(); r != 0 {
+		t.Errorf("Rate() = %d, want 0", r)
+	}
+
+	l.SetRate(-5)
+	if r := l.Rate(); r != 0 {
+		t.Errorf("Rate() after a negative rate = %d, want 0", r)
+	}
+	l.SetRate(1 << 20)
+	if r := l.Rate(); r != 1<<20 {
+		t.Errorf("Rate() = %d, want %d", r, 1<<20)
+	}
+	// The bucket stays within the burst of the new rate
+	if d := l.reserve(2 << 20); !near(d, time.Second) {
+		t.Errorf("reserve() after raising the limit = %v, want 1s", d)
+	}
+}
+
+// recordConn records the size of every write
+type recordConn struct {
+	net.Conn
+	writes []int
+}
+
+func (c *recordConn) Write(p []byte) (int, error) {
+	c.writes = append(c.writes, len(p))
+	return len(p), nil
+}
+
+func TestConnWritesInChunks(t *testing.T) {
+	tests := []struct {
+		size int
+		want []int
+	}{
+		{10, []int{10}},
+		{chunkSize, []int{chunkSize}},
+		{2*chunkSize + 5, []int{chunkSize, chunkSize, 5}},
+	}
+	for _, tt := range tests {
+		inner := &recordConn{}
+		c := NewConn(inner, nil, []*Limiter{New(0), nil})
+		n, err := c.Write(make([]byte, tt.size))
+		if err != nil || n != tt.size {
+			t.Errorf("Write(%d bytes) = %d, %v", tt.size, n, err)
+		}
+		if !reflect.DeepEqual(inner.writes, tt.want) {
+			t.Errorf("Write(%d bytes) wrote %v, want %v", tt.size, inner.writes, tt.want)
+		}
+	}
+}
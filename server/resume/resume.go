@@ -0,0 +1,294 @@
+package resume
+
+import (
+	"bit_torrent/bitfield"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// magic identifies a resume file, followed by a one byte format version
+const magic = "BTRS"
+
+// version is the only format version written and read
+const version uint8 = 1
+
+// ErrStale is returned by Validate when the data on disk no longer matches
+// the resume file and the torrent has to be rechecked
+var ErrStale = errors.New("resume data is stale")
+
+// FileInfo records the size and modification time of a file the torrent
+// writes to, as it was when the resume data was saved
+type FileInfo struct {
+	Path    string
+	Size    int64
+	ModTime int64 // Unix nanoseconds
+}
+
+// PartialPiece records which blocks of an unverified piece are on disk
+type PartialPiece struct {
+	Index  int
+	Blocks bitfield.Bitfield
+}
+
+// Data is the fast-resume state of a single torrent
+type Data struct {
+	InfoHash   [20]byte
+	NumPieces  int
+	Bitfield   bitfield.Bitfield
+	Files      []FileInfo
+	Uploaded   int64 // All-time payload bytes
+	Downloaded int64
+	Partial    []PartialPiece
+
+	// All-time protocol bytes besides the payload
+	UploadedOverhead   int64
+	DownloadedOverhead int64
+}
+
+// CompletedPieces counts the pieces marked as verified in the bitfield
+func (d *Data) CompletedPieces() int {
+	count := 0
+	for index := 0; index < d.NumPieces; index++ {
+		if d.Bitfield.HasPiece(index) {
+			count++
+		}
+	}
+	return count
+}
+
+// StatFiles returns the current size and modification time of each path.
+// Files that do not exist are reported with a zero size and time.
+func StatFiles(paths ...string) ([]FileInfo, error) {
+	files := make([]FileInfo, len(paths))
+	for i, path := range paths {
+		files[i].Path = filepath.Base(path)
+		info, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		files[i].Size = info.Size()
+		files[i].ModTime = info.ModTime().UnixNano()
+	}
+	return files, nil
+}
+
+// Validate checks that d belongs to the torrent and that the files on disk
+// have not changed since it was saved
+func Validate(d *Data, infoHash [20]byte, numPieces int, files []FileInfo) error {
+	if d.InfoHash != infoHash {
+		return fmt.Errorf("%w: infohash %x does not match %x", ErrStale, d.InfoHash, infoHash)
+	}
+	if d.NumPieces != numPieces {
+		return fmt.Errorf("%w: expected %d pieces, got %d", ErrStale, numPieces, d.NumPieces)
+	}
+	if len(d.Files) != len(files) {
+		return fmt.Errorf("%w: expected %d files, got %d", ErrStale, len(files), len(d.Files))
+	}
+	for i, f := range files {
+		if d.Files[i] != f {
+			return fmt.Errorf("%w: %s changed on disk", ErrStale, f.Path)
+		}
+	}
+	return nil
+}
+
+// Save writes d to path atomically by writing a temporary file next to it
+// and renaming it over the old one
+func Save(path string, d *Data) error {
+	tmp := path + ".tmp"
+	file, err := os.Create(tmp)
+	if err != nil {
+		return fmt.Errorf("failed to create resume file: %v", err)
+	}
+
+	_, err = file.Write(d.marshal())
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write resume file: %v", err)
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace resume file: %v", err)
+	}
+	return nil
+}
+
+// Load reads the resume file at path. The returned error wraps
+// os.ErrNotExist when there is no resume file yet.
+func Load(path string) (*Data, error) {
+	buf, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return unmarshal(buf)
+}
+
+func (d *Data) marshal() []byte {
+	buf := new(bytes.Buffer)
+
+	buf.WriteString(magic)
+	buf.WriteByte(version)
+	buf.Write(d.InfoHash[:])
+	binary.Write(buf, binary.BigEndian, uint32(d.NumPieces))
+	bf := make([]byte, (d.NumPieces+7)/8)
+	copy(bf, d.Bitfield)
+	buf.Write(bf)
+	binary.Write(buf, binary.BigEndian, uint64(d.Uploaded))
+	binary.Write(buf, binary.BigEndian, uint64(d.Downloaded))
+	binary.Write(buf, binary.BigEndian, uint64(d.UploadedOverhead))
+	binary.Write(buf, binary.BigEndian, uint64(d.DownloadedOverhead))
+
+	binary.Write(buf, binary.BigEndian, uint32(len(d.Files)))
+	for _, f := range d.Files {
+		binary.Write(buf, binary.BigEndian, uint16(len(f.Path)))
+		buf.WriteString(f.Path)
+		binary.Write(buf, binary.BigEndian, uint64(f.Size))
+		binary.Write(buf, binary.BigEndian, uint64(f.ModTime))
+	}
+
+	binary.Write(buf, binary.BigEndian, uint32(len(d.Partial)))
+	for _, p := range d.Partial {
+		binary.Write(buf, binary.BigEndian, uint32(p.Index))
+		binary.Write(buf, binary.BigEndian, uint32(len(p.Blocks)))
+		buf.Write(p.Blocks)
+	}
+
+	// Trailing checksum so a torn write is detected rather than trusted
+	binary.Write(buf, binary.BigEndian, crc32.ChecksumIEEE(buf.Bytes()))
+	return buf.Bytes()
+}
+
+func unmarshal(buf []byte) (*Data, error) {
+	if len(buf) < len(magic)+1+4 {
+		return nil, fmt.Errorf("resume file too short: %d bytes", len(buf))
+	}
+	body, sum := buf[:len(buf)-4], binary.BigEndian.Uint32(buf[len(buf)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, errors.New("resume file checksum mismatch")
+	}
+	if string(body[:len(magic)]) != magic {
+		return nil, errors.New("not a resume file")
+	}
+	if fileVersion := body[len(magic)]; fileVersion != version {
+		return nil, fmt.Errorf("unsupported resume file version %d", fileVersion)
+	}
+
+	r := bytes.NewReader(body[len(magic)+1:])
+	d := Data{}
+	var numPieces, numFiles, numPartial uint32
+	var uploaded, downloaded uint64
+	if _, err := io.ReadFull(r, d.InfoHash[:]); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &numPieces); err != nil {
+		return nil, err
+	}
+	d.NumPieces = int(numPieces)
+	d.Bitfield = make(bitfield.Bitfield, (d.NumPieces+7)/8)
+	if _, err := io.ReadFull(r, d.Bitfield); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &uploaded); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &downloaded); err != nil {
+		return nil, err
+	}
+	d.Uploaded, d.Downloaded = int64(uploaded), int64(downloaded)
+	if err := binary.Read(r, binary.BigEndian, &uploaded); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &downloaded); err != nil {
+		return nil, err
+	}
+	d.UploadedOverhead, d.DownloadedOverhead = int64(uploaded), int64(downloaded)
+
+	if err := binary.Read(r, binary.BigEndian, &numFiles); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < numFiles; i++ {
+		var pathLen uint16
+		var size, modTime uint64
+		if err := binary.Read(r, binary.BigEndian, &pathLen); err != nil {
+			return nil, err
+		}
+		path := make([]byte, pathLen)
+		if _, err := io.ReadFull(r, path); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &modTime); err != nil {
+			return nil, err
+		}
+		d.Files = append(d.Files, FileInfo{Path: string(path), Size: int64(size), ModTime: int64(modTime)})
+	}
+
+	if err := binary.Read(r, binary.BigEndian, &numPartial); err != nil {
+		return nil, err
+	}
+	for i := uint32(0); i < numPartial; i++ {
+		var index, blocksLen uint32
+		if err := binary.Read(r, binary.BigEndian, &index); err != nil {
+			return nil, err
+		}
+		if err := binary.Read(r, binary.BigEndian, &blocksLen); err != nil {
+			return nil, err
+		}
+		if int(blocksLen) > r.Len() {
+			return nil, io.ErrUnexpectedEOF
+		}
+		blocks := make(bitfield.Bitfield, blocksLen)
+		if _, err := io.ReadFull(r, blocks); err != nil {
+			return nil, err
+		}
+		d.Partial = append(d.Partial, PartialPiece{Index: int(index), Blocks: blocks})
+	}
+
+	return &d, nil
+}
+
+// A Saver bounds how often resume data is written. Callers check Due before
+// building a snapshot, and call Save directly when they must write now.
+type Saver struct {
+	path     string
+	interval time.Duration
+	last     time.Time
+}
+
+// NewSaver returns a Saver writing to path
+func NewSaver(path string, interval time.Duration) *Saver {
+	return &Saver{path: path, interval: interval}
+}
+
+// Due reports whether the interval has passed since the last write
+func (s *Saver) Due() bool {
+	return time.Since(s.last) >= s.interval
+}
+
+// Save writes d to the resume file
+func (s *Saver) Save(d *Data) error {
+	if err := Save(s.path, d); err != nil {
+		return err
+	}
+	s.last = time.Now()
+	return nil
+}
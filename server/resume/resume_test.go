@@ -0,0 +1,132 @@
+package resume
+
+import (
+	"bit_torrent/bitfield"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+var testData = Data{
+	InfoHash:           [20]byte{1, 2, 3},
+	NumPieces:          10,
+	Bitfield:           bitfield.Bitfield{0b10100000, 0b01000000},
+	Files:              []FileInfo{{Path: "a", Size: 5, ModTime: 100}, {Path: "b", Size: 0, ModTime: 0}},
+	Uploaded:           1 << 40,
+	Downloaded:         12345,
+	Partial:            []PartialPiece{{Index: 1, Blocks: bitfield.Bitfield{0b11000000}}, {Index: 3, Blocks: bitfield.Bitfield{0, 1}}},
+	UploadedOverhead:   7,
+	DownloadedOverhead: 8,
+}
+
+func TestUnmarshal(t *testing.T) {
+	noPartial := testData
+	noPartial.Partial = nil
+	tests := []struct {
+		name string
+		data Data
+	}{
+		{"partial pieces", testData},
+		{"no partial pieces", noPartial},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := unmarshal(tt.data.marshal())
+			if err != nil {
+				t.Fatalf("unmarshal() error = %v", err)
+			}
+			if !reflect.DeepEqual(*got, tt.data) {
+				t.Errorf("unmarshal() = %+v, want %+v", *got, tt.data)
+			}
+			if n := got.CompletedPieces(); n != 3 {
+				t.Errorf("CompletedPieces() = %d, want 3", n)
+			}
+		})
+	}
+}
+
+func TestUnmarshalRejects(t *testing.T) {
+	good := testData.marshal()
+	corrupt := append([]byte(nil), good...)
+	corrupt[len(magic)+5] ^= 0xff
+	truncated := good[:len(good)-10]
+	// A partial piece claiming more blocks than the file holds
+	overlong := append([]byte(nil), good[:len(good)-4-2]...)
+	binary.BigEndian.PutUint32(overlong[len(overlong)-4:], 1<<30)
+	overlong = binary.BigEndian.AppendUint32(overlong, crc32.ChecksumIEEE(overlong))
+	// A future version with a valid checksum
+	future := append([]byte(nil), good[:len(good)-4]...)
+	future[len(magic)] = version + 1
+	future = binary.BigEndian.AppendUint32(future, crc32.ChecksumIEEE(future))
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"empty", nil},
+		{"too short", []byte("BTRS")},
+		{"flipped byte", corrupt},
+		{"truncated", truncated},
+		{"future version", future},
+		{"overlong partial piece", overlong},
+		{"not a resume file", binary.BigEndian.AppendUint32([]byte("JUNK\x01"), crc32.ChecksumIEEE([]byte("JUNK\x01")))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if d, err := unmarshal(tt.data); err == nil {
+				t.Errorf("unmarshal() = %+v, want an error", d)
+			}
+		})
+	}
+}
+
+func TestSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "torrent.resume")
+	if _, err := Load(path); !errors.Is(err, os.ErrNotExist) {
+		t.Fatalf("Load() of a missing file error = %v, want os.ErrNotExist", err)
+	}
+	d := testData
+	if err := Save(path, &d); err != nil {
+		t.Fatal(err)
+	}
+	got, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*got, testData) {
+		t.Errorf("Load() = %+v, want %+v", *got, testData)
+	}
+	if _, err := os.Stat(path + ".tmp"); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("temporary file left behind: %v", err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	files := testData.Files
+	changed := []FileInfo{files[0], {Path: "b", Size: 3, ModTime: 200}}
+	tests := []struct {
+		name      string
+		infoHash  [20]byte
+		numPieces int
+		files     []FileInfo
+		stale     bool
+	}{
+		{"matches", testData.InfoHash, 10, files, false},
+		{"other torrent", [20]byte{9}, 10, files, true},
+		{"piece count", testData.InfoHash, 11, files, true},
+		{"file count", testData.InfoHash, 10, files[:1], true},
+		{"file changed", testData.InfoHash, 10, changed, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := Validate(&testData, tt.infoHash, tt.numPieces, tt.files)
+			if errors.Is(err, ErrStale) != tt.stale {
+				t.Errorf("Validate() error = %v, want stale %t", err, tt.stale)
+			}
+		})
+	}
+}
@@ -0,0 +1,241 @@
+package session
+
+import (
+	"bit_torrent/storage"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Dirs are where torrent data is kept. New torrents download into
+// Incomplete, or the output directory when it is empty, and move to
+// Complete when they finish unless it is empty.
+type Dirs struct {
+	Incomplete string `json:"incomplete,omitempty"`
+	Complete   string `json:"complete,omitempty"`
+}
+
+// Dirs returns the directories of torrents without their own
+func (m *Manager) Dirs() Dirs {
+	return m.cfg.Dirs
+}
+
+// Dirs returns the torrent's own directories, which replace the session's
+// where they are set
+func (t *Torrent) Dirs() Dirs {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dirs
+}
+
+// SetDirs changes a torrent's own directories, which must be absolute and
+// inside the data directories. Data already on disk stays where it is until
+// the torrent completes or is moved.
+func (m *Manager) SetDirs(hash [20]byte, dirs Dirs) error {
+	for _, dir := range []string{dirs.Incomplete, dirs.Complete} {
+		if dir == "" {
+			continue
+		}
+		if err := m.checkDir(dir); err != nil {
+			return err
+		}
+	}
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.dirs = dirs
+	t.mu.Unlock()
+	t.changed()
+	return nil
+}
+
+// SavePath returns where the torrent's data is
+func (t *Torrent) SavePath() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.savePath
+}
+
+// downloadDir is where new torrents download into
+func (m *Manager) downloadDir() string {
+	if m.cfg.Dirs.Incomplete != "" {
+		return m.cfg.Dirs.Incomplete
+	}
+	return m.cfg.OutputDir
+}
+
+// dirsFor merges the torrent's directories, and then its category's save
+// directory, over the session's
+func (m *Manager) dirsFor(t *Torrent) Dirs {
+	dirs := m.cfg.Dirs
+	own := t.Dirs()
+	if own.Incomplete != "" {
+		dirs.Incomplete = own.Incomplete
+	}
+	if path := m.categoryPath(t.Category()); path != "" {
+		dirs.Complete = path
+	}
+	if own.Complete != "" {
+		dirs.Complete = own.Complete
+	}
+	return dirs
+}
+
+// checkDir checks that dir, given for a single torrent, is absolute and
+// inside the output directory, the session's directories or DataDirs
+func (m *Manager) checkDir(dir string) error {
+	if !filepath.IsAbs(dir) {
+		return fmt.Errorf("%w: %s is not an absolute path", ErrDirNotAllowed, dir)
+	}
+	// Cleaning would take .. after a symlink back out of it
+	for _, part := range strings.Split(filepath.ToSlash(dir), "/") {
+		if part == ".." {
+			return fmt.Errorf("%w: %s contains ..", ErrDirNotAllowed, dir)
+		}
+	}
+	roots := append([]string{m.cfg.OutputDir, m.cfg.Dirs.Incomplete, m.cfg.Dirs.Complete}, m.cfg.DataDirs...)
+	for _, root := range roots {
+		if root != "" && underDir(root, dir) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: %s is outside the data directories", ErrDirNotAllowed, dir)
+}
+
+// underDir reports whether dir is root or lies inside it once symlinks in
+// both are resolved
+func underDir(root, dir string) bool {
+	root, err := resolvePath(root)
+	if err != nil {
+		return false
+	}
+	dir, err = resolvePath(dir)
+	if err != nil {
+		return false
+	}
+	rel, err := filepath.Rel(root, dir)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// resolvePath makes path absolute and resolves the symlinks in the part of
+// it that exists, keeping the rest as it is
+func resolvePath(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	missing := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, missing), nil
+		}
+		parent := filepath.Dir(path)
+		if !errors.Is(err, os.ErrNotExist) || parent == path {
+			return "", err
+		}
+		missing = filepath.Join(filepath.Base(path), missing)
+		path = parent
+	}
+}
+
+// checkDataPath checks that path lies inside one of the directories the
+// session keeps data in, so it can be deleted
+func (m *Manager) checkDataPath(t *Torrent, path string) error {
+	dirs := m.dirsFor(t)
+	err := insideDir(m.cfg.OutputDir, path)
+	for _, dir := range []string{dirs.Incomplete, dirs.Complete} {
+		if err == nil {
+			break
+		}
+		if dir != "" {
+			err = insideDir(dir, path)
+		}
+	}
+	return err
+}
+
+// MoveStorage moves a torrent's data into dir, which becomes its complete
+// directory and must be absolute and inside the data directories. A running
+// torrent is stopped for the move and started again afterwards, a seeding
+// one keeps seeding. One paused in place stays paused.
+func (m *Manager) MoveStorage(hash [20]byte, dir string) error {
+	if dir == "" {
+		return errors.New("no directory to move to")
+	}
+	if err := m.checkDir(dir); err != nil {
+		return err
+	}
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+
+	// Keep the torrent from starting, or the queue from restarting a seed,
+	// while its data moves
+	t.mu.Lock()
+	restart := false
+	switch t.state {
+	case StateQueued, StateChecking, StateDownloading, StateSeeding:
+		restart = t.setState(StatePaused, nil) == nil
+	}
+	t.mu.Unlock()
+	t.stop()
+
+	err = t.move(filepath.Join(dir, t.Name))
+	if err == nil {
+		// Completing must not move it back, and deleting its data must
+		// find it inside a directory of the torrent's
+		t.mu.Lock()
+		t.dirs.Complete = dir
+		t.mu.Unlock()
+	}
+	if restart {
+		t.enqueue()
+	}
+	m.save()
+	m.schedule()
+	return err
+}
+
+// movesWhenComplete reports whether the torrent's data is to move into its
+// complete directory once downloaded
+func (m *Manager) movesWhenComplete(t *Torrent) bool {
+	dir := m.dirsFor(t).Complete
+	return dir != "" && filepath.Clean(filepath.Join(dir, t.Name)) != filepath.Clean(t.SavePath())
+}
+
+// moveToComplete moves a finished torrent's data into its complete
+// directory, if it has one. Failing to move leaves the data in place.
+func (m *Manager) moveToComplete(t *Torrent) error {
+	dir := m.dirsFor(t).Complete
+	if dir == "" {
+		return nil
+	}
+	if err := t.move(filepath.Join(dir, t.Name)); err != nil {
+		return fmt.Errorf("failed to move to %s: %w", dir, err)
+	}
+	m.save()
+	return nil
+}
+
+// move moves the torrent's data to path. The torrent must not be running.
+func (t *Torrent) move(path string) error {
+	from := t.SavePath()
+	if filepath.Clean(from) == filepath.Clean(path) {
+		return nil
+	}
+	log.Printf("Moving data of %s from %s to %s\n", t.Name, from, path)
+	if err := storage.Move(from, path); err != nil {
+		return fmt.Errorf("failed to move data: %w", err)
+	}
+	t.mu.Lock()
+	t.savePath = path
+	t.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,150 @@
+package session
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMoveStorage(t *testing.T) {
+	root := t.TempDir()
+	output, moved := filepath.Join(root, "output"), filepath.Join(root, "moved")
+	m := New(Config{OutputDir: output, DataDirs: []string{moved}})
+	defer m.Shutdown()
+
+	tor := seedingTorrent(m, 1, 0, 0, 0, 0)
+	tor.state = StatePaused
+	tor.savePath = filepath.Join(output, tor.Name)
+	tor.TorrentPath = filepath.Join(root, "uploads", tor.Name, tor.Name+".torrent")
+	tor.ResumePath = filepath.Join(root, "uploads", tor.Name, ResumeFileName)
+	if err := os.MkdirAll(output, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(tor.savePath, []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, dir := range []string{filepath.Join(root, "uploads"), "moved"} {
+		if err := m.MoveStorage(tor.InfoHash, dir); !errors.Is(err, ErrDirNotAllowed) {
+			t.Errorf("MoveStorage(%q) error = %v, want ErrDirNotAllowed", dir, err)
+		}
+	}
+	if err := m.MoveStorage(tor.InfoHash, moved); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tor.SavePath(), filepath.Join(moved, tor.Name); got != want {
+		t.Errorf("SavePath() = %q, want %q", got, want)
+	}
+	if got := tor.Dirs().Complete; got != moved {
+		t.Errorf("complete directory = %q, want %q", got, moved)
+	}
+	if state, _ := tor.State(); state != StatePaused {
+		t.Errorf("state = %q, want it to stay paused", state)
+	}
+
+	// The data is deletable where it moved to
+	if err := m.Remove(tor.InfoHash, true); err != nil {
+		t.Fatalf("Remove() error = %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(moved, tor.Name)); !os.IsNotExist(err) {
+		t.Errorf("data was not deleted: %v", err)
+	}
+}
+
+func TestCheckDir(t *testing.T) {
+	root := t.TempDir()
+	output, extra, other := filepath.Join(root, "output"), filepath.Join(root, "extra"), filepath.Join(root, "other")
+	for _, dir := range []string{output, extra, other} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Symlink(other, filepath.Join(output, "escape")); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	m := New(Config{OutputDir: output, DataDirs: []string{extra}})
+	defer m.Shutdown()
+
+	tests := []struct {
+		name    string
+		dir     string
+		allowed bool
+	}{
+		{"output directory", output, true},
+		{"inside it", filepath.Join(output, "movies"), true},
+		{"not created yet", filepath.Join(output, "new", "dir"), true},
+		{"extra directory", filepath.Join(extra, "tv"), true},
+		{"relative", "output/movies", false},
+		{"elsewhere", other, false},
+		{"root", "/", false},
+		{"dot dot", output + "/../other", false},
+		{"dot dot that stays inside", output + "/movies/../tv", false},
+		{"through a symlink", filepath.Join(output, "escape", "movies"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := m.checkDir(tt.dir)
+			if (err == nil) != tt.allowed {
+				t.Errorf("checkDir(%q) = %v, want allowed %t", tt.dir, err, tt.allowed)
+			}
+			if err != nil && !errors.Is(err, ErrDirNotAllowed) {
+				t.Errorf("checkDir(%q) = %v, want ErrDirNotAllowed", tt.dir, err)
+			}
+		})
+	}
+}
+
+func TestAddChecksSaveDir(t *testing.T) {
+	root := t.TempDir()
+	output := filepath.Join(root, "output")
+	m := New(Config{OutputDir: output})
+	defer m.Shutdown()
+	path := writeTorrent(t, filepath.Join(root, "uploads", "a"), "a", "http://127.0.0.1:1/announce", []byte("data"))
+
+	_, err := m.Add(path, "a", AddOptions{SaveDir: filepath.Join(root, "elsewhere")})
+	if !errors.Is(err, ErrDirNotAllowed) {
+		t.Fatalf("Add() outside the data directories error = %v, want ErrDirNotAllowed", err)
+	}
+	if len(m.List()) != 0 {
+		t.Error("the torrent was added anyway")
+	}
+	tor, err := m.Add(path, "a", AddOptions{SaveDir: filepath.Join(output, "movies")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := tor.SavePath(), filepath.Join(output, "movies", "a"); got != want {
+		t.Errorf("SavePath() = %q, want %q", got, want)
+	}
+}
+
+func TestSetDirs(t *testing.T) {
+	root := t.TempDir()
+	output := filepath.Join(root, "output")
+	m := New(Config{OutputDir: output})
+	defer m.Shutdown()
+	tor := seedingTorrent(m, 1, 0, 0, 0, 0)
+
+	want := Dirs{Incomplete: filepath.Join(output, "incomplete"), Complete: filepath.Join(output, "done")}
+	tests := []struct {
+		name string
+		dirs Dirs
+		err  error
+	}{
+		{"inside the output directory", want, nil},
+		{"incomplete elsewhere", Dirs{Incomplete: root}, ErrDirNotAllowed},
+		{"complete elsewhere", Dirs{Incomplete: want.Incomplete, Complete: "/tmp"}, ErrDirNotAllowed},
+		{"relative", Dirs{Complete: "done"}, ErrDirNotAllowed},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.SetDirs(tor.InfoHash, tt.dirs); !errors.Is(err, tt.err) {
+				t.Errorf("SetDirs(%+v) error = %v, want %v", tt.dirs, err, tt.err)
+			}
+			// Refused directories leave the torrent's as they were
+			if got := tor.Dirs(); got != want {
+				t.Errorf("Dirs() = %+v, want %+v", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package session
+
+import "fmt"
+
+// Event is something that happens to a torrent that is reported through
+// Config.Events
+type Event string
+
+const (
+	EventAdded     Event = "added"
+	EventCompleted Event = "completed" // Every wanted piece was downloaded
+	EventErrored   Event = "errored"
+)
+
+// ParseEvent validates an event name
+func ParseEvent(s string) (Event, error) {
+	switch event := Event(s); event {
+	case EventAdded, EventCompleted, EventErrored:
+		return event, nil
+	}
+	return "", fmt.Errorf("invalid event %q", s)
+}
+
+func (m *Manager) emit(t *Torrent, event Event) {
+	if m.cfg.Events != nil {
+		m.cfg.Events(t, event)
+	}
+}
@@ -0,0 +1,226 @@
+package session
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+// GoalAction is what the session does with a torrent that reaches one of
+// its seeding goals
+type GoalAction string
+
+const (
+	GoalPause      GoalAction = "pause"
+	GoalRemove     GoalAction = "remove"
+	GoalRemoveData GoalAction = "remove-data" // Remove the torrent and delete its data
+)
+
+// ParseGoalAction validates a seeding goal action
+func ParseGoalAction(s string) (GoalAction, error) {
+	switch action := GoalAction(s); action {
+	case GoalPause, GoalRemove, GoalRemoveData:
+		return action, nil
+	}
+	return "", fmt.Errorf("invalid seeding goal action %q", s)
+}
+
+// SeedGoals end seeding once the share ratio, the time spent seeding or
+// the time spent seeding without uploading reaches a maximum. A zero
+// maximum is no goal.
+type SeedGoals struct {
+	Ratio    float64
+	SeedTime time.Duration
+	IdleTime time.Duration
+	Action   GoalAction
+}
+
+// seedGoalsJSON is SeedGoals with durations written like "24h0m0s"
+type seedGoalsJSON struct {
+	Ratio    float64    `json:"ratio"`
+	SeedTime string     `json:"seed_time"`
+	IdleTime string     `json:"idle_time"`
+	Action   GoalAction `json:"action"`
+}
+
+func (g SeedGoals) MarshalJSON() ([]byte, error) {
+	return json.Marshal(seedGoalsJSON{
+		Ratio:    g.Ratio,
+		SeedTime: g.SeedTime.String(),
+		IdleTime: g.IdleTime.String(),
+		Action:   g.Action,
+	})
+}
+
+func (g *SeedGoals) UnmarshalJSON(data []byte) error {
+	var j seedGoalsJSON
+	if err := json.Unmarshal(data, &j); err != nil {
+		return err
+	}
+	seedTime, err := parseGoalDuration(j.SeedTime)
+	if err != nil {
+		return err
+	}
+	idleTime, err := parseGoalDuration(j.IdleTime)
+	if err != nil {
+		return err
+	}
+	*g = SeedGoals{Ratio: j.Ratio, SeedTime: seedTime, IdleTime: idleTime, Action: j.Action}
+	return nil
+}
+
+func parseGoalDuration(s string) (time.Duration, error) {
+	if s == "" {
+		return 0, nil
+	}
+	return time.ParseDuration(s)
+}
+
+// reached describes the first goal the torrent has reached, or returns ""
+func (g SeedGoals) reached(ratio float64, seeding, idle time.Duration) string {
+	switch {
+	case g.Ratio > 0 && ratio >= g.Ratio:
+		return fmt.Sprintf("ratio %.2f reached", g.Ratio)
+	case g.SeedTime > 0 && seeding >= g.SeedTime:
+		return fmt.Sprintf("seeding time %s reached", g.SeedTime)
+	case g.IdleTime > 0 && idle >= g.IdleTime:
+		return fmt.Sprintf("idle seeding time %s reached", g.IdleTime)
+	}
+	return ""
+}
+
+// SeedGoals returns the goals of torrents without their own
+func (m *Manager) SeedGoals() SeedGoals {
+	m.goalsMu.Lock()
+	defer m.goalsMu.Unlock()
+	return m.seedGoals
+}
+
+// SetSeedGoals changes the goals of torrents without their own
+func (m *Manager) SetSeedGoals(goals SeedGoals) {
+	m.goalsMu.Lock()
+	m.seedGoals = goals
+	m.goalsMu.Unlock()
+	m.checkSeedGoals()
+}
+
+// SeedGoals returns the torrent's own goals, nil when it follows the session's
+func (t *Torrent) SeedGoals() *SeedGoals {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.seedGoals == nil {
+		return nil
+	}
+	goals := *t.seedGoals
+	return &goals
+}
+
+// SetSeedGoals gives the torrent its own goals, or makes it follow the
+// session's again when goals is nil
+func (t *Torrent) SetSeedGoals(goals *SeedGoals) {
+	t.mu.Lock()
+	if goals != nil {
+		copied := *goals
+		goals = &copied
+	}
+	t.seedGoals = goals
+	t.mu.Unlock()
+	t.changed()
+}
+
+// Ratio is the all-time payload uploaded over downloaded. Torrents whose
+// data was already on disk count their size as downloaded.
+func (t *Torrent) Ratio() float64 {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ratio()
+}
+
+// ratio must be called with t.mu held
+func (t *Torrent) ratio() float64 {
+	if t.progress.Stats == nil {
+		return 0
+	}
+	downloaded := t.progress.Stats.Download.Payload
+	if downloaded == 0 {
+		downloaded = int64(t.Meta.Length)
+	}
+	if downloaded == 0 {
+		return 0
+	}
+	return float64(t.progress.Stats.Upload.Payload) / float64(downloaded)
+}
+
+// SeedingTime is how long the torrent has been seeding in total
+func (t *Torrent) SeedingTime() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.seedingTime()
+}
+
+// seedingTime must be called with t.mu held
+func (t *Torrent) seedingTime() time.Duration {
+	if t.state == StateSeeding {
+		return t.seededFor + time.Since(t.seedingSince)
+	}
+	return t.seededFor
+}
+
+// trackSeeding keeps the seeding time as the torrent moves from state to
+// next. It must be called with t.mu held.
+func (t *Torrent) trackSeeding(next State) {
+	switch {
+	case t.state == StateSeeding && next != StateSeeding:
+		t.seededFor += time.Since(t.seedingSince)
+	case t.state != StateSeeding && next == StateSeeding:
+		t.seedingSince = time.Now()
+		t.lastUpload = t.seedingSince
+	}
+}
+
+// checkSeedGoals applies the goal action to seeding torrents that have
+// reached one of their goals. A torrent the action fails for is stopped
+// and errored.
+func (m *Manager) checkSeedGoals() {
+	defaults := m.SeedGoals()
+	for _, t := range m.List() {
+		t.mu.Lock()
+		goals := defaults
+		if t.seedGoals != nil {
+			goals = *t.seedGoals
+		}
+		reason := ""
+		if t.state == StateSeeding {
+			reason = goals.reached(t.ratio(), t.seedingTime(), time.Since(t.lastUpload))
+		}
+		if reason != "" {
+			t.goalReached = reason
+		}
+		t.mu.Unlock()
+		if reason == "" {
+			continue
+		}
+
+		log.Printf("Torrent %s: %s, applying %s\n", t.Name, reason, goals.Action)
+		var err error
+		switch goals.Action {
+		case GoalRemove:
+			err = m.Remove(t.InfoHash, false)
+		case GoalRemoveData:
+			err = m.Remove(t.InfoHash, true)
+		default:
+			err = m.Pause(t.InfoHash)
+		}
+		if err == nil {
+			continue
+		}
+		if _, getErr := m.Get(t.InfoHash); getErr != nil {
+			log.Printf("Failed to apply seeding goal to %s: %v\n", t.Name, err)
+			continue
+		}
+		// Left seeding, the torrent would fail the same way on every check
+		t.stop()
+		m.fail(t, fmt.Errorf("failed to apply seeding goal: %w", err))
+	}
+}
@@ -0,0 +1,140 @@
+package session
+
+import (
+	"bit_torrent/p2p"
+	"bit_torrent/torrent"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeedGoalsReached(t *testing.T) {
+	goals := SeedGoals{Ratio: 2, SeedTime: time.Hour, IdleTime: 10 * time.Minute}
+	tests := []struct {
+		name    string
+		goals   SeedGoals
+		ratio   float64
+		seeding time.Duration
+		idle    time.Duration
+		want    string
+	}{
+		{"no goals", SeedGoals{}, 100, 100 * time.Hour, 100 * time.Hour, ""},
+		{"none reached", goals, 1.5, 30 * time.Minute, time.Minute, ""},
+		{"ratio", goals, 2, 0, 0, "ratio 2.00 reached"},
+		{"seeding time", goals, 0, time.Hour, 0, "seeding time 1h0m0s reached"},
+		{"idle time", goals, 0, 0, 10 * time.Minute, "idle seeding time 10m0s reached"},
+		{"ratio first", goals, 3, 2 * time.Hour, time.Hour, "ratio 2.00 reached"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.goals.reached(tt.ratio, tt.seeding, tt.idle); got != tt.want {
+				t.Errorf("reached() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// seedingTorrent adds a torrent to m that has been seeding for seeding,
+// uploading its last byte idle ago
+func seedingTorrent(m *Manager, hash byte, downloaded, uploaded int64, seeding, idle time.Duration) *Torrent {
+	t := &Torrent{
+		InfoHash:     [20]byte{hash},
+		Name:         string('a' + rune(hash)),
+		Meta:         torrent.TorrentFile{Length: 1000},
+		state:        StateSeeding,
+		changed:      m.save,
+		seedingSince: time.Now().Add(-seeding),
+		lastUpload:   time.Now().Add(-idle),
+		progress: p2p.ProgressData{Progress: 100, Stats: &p2p.TransferStats{
+			Download: p2p.TransferTotals{Payload: downloaded},
+			Upload:   p2p.TransferTotals{Payload: uploaded},
+		}},
+	}
+	m.mu.Lock()
+	m.torrents[t.InfoHash] = t
+	m.queue = append(m.queue, t)
+	m.mu.Unlock()
+	return t
+}
+
+func TestCheckSeedGoals(t *testing.T) {
+	tests := []struct {
+		name       string
+		defaults   SeedGoals
+		own        *SeedGoals
+		downloaded int64
+		uploaded   int64
+		seeding    time.Duration
+		idle       time.Duration
+		want       State
+		reached    string
+	}{
+		{"below the ratio", SeedGoals{Ratio: 1}, nil, 1000, 999, time.Hour, 0, StateSeeding, ""},
+		{"ratio of uploads", SeedGoals{Ratio: 1}, nil, 1000, 1000, 0, 0, StatePaused, "ratio 1.00 reached"},
+		{"data already on disk counts as downloaded", SeedGoals{Ratio: 1}, nil, 0, 1000, 0, 0, StatePaused, "ratio 1.00 reached"},
+		{"seeding time", SeedGoals{SeedTime: time.Hour}, nil, 1000, 0, 2 * time.Hour, 0, StatePaused, "seeding time 1h0m0s reached"},
+		{"uploading is not idle", SeedGoals{IdleTime: time.Hour}, nil, 1000, 500, 2 * time.Hour, time.Minute, StateSeeding, ""},
+		{"idle", SeedGoals{IdleTime: time.Hour}, nil, 1000, 500, 2 * time.Hour, 2 * time.Hour, StatePaused, "idle seeding time 1h0m0s reached"},
+		{"own goals replace the session's", SeedGoals{Ratio: 1}, &SeedGoals{Ratio: 5}, 1000, 2000, 0, 0, StateSeeding, ""},
+		{"remove", SeedGoals{Ratio: 1, Action: GoalRemove}, nil, 1000, 1000, 0, 0, "", "ratio 1.00 reached"},
+		// It has no output directory to delete data from
+		{"remove data it may not delete", SeedGoals{Ratio: 1, Action: GoalRemoveData}, nil, 1000, 1000, 0, 0, StateErrored, "ratio 1.00 reached"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := New(Config{SeedGoals: tt.defaults})
+			defer m.Shutdown()
+			tor := seedingTorrent(m, 1, tt.downloaded, tt.uploaded, tt.seeding, tt.idle)
+			tor.seedGoals = tt.own
+			dir := filepath.Join(t.TempDir(), tor.Name)
+			tor.TorrentPath = filepath.Join(dir, tor.Name+".torrent")
+			tor.ResumePath = filepath.Join(dir, ResumeFileName)
+
+			m.checkSeedGoals()
+			state, _ := tor.State()
+			if _, err := m.Get(tor.InfoHash); err != nil {
+				state = "" // Removed
+			}
+			if state != tt.want {
+				t.Errorf("state = %q, want %q", state, tt.want)
+			}
+			if tor.Status().GoalReached != tt.reached {
+				t.Errorf("goal reached = %q, want %q", tor.Status().GoalReached, tt.reached)
+			}
+		})
+	}
+}
+
+func TestCheckSeedGoalsOnlySeeds(t *testing.T) {
+	m := New(Config{SeedGoals: SeedGoals{SeedTime: time.Minute}})
+	defer m.Shutdown()
+	tor := seedingTorrent(m, 1, 1000, 5000, time.Hour, time.Hour)
+	tor.state = StateDownloading
+
+	m.checkSeedGoals()
+	if state, _ := tor.State(); state != StateDownloading {
+		t.Errorf("state = %q, want %q", state, StateDownloading)
+	}
+}
+
+func TestSetProgressTracksUploads(t *testing.T) {
+	m := New(Config{})
+	defer m.Shutdown()
+	tor := seedingTorrent(m, 1, 1000, 500, time.Hour, time.Hour)
+	idleSince := tor.lastUpload
+
+	report := func(uploaded int64) {
+		tor.setProgress(p2p.ProgressData{Progress: 100, Stats: &p2p.TransferStats{
+			Upload: p2p.TransferTotals{Payload: uploaded},
+		}})
+	}
+	// Progress without new uploads, such as keepalives, leaves it idle
+	report(500)
+	if !tor.lastUpload.Equal(idleSince) {
+		t.Errorf("lastUpload moved without an upload")
+	}
+	report(600)
+	if time.Since(tor.lastUpload) > time.Minute {
+		t.Errorf("lastUpload = %v after an upload", tor.lastUpload)
+	}
+}
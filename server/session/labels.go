@@ -0,0 +1,195 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+var (
+	// ErrNoCategory is returned for categories the session does not have
+	ErrNoCategory = errors.New("session: category not found")
+	// ErrInvalidLabel is returned for category and tag names that cannot be used
+	ErrInvalidLabel = errors.New("session: invalid category or tag")
+)
+
+// Category groups torrents. Torrents in a category without a save
+// directory of their own download into, or move to when they complete,
+// its SavePath when it has one.
+type Category struct {
+	Name     string `json:"name"`
+	SavePath string `json:"save_path,omitempty"`
+}
+
+// checkLabel validates a category or tag name. Commas are refused so tags
+// can be given as a comma separated list.
+func checkLabel(kind, name string) error {
+	if name == "" || strings.TrimSpace(name) != name {
+		return fmt.Errorf("%w: %s %q must not be empty or start or end with spaces", ErrInvalidLabel, kind, name)
+	}
+	if strings.ContainsRune(name, ',') || strings.IndexFunc(name, unicode.IsControl) >= 0 {
+		return fmt.Errorf("%w: %s %q must not contain commas or control characters", ErrInvalidLabel, kind, name)
+	}
+	return nil
+}
+
+// ParseTags validates tags given one by one or as comma separated lists,
+// returning them sorted and without duplicates
+func ParseTags(values []string) ([]string, error) {
+	set := make(map[string]bool)
+	for _, value := range values {
+		for _, tag := range strings.Split(value, ",") {
+			tag = strings.TrimSpace(tag)
+			if tag == "" {
+				continue
+			}
+			if err := checkLabel("tag", tag); err != nil {
+				return nil, err
+			}
+			set[tag] = true
+		}
+	}
+	return sortedTags(set), nil
+}
+
+func sortedTags(set map[string]bool) []string {
+	tags := make([]string, 0, len(set))
+	for tag := range set {
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// Categories returns the session's categories by name
+func (m *Manager) Categories() []Category {
+	m.labelsMu.Lock()
+	defer m.labelsMu.Unlock()
+	categories := make([]Category, 0, len(m.categories))
+	for _, c := range m.categories {
+		categories = append(categories, c)
+	}
+	sort.Slice(categories, func(i, j int) bool { return categories[i].Name < categories[j].Name })
+	return categories
+}
+
+// SetCategory creates a category or changes its save directory, which must
+// be absolute and inside the data directories. Data of torrents already in
+// it stays where it is until they complete or are moved.
+func (m *Manager) SetCategory(c Category) error {
+	if err := checkLabel("category", c.Name); err != nil {
+		return err
+	}
+	if c.SavePath != "" {
+		if err := m.checkDir(c.SavePath); err != nil {
+			return err
+		}
+	}
+	m.labelsMu.Lock()
+	m.categories[c.Name] = c
+	m.labelsMu.Unlock()
+	m.save()
+	return nil
+}
+
+// RemoveCategory deletes a category, leaving its torrents without one
+func (m *Manager) RemoveCategory(name string) error {
+	m.labelsMu.Lock()
+	_, ok := m.categories[name]
+	delete(m.categories, name)
+	m.labelsMu.Unlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrNoCategory, name)
+	}
+	for _, t := range m.List() {
+		t.mu.Lock()
+		if t.category == name {
+			t.category = ""
+		}
+		t.mu.Unlock()
+	}
+	m.save()
+	return nil
+}
+
+// useCategory validates a category a torrent is put in, creating it
+// without a save directory if the session does not have it yet
+func (m *Manager) useCategory(name string) error {
+	if name == "" {
+		return nil
+	}
+	if err := checkLabel("category", name); err != nil {
+		return err
+	}
+	m.labelsMu.Lock()
+	defer m.labelsMu.Unlock()
+	if _, ok := m.categories[name]; !ok {
+		m.categories[name] = Category{Name: name}
+	}
+	return nil
+}
+
+// categoryPath returns the save directory of a category, or "" when it has none
+func (m *Manager) categoryPath(name string) string {
+	m.labelsMu.Lock()
+	defer m.labelsMu.Unlock()
+	return m.categories[name].SavePath
+}
+
+// SetTorrentCategory puts a torrent in a category, or in none when name is
+// empty. An unfinished torrent moves to the new category's save directory
+// when it completes, finished data stays where it is.
+func (m *Manager) SetTorrentCategory(hash [20]byte, name string) error {
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+	if err := m.useCategory(name); err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.category = name
+	t.mu.Unlock()
+	m.save()
+	return nil
+}
+
+// Tags returns every tag in use, sorted
+func (m *Manager) Tags() []string {
+	set := make(map[string]bool)
+	for _, t := range m.List() {
+		for _, tag := range t.Tags() {
+			set[tag] = true
+		}
+	}
+	return sortedTags(set)
+}
+
+// Category returns the torrent's category, "" when it has none
+func (t *Torrent) Category() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.category
+}
+
+// Tags returns the torrent's tags, sorted
+func (t *Torrent) Tags() []string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]string(nil), t.tags...)
+}
+
+// SetTags replaces the torrent's tags
+func (t *Torrent) SetTags(tags []string) error {
+	tags, err := ParseTags(tags)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.tags = tags
+	t.mu.Unlock()
+	t.changed()
+	return nil
+}
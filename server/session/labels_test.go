@@ -0,0 +1,38 @@
+package session
+
+import (
+	"errors"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestSetCategory(t *testing.T) {
+	root := t.TempDir()
+	output := filepath.Join(root, "output")
+	m := New(Config{OutputDir: output})
+	defer m.Shutdown()
+
+	tests := []struct {
+		name     string
+		category Category
+		err      error
+	}{
+		{"no save path", Category{Name: "linux"}, nil},
+		{"inside the output directory", Category{Name: "movies", SavePath: filepath.Join(output, "movies")}, nil},
+		{"outside", Category{Name: "etc", SavePath: "/etc"}, ErrDirNotAllowed},
+		{"relative", Category{Name: "tv", SavePath: "tv"}, ErrDirNotAllowed},
+		{"bad name", Category{Name: " spaced "}, ErrInvalidLabel},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := m.SetCategory(tt.category); !errors.Is(err, tt.err) {
+				t.Errorf("SetCategory(%+v) error = %v, want %v", tt.category, err, tt.err)
+			}
+		})
+	}
+	want := []Category{{Name: "linux"}, {Name: "movies", SavePath: filepath.Join(output, "movies")}}
+	if got := m.Categories(); !reflect.DeepEqual(got, want) {
+		t.Errorf("Categories() = %+v, want %+v", got, want)
+	}
+}
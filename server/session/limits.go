@@ -0,0 +1,55 @@
+package session
+
+// Limits is a pair of transfer rates in bytes per second, 0 meaning unlimited
+type Limits struct {
+	Download int64 `json:"download"`
+	Upload   int64 `json:"upload"`
+}
+
+// Limits returns the normal limits shared by every torrent
+func (m *Manager) Limits() Limits {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	return m.limits
+}
+
+// SetLimits changes the normal limits shared by every torrent, straight
+// away for running ones unless the alternative limits apply
+func (m *Manager) SetLimits(limits Limits) {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	m.limits = limits
+	m.applyLimits()
+}
+
+// AltLimits returns the alternative limits shared by every torrent
+func (m *Manager) AltLimits() Limits {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	return m.altLimits
+}
+
+// SetAltLimits changes the alternative limits shared by every torrent
+func (m *Manager) SetAltLimits(limits Limits) {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	m.altLimits = limits
+	m.applyLimits()
+}
+
+// Limits returns the torrent's own limits, which apply on top of the
+// session's
+func (t *Torrent) Limits() Limits {
+	return Limits{Download: t.downloadLimiter.Rate(), Upload: t.uploadLimiter.Rate()}
+}
+
+// SetLimits changes the torrent's own limits, straight away if it is running
+func (t *Torrent) SetLimits(limits Limits) {
+	t.setLimits(limits)
+	t.changed()
+}
+
+func (t *Torrent) setLimits(limits Limits) {
+	t.downloadLimiter.SetRate(limits.Download)
+	t.uploadLimiter.SetRate(limits.Upload)
+}
@@ -0,0 +1,75 @@
+package session
+
+import (
+	"bit_torrent/handshake"
+	"errors"
+	"log"
+	"net"
+	"time"
+)
+
+// handshakeTimeout bounds how long an incoming peer has to send its handshake
+const handshakeTimeout = 10 * time.Second
+
+// Listen accepts incoming peer connections on addr in the background,
+// handing each to the running torrent its handshake asks for. Shutdown
+// closes the listener.
+func (m *Manager) Listen(addr string) error {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		l.Close()
+		return errors.New("session: shut down")
+	}
+	m.listener = l
+	m.mu.Unlock()
+
+	log.Printf("Accepting peers on %s\n", l.Addr())
+	go m.accept(l)
+	return nil
+}
+
+func (m *Manager) accept(l net.Listener) {
+	for {
+		conn, err := l.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			log.Printf("Failed to accept a peer: %v\n", err)
+			time.Sleep(time.Second)
+			continue
+		}
+		go m.handleIncoming(conn)
+	}
+}
+
+// handleIncoming reads the handshake of an incoming connection and passes
+// the connection to the torrent it names, closing it when that torrent is
+// unknown or not running
+func (m *Manager) handleIncoming(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	hs, err := handshake.Read(conn)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return
+	}
+	t, err := m.Get(hs.InfoHash)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	running := t.Running()
+	if running == nil {
+		conn.Close()
+		return
+	}
+	if err := running.Accept(conn, hs.PeerID); err != nil {
+		log.Printf("Refused peer %s for %s: %v\n", conn.RemoteAddr(), t.Name, err)
+	}
+}
@@ -0,0 +1,187 @@
+package session
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// QueueInterval is how often the queue looks for stalled downloads and the
+// speed schedule is checked
+const QueueInterval = 10 * time.Second
+
+// stateStalled is reported by activeState for downloads that are making no
+// progress. It is never a torrent's actual state.
+const stateStalled State = "stalled"
+
+// QueueMove reorders a torrent in the queue
+type QueueMove string
+
+// Queue moves, relative to the torrent's current position or to the ends of the queue
+const (
+	MoveUp     QueueMove = "up"
+	MoveDown   QueueMove = "down"
+	MoveTop    QueueMove = "top"
+	MoveBottom QueueMove = "bottom"
+)
+
+// ParseQueueMove validates a queue move
+func ParseQueueMove(s string) (QueueMove, error) {
+	switch move := QueueMove(s); move {
+	case MoveUp, MoveDown, MoveTop, MoveBottom:
+		return move, nil
+	}
+	return "", fmt.Errorf("invalid queue move %q", s)
+}
+
+// Move reorders a torrent in the queue. Running torrents keep running;
+// the order decides which queued torrents start first.
+func (m *Manager) Move(hash [20]byte, move QueueMove) error {
+	m.mu.Lock()
+	from := m.queueIndex(hash)
+	if from < 0 {
+		m.mu.Unlock()
+		return ErrNotFound
+	}
+	t := m.queue[from]
+	rest := append(m.queue[:from:from], m.queue[from+1:]...)
+
+	to := from
+	switch move {
+	case MoveUp:
+		if to > 0 {
+			to--
+		}
+	case MoveDown:
+		if to < len(rest) {
+			to++
+		}
+	case MoveTop:
+		to = 0
+	case MoveBottom:
+		to = len(rest)
+	}
+	m.queue = append(rest[:to:to], append([]*Torrent{t}, rest[to:]...)...)
+	m.mu.Unlock()
+
+	m.save()
+	m.schedule()
+	return nil
+}
+
+// QueuePosition returns where a torrent is in the queue, starting at 1
+func (m *Manager) QueuePosition(hash [20]byte) int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.queueIndex(hash) + 1
+}
+
+// Statuses returns the status of every torrent in queue order
+func (m *Manager) Statuses() []Status {
+	statuses := []Status{}
+	for i, t := range m.List() {
+		status := t.Status()
+		status.QueuePosition = i + 1
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// queueIndex must be called with m.mu held
+func (m *Manager) queueIndex(hash [20]byte) int {
+	for i, t := range m.queue {
+		if t.InfoHash == hash {
+			return i
+		}
+	}
+	return -1
+}
+
+// schedule starts queued torrents in queue order while there are free
+// download and seed slots. Queued torrents that already have every piece
+// take a seed slot. When there are more seeds than allowed, the last ones
+// in the queue go back to waiting.
+func (m *Manager) schedule() {
+	m.schedMu.Lock()
+	defer m.schedMu.Unlock()
+
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		return
+	}
+	queue := append([]*Torrent(nil), m.queue...)
+	m.mu.Unlock()
+
+	downloads, seeds := 0, 0
+	for _, t := range queue {
+		switch state := t.activeState(m.cfg.StallTimeout); {
+		// A complete torrent being checked is about to seed
+		case state == StateSeeding, state == StateChecking && t.complete():
+			seeds++
+		case state == StateChecking, state == StateDownloading:
+			downloads++
+		}
+	}
+
+	for i := len(queue) - 1; i >= 0 && overLimit(seeds, m.cfg.MaxActiveSeeds); i-- {
+		t := queue[i]
+		t.mu.Lock()
+		if t.state == StateSeeding && t.setState(StateQueued, nil) == nil {
+			seeds--
+			if t.running != nil {
+				t.running.Stop()
+			}
+		}
+		t.mu.Unlock()
+	}
+
+	for _, t := range queue {
+		if state, _ := t.State(); state != StateQueued {
+			continue
+		}
+
+		if t.complete() {
+			if !underLimit(seeds, m.cfg.MaxActiveSeeds) {
+				continue
+			}
+			seeds++
+		} else {
+			if !underLimit(downloads, m.cfg.MaxActiveDownloads) {
+				continue
+			}
+			downloads++
+		}
+		if err := m.launch(t); err != nil && !errors.Is(err, errStopping) {
+			log.Printf("Failed to start %s: %v\n", t.Name, err)
+		}
+	}
+}
+
+func underLimit(n, max int) bool {
+	return max <= 0 || n < max
+}
+
+func overLimit(n, max int) bool {
+	return max > 0 && n > max
+}
+
+// complete reports whether the torrent had every wanted piece when it last
+// reported progress
+func (t *Torrent) complete() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.progress.Progress >= 100
+}
+
+// activeState returns the torrent's state, reporting downloads that have
+// not finished a piece within stallTimeout as stalled so they free their slot
+func (t *Torrent) activeState(stallTimeout time.Duration) State {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.state == StateDownloading && stallTimeout > 0 && time.Since(t.lastActive) > stallTimeout {
+		return stateStalled
+	}
+	return t.state
+}
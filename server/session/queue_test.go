@@ -0,0 +1,49 @@
+package session
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestScheduleLimits(t *testing.T) {
+	root, tracker := t.TempDir(), newTracker(t)
+	m := New(Config{OutputDir: filepath.Join(root, "output"), MaxActiveDownloads: 1, MaxActiveSeeds: 1})
+	defer m.Shutdown()
+
+	download1 := startTorrent(t, m, root, tracker, "a", false)
+	download2 := startTorrent(t, m, root, tracker, "b", false)
+	seed1 := startTorrent(t, m, root, tracker, "c", true)
+	seed2 := startTorrent(t, m, root, tracker, "d", true)
+	waitState(t, download1, StateDownloading)
+	waitState(t, seed1, StateSeeding)
+	for _, tor := range []*Torrent{download2, seed2} {
+		if state, _ := tor.State(); state != StateQueued {
+			t.Errorf("%s is %s with every slot taken, want queued", tor.Name, state)
+		}
+	}
+
+	// Pausing frees a slot for the next torrent of the same kind
+	if err := m.Pause(download1.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, download2, StateDownloading)
+	if err := m.Pause(seed1.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, seed2, StateSeeding)
+
+	// Starting again waits for a slot even at the top of the queue
+	if err := m.Start(seed1.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Move(seed1.InfoHash, MoveTop); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := seed1.State(); state != StateQueued {
+		t.Errorf("%s is %s, want queued behind the running seed", seed1.Name, state)
+	}
+	if err := m.Remove(seed2.InfoHash, false); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, seed1, StateSeeding)
+}
@@ -0,0 +1,822 @@
+package session
+
+import (
+	"bit_torrent/p2p"
+	"bit_torrent/ratelimit"
+	"bit_torrent/storage"
+	"bit_torrent/torrent"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ResumeFileName is the fast-resume file kept next to each .torrent file
+const ResumeFileName = "torrent.resume"
+
+var (
+	// ErrNotFound is returned when no torrent matches a hash or name
+	ErrNotFound = errors.New("session: torrent not found")
+	// ErrExists is returned when adding a torrent the session already has
+	ErrExists = errors.New("session: torrent already added")
+	// ErrOutsideOutputDir is returned when refusing to delete data that is
+	// not inside the output directory
+	ErrOutsideOutputDir = errors.New("session: path is outside the output directory")
+	// ErrInvalidOptions is returned when adding a torrent with options
+	// that do not fit it
+	ErrInvalidOptions = errors.New("session: invalid add options")
+	// ErrDirNotAllowed is returned for data directories that are relative
+	// or outside every directory the session may keep data in
+	ErrDirNotAllowed = errors.New("session: directory not allowed")
+)
+
+// Config holds the directories and callbacks the session works with
+type Config struct {
+	OutputDir string
+	// StatePath is the file the torrent list is kept in across restarts,
+	// empty to not keep it
+	StatePath string
+	// Progress receives every progress update of every torrent
+	Progress func(t *Torrent, progress p2p.ProgressData)
+	// Recheck receives the progress of data checks
+	Recheck func(t *Torrent, progress p2p.RecheckProgress)
+	// Events receives torrents being added, completing and failing
+	Events func(t *Torrent, event Event)
+
+	// MaxActiveDownloads and MaxActiveSeeds bound how many torrents run at
+	// once, the rest wait in the queue. 0 means no limit.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	// StallTimeout is how long a download may go without finishing a piece
+	// before it stops counting against MaxActiveDownloads, 0 to never
+	StallTimeout time.Duration
+
+	// Limits caps the traffic of all torrents together, replaced by
+	// AltLimits during the windows of AltSchedule
+	Limits      Limits
+	AltLimits   Limits
+	AltSchedule []Window
+
+	// SeedGoals ends seeding for torrents without goals of their own
+	SeedGoals SeedGoals
+	// Dirs are the data directories of torrents without their own
+	Dirs Dirs
+	// DataDirs are the directories, besides OutputDir and Dirs, torrents
+	// may keep data in. Directories given for a single torrent must be
+	// absolute and inside one of them.
+	DataDirs []string
+}
+
+// Manager owns every torrent of the session and their lifecycle. It knows
+// nothing about HTTP; the API layer calls into it.
+type Manager struct {
+	cfg Config
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*Torrent
+	queue    []*Torrent // Every torrent, in the order they are started
+	closed   bool       // Set by Shutdown, nothing starts afterwards
+	quit     chan struct{}
+	listener net.Listener   // Incoming peer connections, see Listen
+	wg       sync.WaitGroup // Running downloads and checks
+	saveMu   sync.Mutex     // Serializes writes of the session file
+	schedMu  sync.Mutex     // Serializes runs of the scheduler
+
+	speedMu         sync.Mutex // Guards the limits and speed mode below
+	limits          Limits
+	altLimits       Limits
+	altSchedule     []Window
+	override        SpeedMode
+	appliedMode     SpeedMode
+	downloadLimiter *ratelimit.Limiter
+	uploadLimiter   *ratelimit.Limiter
+
+	goalsMu   sync.Mutex // Guards seedGoals
+	seedGoals SeedGoals
+
+	labelsMu   sync.Mutex // Guards categories
+	categories map[string]Category
+}
+
+// New returns an empty session
+func New(cfg Config) *Manager {
+	m := &Manager{
+		cfg:      cfg,
+		torrents: make(map[[20]byte]*Torrent),
+		quit:     make(chan struct{}),
+
+		limits:          cfg.Limits,
+		altLimits:       cfg.AltLimits,
+		altSchedule:     cfg.AltSchedule,
+		override:        SpeedAuto,
+		appliedMode:     SpeedNormal,
+		downloadLimiter: ratelimit.New(0),
+		uploadLimiter:   ratelimit.New(0),
+		seedGoals:       cfg.SeedGoals,
+		categories:      make(map[string]Category),
+	}
+	m.followSchedule()
+	go m.watch()
+	return m
+}
+
+// ParseHash parses a hex encoded infohash
+func ParseHash(s string) ([20]byte, error) {
+	var hash [20]byte
+	b, err := hex.DecodeString(s)
+	if err != nil || len(b) != len(hash) {
+		return hash, fmt.Errorf("invalid infohash %q", s)
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// AddOptions are the settings of a torrent being added
+type AddOptions struct {
+	Storage storage.Options
+	// SaveDir is the directory the data ends up in. It becomes the
+	// torrent's complete directory, and the data downloads straight into
+	// it unless the session has an incomplete directory.
+	SaveDir string
+	// Category is created if the session does not have it yet. Its save
+	// directory is used when SaveDir is empty.
+	Category string
+	Tags     []string
+
+	// Priorities of the torrent's files by index, all normal when nil
+	Priorities []p2p.Priority
+	Limits     Limits
+	Sequential bool
+	// SkipHashCheck trusts the data already in the save directory to be
+	// complete instead of checking it. Every file must be there at its
+	// full size.
+	SkipHashCheck bool
+	// Start queues the torrent once it is added instead of leaving it paused
+	Start bool
+}
+
+// check validates the options against the torrent they are for
+func (opts AddOptions) check(meta torrent.TorrentFile) error {
+	if opts.Priorities != nil {
+		numFiles := len(meta.StorageInfo().Files)
+		if len(opts.Priorities) != numFiles {
+			return fmt.Errorf("%w: %d file priorities given for %d files", ErrInvalidOptions, len(opts.Priorities), numFiles)
+		}
+		for i, priority := range opts.Priorities {
+			if priority < p2p.PrioritySkip || priority > p2p.PriorityHigh {
+				return fmt.Errorf("%w: invalid priority %s of file %d", ErrInvalidOptions, priority, i)
+			}
+		}
+	}
+	if opts.Limits.Download < 0 || opts.Limits.Upload < 0 {
+		return fmt.Errorf("%w: rate limits must not be negative", ErrInvalidOptions)
+	}
+	if opts.SkipHashCheck && opts.Storage.Kind == storage.KindMemory {
+		return fmt.Errorf("%w: data kept in memory cannot skip the hash check", ErrInvalidOptions)
+	}
+	return nil
+}
+
+// Add registers the .torrent file at torrentPath under name, paused unless
+// opts.Start is set. Its data is saved under the download directory, or
+// opts.SaveDir or its category's save directory, and its resume data next
+// to the .torrent file.
+func (m *Manager) Add(torrentPath string, name string, opts AddOptions) (*Torrent, error) {
+	t, err := m.add(torrentPath, name, opts)
+	if err != nil {
+		return nil, err
+	}
+	m.save()
+	m.emit(t, EventAdded)
+	if opts.Start {
+		if err := m.Start(t.InfoHash); err != nil {
+			return t, err
+		}
+	}
+	return t, nil
+}
+
+func (m *Manager) add(torrentPath string, name string, opts AddOptions) (*Torrent, error) {
+	tags, err := ParseTags(opts.Tags)
+	if err != nil {
+		return nil, err
+	}
+	if err := m.useCategory(opts.Category); err != nil {
+		return nil, err
+	}
+	meta, err := torrent.Open(torrentPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := opts.check(meta); err != nil {
+		return nil, err
+	}
+	if opts.SaveDir != "" {
+		if err := m.checkDir(opts.SaveDir); err != nil {
+			return nil, err
+		}
+	}
+	saveDir := opts.SaveDir
+	if saveDir == "" {
+		saveDir = m.categoryPath(opts.Category)
+	}
+	downloadDir := m.downloadDir()
+	// Complete data is already where it ends up
+	if saveDir != "" && (m.cfg.Dirs.Incomplete == "" || opts.SkipHashCheck) {
+		downloadDir = saveDir
+	}
+
+	t := &Torrent{
+		InfoHash:    meta.InfoHash,
+		Name:        name,
+		Meta:        meta,
+		TorrentPath: torrentPath,
+		ResumePath:  filepath.Join(filepath.Dir(torrentPath), ResumeFileName),
+		Storage:     opts.Storage,
+		savePath:    filepath.Join(downloadDir, name),
+		dirs:        Dirs{Complete: opts.SaveDir},
+		category:    opts.Category,
+		tags:        tags,
+		priorities:  append([]p2p.Priority(nil), opts.Priorities...),
+		sequential:  opts.Sequential,
+		state:       StatePaused,
+		userPaused:  true,
+		changed:     m.save,
+
+		downloadLimiter: ratelimit.New(opts.Limits.Download),
+		uploadLimiter:   ratelimit.New(opts.Limits.Upload),
+	}
+	if opts.SkipHashCheck {
+		// Refuse before overwriting the resume data of a torrent already added
+		if _, err := m.Get(t.InfoHash); err == nil {
+			return nil, ErrExists
+		}
+		if err := meta.MarkComplete(t.savePath, t.ResumePath); err != nil {
+			return nil, fmt.Errorf("%w: cannot skip the hash check: %v", ErrInvalidOptions, err)
+		}
+	}
+	t.loadProgress()
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.torrents[t.InfoHash]; ok {
+		return nil, ErrExists
+	}
+	m.torrents[t.InfoHash] = t
+	m.queue = append(m.queue, t)
+	return t, nil
+}
+
+// Get returns the torrent with the given infohash
+func (m *Manager) Get(hash [20]byte) (*Torrent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	t, ok := m.torrents[hash]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return t, nil
+}
+
+// FindByName returns the torrent added under name
+func (m *Manager) FindByName(name string) (*Torrent, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, t := range m.torrents {
+		if t.Name == name {
+			return t, nil
+		}
+	}
+	return nil, ErrNotFound
+}
+
+// List returns every torrent of the session in queue order
+func (m *Manager) List() []*Torrent {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]*Torrent(nil), m.queue...)
+}
+
+// Start queues a paused, errored or seeding torrent to be checked and
+// downloaded in the background as soon as there is a free slot
+func (m *Manager) Start(hash [20]byte) error {
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+	if err := t.enqueue(); err != nil {
+		return err
+	}
+	m.save()
+	m.schedule()
+	return nil
+}
+
+func (t *Torrent) enqueue() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if err := t.setState(StateQueued, nil); err != nil {
+		return err
+	}
+	t.userPaused = false
+	t.goalReached = ""
+	return nil
+}
+
+// errStopping is returned by launch while the torrent's previous run has
+// not ended yet. The end of that run schedules it again.
+var errStopping = errors.New("session: torrent is still stopping")
+
+// launch starts a queued torrent
+func (m *Manager) launch(t *Torrent) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.done != nil {
+		select {
+		case <-t.done:
+		default:
+			return errStopping
+		}
+	}
+	if err := t.setState(StateChecking, nil); err != nil {
+		return err
+	}
+	t.lastActive = time.Now()
+	t.done = make(chan struct{})
+	m.wg.Add(1)
+	go m.run(t, t.done)
+	return nil
+}
+
+// Pause stops a checking or downloading torrent from requesting pieces.
+// A download keeps its peer connections so Resume carries on straight away;
+// a check finishes and the torrent then stays paused. A seeding torrent is
+// stopped. Pausing a paused torrent does nothing.
+func (m *Manager) Pause(hash [20]byte) error {
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+	if err := t.pause(); err != nil {
+		return err
+	}
+	m.save()
+	m.schedule()
+	return nil
+}
+
+func (t *Torrent) pause() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch t.state {
+	case StatePaused:
+	case StateQueued:
+		if err := t.setState(StatePaused, nil); err != nil {
+			return err
+		}
+	case StateChecking:
+		if t.running != nil {
+			t.running.Pause()
+		}
+	case StateDownloading:
+		t.running.Pause()
+		if err := t.setState(StatePaused, nil); err != nil {
+			return err
+		}
+	case StateSeeding:
+		if t.running != nil {
+			t.running.Stop()
+		}
+		if err := t.setState(StatePaused, nil); err != nil {
+			return err
+		}
+	default:
+		return &TransitionError{From: t.state, To: StatePaused}
+	}
+	t.userPaused = true
+	return nil
+}
+
+// Resume continues a paused torrent, in place when its download is still
+// running and by starting it again otherwise
+func (m *Manager) Resume(hash [20]byte) error {
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	if t.running != nil && t.running.IsStopped() {
+		// A paused seed that is still disconnecting starts again once it has
+		done := t.done
+		t.mu.Unlock()
+		<-done
+		t.mu.Lock()
+	}
+	if t.running == nil {
+		t.mu.Unlock()
+		return m.Start(hash)
+	}
+	t.userPaused = false
+	if t.running.IsPaused() {
+		t.running.Resume()
+		if t.state == StatePaused {
+			err = t.setState(StateDownloading, nil)
+		}
+	}
+	t.mu.Unlock()
+	m.save()
+	return err
+}
+
+// Stop disconnects a running torrent from its peers and waits until it
+// has saved its data
+func (m *Manager) Stop(hash [20]byte) error {
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+	t.stop()
+	return nil
+}
+
+// Remove stops a torrent, forgets about it and deletes its .torrent and
+// resume files. With deleteData its downloaded data is deleted as well,
+// provided it lies inside the output directory.
+func (m *Manager) Remove(hash [20]byte, deleteData bool) error {
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+	if deleteData {
+		if err := m.checkDataPath(t, t.SavePath()); err != nil {
+			return err
+		}
+	}
+
+	// Forget the torrent first so it cannot be started again meanwhile
+	m.mu.Lock()
+	delete(m.torrents, hash)
+	for i, queued := range m.queue {
+		if queued == t {
+			m.queue = append(m.queue[:i:i], m.queue[i+1:]...)
+			break
+		}
+	}
+	m.mu.Unlock()
+	m.save()
+	t.stop()
+	m.schedule()
+
+	for _, path := range []string{t.TorrentPath, t.ResumePath} {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	// The folder holding them goes too unless something else lives there
+	os.Remove(filepath.Dir(t.TorrentPath))
+
+	if deleteData {
+		savePath := t.SavePath()
+		log.Printf("Deleting data of %s in %s\n", t.Name, savePath)
+		return os.RemoveAll(savePath)
+	}
+	return nil
+}
+
+// Recheck verifies a stopped torrent's data against its piece hashes in the
+// background, rebuilding its resume data
+func (m *Manager) Recheck(hash [20]byte) error {
+	t, err := m.Get(hash)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	state, running := t.state, t.running != nil
+	t.mu.Unlock()
+	if state == StateChecking || state == StateDownloading {
+		return &TransitionError{From: state, To: StateChecking}
+	}
+	// A torrent paused in place still has its files open and unflushed
+	// pieces in its cache, stop it before its data is read back
+	if running {
+		t.stop()
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.running != nil || t.state == StateChecking || t.state == StateDownloading {
+		return &TransitionError{From: t.state, To: StateChecking}
+	}
+	if err := t.setState(StateChecking, nil); err != nil {
+		return err
+	}
+	t.done = make(chan struct{})
+	m.wg.Add(1)
+	go m.recheck(t, t.done)
+	return nil
+}
+
+// Shutdown stops every running torrent and waits for them to flush their
+// data and resume files
+func (m *Manager) Shutdown() {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.quit)
+		if m.listener != nil {
+			m.listener.Close()
+		}
+	}
+	m.mu.Unlock()
+
+	for _, t := range m.List() {
+		t.mu.Lock()
+		if t.running != nil {
+			t.running.Stop()
+		}
+		t.mu.Unlock()
+	}
+	m.wg.Wait()
+	m.save() // Keep the seeding times
+}
+
+// run downloads and then seeds a torrent until it is paused, stopped or
+// fails. A torrent whose data moves to its complete directory stops when
+// it completes instead, and is queued again to seed from there.
+func (m *Manager) run(t *Torrent, done chan struct{}) {
+	defer m.wg.Done()
+	defer m.schedule() // A download or seed slot may have freed up
+	defer close(done)
+
+	err := m.download(t)
+
+	t.mu.Lock()
+	t.running = nil
+	announced := t.announced
+	t.announced = nil
+	state := t.state
+	t.mu.Unlock()
+
+	// Let the tracker know we have left the swarm
+	if announced != nil {
+		uploaded, downloaded, left := announced.Totals()
+		if err := t.Meta.AnnounceStopped(announced.PeerID, uploaded, downloaded, left); err != nil {
+			log.Printf("Failed to announce stopped for %s: %v\n", t.Name, err)
+		}
+	}
+
+	switch {
+	case err == nil || errors.Is(err, p2p.ErrAlreadyDownloaded):
+		moveErr := m.moveToComplete(t)
+		if err == nil {
+			m.emit(t, EventCompleted)
+		}
+		switch {
+		case moveErr != nil:
+			m.fail(t, moveErr)
+		// A torrent paused while its last pieces were finishing stays
+		// paused, resuming it starts seeding
+		case state != StatePaused:
+			t.moveTo(StateSeeding, nil)
+			t.moveTo(StateQueued, nil)
+		}
+	case errors.Is(err, p2p.ErrPaused), errors.Is(err, p2p.ErrStopped):
+		// Seeds the queue sent back to waiting keep their place
+		if state != StateQueued {
+			t.moveTo(StatePaused, nil)
+		}
+	default:
+		m.fail(t, err)
+	}
+}
+
+// fail moves a torrent whose run ended with err to errored
+func (m *Manager) fail(t *Torrent, err error) {
+	log.Printf("Torrent %s failed: %v\n", t.Name, err)
+	t.moveTo(StateErrored, err)
+	m.reportProgress(t, t.Progress())
+	m.emit(t, EventErrored)
+}
+
+func (m *Manager) download(t *Torrent) error {
+	running, err := t.Meta.NewTorrent(t.SavePath(), t.Storage)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Streams still waiting for pieces give up, even when the run ends
+		// before the download starts
+		running.Stop()
+		running.Storage.Close()
+	}()
+	stopWhenComplete := m.movesWhenComplete(t)
+
+	t.mu.Lock()
+	// A copy, later changes reach it through SetFilePriority
+	running.FilePriorities = append([]p2p.Priority(nil), t.priorities...)
+	running.Sequential = t.sequential
+	running.StopWhenComplete = stopWhenComplete
+	running.DownloadLimiters = []*ratelimit.Limiter{t.downloadLimiter, m.downloadLimiter}
+	running.UploadLimiters = []*ratelimit.Limiter{t.uploadLimiter, m.uploadLimiter}
+	t.running = running
+	// Pausing while checking before the download existed only took note
+	if t.userPaused {
+		running.Pause()
+	}
+	// Shutdown may have gone past this torrent before the download existed
+	select {
+	case <-m.quit:
+		running.Stop()
+	default:
+	}
+	t.mu.Unlock()
+
+	// Restore progress from the resume data, rechecking if it is stale
+	recheckChan := make(chan p2p.RecheckProgress)
+	go m.forwardRecheck(t, recheckChan)
+	err = torrent.LoadResumeData(running, t.ResumePath, recheckChan)
+	close(recheckChan)
+	if err != nil {
+		return err
+	}
+	if running.IsPaused() {
+		return p2p.ErrPaused
+	}
+
+	// Fail early if the data cannot fit on disk. Allocating only once the
+	// resume data is loaded keeps new files from triggering a recheck.
+	if t.Storage.Kind != storage.KindMemory {
+		priorities := running.Priorities()
+		skip := make([]bool, len(priorities))
+		for i, priority := range priorities {
+			skip[i] = priority == p2p.PrioritySkip
+		}
+		if err := storage.Prepare(t.SavePath(), t.Meta.StorageInfo(), t.Storage.Allocation, skip); err != nil {
+			return err
+		}
+	}
+
+	_, err = rand.Read(running.PeerID[:])
+	if err != nil {
+		return err
+	}
+	uploaded, downloaded, left := running.Totals()
+	running.Peers, err = t.Meta.RequestPeers(running.PeerID, uploaded, downloaded, left)
+	if err != nil {
+		return err
+	}
+	t.mu.Lock()
+	t.announced = running
+	t.mu.Unlock()
+
+	// The torrent may have been paused while connecting to the tracker.
+	// One with nothing left to download seeds straight away.
+	t.mu.Lock()
+	next := StateDownloading
+	if running.IsPaused() {
+		next = StatePaused
+	} else if running.Complete() && !running.StopWhenComplete {
+		next = StateSeeding
+	}
+	if err := t.setState(next, nil); err != nil {
+		t.mu.Unlock()
+		return err
+	}
+	t.mu.Unlock()
+
+	progressChan := make(chan p2p.ProgressData)
+	forwarded := make(chan struct{})
+	go func() {
+		for progress := range progressChan {
+			t.setProgress(progress)
+			if t.followSeeding(progress.Seeding) {
+				m.emit(t, EventCompleted)
+			}
+			m.reportProgress(t, progress)
+		}
+		close(forwarded)
+	}()
+	err = running.Download(progressChan, t.ResumePath)
+	close(progressChan)
+	<-forwarded
+	return err
+}
+
+// followSeeding moves a running torrent between downloading and seeding as
+// its download reports, returning true when it has just completed
+func (t *Torrent) followSeeding(seeding bool) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	switch {
+	case seeding && t.state == StateDownloading:
+		return t.setState(StateSeeding, nil) == nil
+	case !seeding && t.state == StateSeeding:
+		t.setState(StateDownloading, nil)
+	}
+	return false
+}
+
+// recheck verifies a torrent's data outside of a download
+func (m *Manager) recheck(t *Torrent, done chan struct{}) {
+	defer m.wg.Done()
+	defer close(done)
+
+	err := m.checkData(t)
+	if err != nil {
+		log.Printf("Torrent recheck failed for %s: %v\n", t.Name, err)
+		t.moveTo(StateErrored, err)
+		m.emit(t, EventErrored)
+		return
+	}
+	t.loadProgress()
+	t.moveTo(StatePaused, nil)
+}
+
+func (m *Manager) checkData(t *Torrent) error {
+	running, err := t.Meta.NewTorrent(t.SavePath(), storage.Options{Kind: t.Storage.Kind})
+	if err != nil {
+		return err
+	}
+	defer running.Storage.Close()
+
+	// Carry the transfer totals over from any previous resume data
+	torrent.LoadTotals(running, t.ResumePath)
+
+	recheckChan := make(chan p2p.RecheckProgress)
+	go m.forwardRecheck(t, recheckChan)
+	defer close(recheckChan)
+	return running.Recheck(recheckChan, t.ResumePath)
+}
+
+func (m *Manager) forwardRecheck(t *Torrent, recheckChan <-chan p2p.RecheckProgress) {
+	for progress := range recheckChan {
+		if m.cfg.Recheck != nil {
+			m.cfg.Recheck(t, progress)
+		}
+	}
+}
+
+func (m *Manager) reportProgress(t *Torrent, progress p2p.ProgressData) {
+	if m.cfg.Progress != nil {
+		m.cfg.Progress(t, progress)
+	}
+}
+
+// insideDir checks that path lies strictly inside dir once symlinks in
+// both are resolved, so deleting path cannot reach anything else
+func insideDir(dir, path string) error {
+	if dir == "" {
+		return fmt.Errorf("%w: no output directory", ErrOutsideOutputDir)
+	}
+	root, err := filepath.EvalSymlinks(dir)
+	if err != nil {
+		return err
+	}
+	root, err = filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	parent, err := filepath.EvalSymlinks(filepath.Dir(path))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil // Nothing was ever downloaded
+	}
+	if err != nil {
+		return err
+	}
+	parent, err = filepath.Abs(parent)
+	if err != nil {
+		return err
+	}
+
+	rel, err := filepath.Rel(root, filepath.Join(parent, filepath.Base(path)))
+	if err != nil || rel == "." || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("%w: %s", ErrOutsideOutputDir, path)
+	}
+	return nil
+}
+
+// watch periodically reschedules so stalled downloads let queued torrents
+// start, and switches the speed limits when the schedule says so
+func (m *Manager) watch() {
+	ticker := time.NewTicker(QueueInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+			m.schedule()
+			m.followSchedule()
+			m.checkSeedGoals()
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package session
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+// writeTorrent writes a single file .torrent for data named name into dir,
+// announcing to announce
+func writeTorrent(t *testing.T, dir, name, announce string, data []byte) string {
+	t.Helper()
+	const pieceLength = 16384
+	var pieces []byte
+	for begin := 0; begin < len(data); begin += pieceLength {
+		hash := sha1.Sum(data[begin:min(begin+pieceLength, len(data))])
+		pieces = append(pieces, hash[:]...)
+	}
+	type info struct {
+		Pieces      string `bencode:"pieces"`
+		PieceLength int    `bencode:"piece length"`
+		Length      int    `bencode:"length"`
+		Name        string `bencode:"name"`
+	}
+	meta := struct {
+		Announce string `bencode:"announce"`
+		Info     info   `bencode:"info"`
+	}{announce, info{string(pieces), pieceLength, len(data), name}}
+
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, name+".torrent")
+	file, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if err := bencode.Marshal(file, meta); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTracker returns the announce URL of a tracker that knows no peers, so
+// started downloads stay downloading until they are stopped
+func newTracker(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali900e5:peers0:e"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL + "/announce"
+}
+
+// startTorrent adds a torrent named name to m and starts it. A complete
+// torrent has its data in the output directory already.
+func startTorrent(t *testing.T, m *Manager, root, announce, name string, complete bool) *Torrent {
+	t.Helper()
+	data := make([]byte, 40000)
+	for i := range data {
+		data[i] = name[i%len(name)] + byte(i)
+	}
+	path := writeTorrent(t, filepath.Join(root, "uploads", name), name, announce, data)
+	if complete {
+		if err := os.MkdirAll(m.cfg.OutputDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(m.cfg.OutputDir, name), data, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tor, err := m.Add(path, name, AddOptions{Start: true, SkipHashCheck: complete})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tor
+}
+
+// waitFor waits until cond holds, failing with what after a while
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+	}
+}
+
+// waitState waits until tor is in state want
+func waitState(t *testing.T, tor *Torrent, want State) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%s to be %s", tor.Name, want), func() bool {
+		state, _ := tor.State()
+		return state == want
+	})
+}
+
+func TestPauseResume(t *testing.T) {
+	root, tracker := t.TempDir(), newTracker(t)
+	m := New(Config{OutputDir: filepath.Join(root, "output")})
+	defer m.Shutdown()
+
+	// A download pauses in place and carries on when resumed
+	download := startTorrent(t, m, root, tracker, "a", false)
+	waitState(t, download, StateDownloading)
+	running := download.Running()
+	if err := m.Pause(download.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := download.State(); state != StatePaused {
+		t.Errorf("state after Pause() = %s, want paused", state)
+	}
+	if download.Running() != running || !running.IsPaused() {
+		t.Error("Pause() did not pause the download in place")
+	}
+	if err := m.Pause(download.InfoHash); err != nil {
+		t.Errorf("pausing again: %v", err)
+	}
+	if err := m.Resume(download.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if state, _ := download.State(); state != StateDownloading {
+		t.Errorf("state after Resume() = %s, want downloading", state)
+	}
+	if download.Running() != running || running.IsPaused() {
+		t.Error("Resume() did not carry on with the paused download")
+	}
+
+	// A seed stops and starts again when resumed
+	seed := startTorrent(t, m, root, tracker, "b", true)
+	waitState(t, seed, StateSeeding)
+	if err := m.Pause(seed.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "the seed to stop", func() bool { return seed.Running() == nil })
+	if state, _ := seed.State(); state != StatePaused {
+		t.Errorf("seed state after Pause() = %s, want paused", state)
+	}
+	if err := m.Resume(seed.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	waitState(t, seed, StateSeeding)
+	if seed.Running() == nil {
+		t.Error("resumed seed is not running")
+	}
+}
+
+func TestPauseBeforeCheckStarts(t *testing.T) {
+	root, tracker := t.TempDir(), newTracker(t)
+	m := New(Config{OutputDir: filepath.Join(root, "output")})
+	defer m.Shutdown()
+	path := writeTorrent(t, filepath.Join(root, "uploads", "a"), "a", tracker, make([]byte, 40000))
+	tor, err := m.Add(path, "a", AddOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Paused between being launched and its download being set up
+	if err := tor.enqueue(); err != nil {
+		t.Fatal(err)
+	}
+	tor.moveTo(StateChecking, nil)
+	if err := tor.pause(); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.launch(tor); err != nil {
+		t.Fatal(err)
+	}
+	tor.mu.Lock()
+	done := tor.done
+	tor.mu.Unlock()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the run did not end")
+	}
+	if state, _ := tor.State(); state != StatePaused {
+		t.Errorf("state = %s, want paused", state)
+	}
+}
+
+func TestRemove(t *testing.T) {
+	tests := []struct {
+		name       string
+		deleteData bool
+	}{
+		{"keeping data", false},
+		{"deleting data", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			root, tracker := t.TempDir(), newTracker(t)
+			m := New(Config{OutputDir: filepath.Join(root, "output")})
+			defer m.Shutdown()
+			tor := startTorrent(t, m, root, tracker, "a", true)
+			waitState(t, tor, StateSeeding)
+
+			if err := m.Remove(tor.InfoHash, tt.deleteData); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := m.Get(tor.InfoHash); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get() after Remove() error = %v, want ErrNotFound", err)
+			}
+			if len(m.List()) != 0 {
+				t.Errorf("List() = %v, want it empty", m.List())
+			}
+			if tor.Running() != nil {
+				t.Error("removed torrent is still running")
+			}
+			if _, err := os.Stat(filepath.Dir(tor.TorrentPath)); !os.IsNotExist(err) {
+				t.Errorf("torrent folder was not deleted: %v", err)
+			}
+			_, err := os.Stat(tor.SavePath())
+			if tt.deleteData && !os.IsNotExist(err) {
+				t.Errorf("data was not deleted: %v", err)
+			}
+			if !tt.deleteData && err != nil {
+				t.Errorf("data was not kept: %v", err)
+			}
+			if err := m.Remove(tor.InfoHash, tt.deleteData); !errors.Is(err, ErrNotFound) {
+				t.Errorf("removing again error = %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
+
+func TestInsideDir(t *testing.T) {
+	root := t.TempDir()
+	output := filepath.Join(root, "output")
+	other := filepath.Join(root, "other")
+	for _, dir := range []string{filepath.Join(output, "sub"), other} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// A link out of the output directory, and one to it
+	if err := os.Symlink(other, filepath.Join(output, "escape")); err != nil {
+		t.Skipf("cannot create symlinks: %v", err)
+	}
+	if err := os.Symlink(output, filepath.Join(root, "linked")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		dir  string
+		path string
+		err  error
+	}{
+		{"inside", output, filepath.Join(output, "a"), nil},
+		{"nested", output, filepath.Join(output, "sub", "a"), nil},
+		{"never downloaded", output, filepath.Join(output, "missing", "a"), nil},
+		{"the directory itself", output, output, ErrOutsideOutputDir},
+		{"its parent", output, root, ErrOutsideOutputDir},
+		{"a sibling", output, filepath.Join(other, "a"), ErrOutsideOutputDir},
+		{"dot dot", output, filepath.Join(output, "..", "other", "a"), ErrOutsideOutputDir},
+		{"through a symlink", output, filepath.Join(output, "escape", "a"), ErrOutsideOutputDir},
+		{"the symlink itself", output, filepath.Join(output, "escape"), nil},
+		{"symlinked directory", filepath.Join(root, "linked"), filepath.Join(output, "a"), nil},
+		{"no directory", "", filepath.Join(output, "a"), ErrOutsideOutputDir},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := insideDir(tt.dir, tt.path); !errors.Is(err, tt.err) {
+				t.Errorf("insideDir(%q, %q) = %v, want %v", tt.dir, tt.path, err, tt.err)
+			}
+		})
+	}
+}
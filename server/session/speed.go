@@ -0,0 +1,240 @@
+package session
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// SpeedMode selects between the normal and the alternative session limits
+type SpeedMode string
+
+const (
+	SpeedNormal      SpeedMode = "normal"
+	SpeedAlternative SpeedMode = "alternative"
+	// SpeedAuto is only used as an override, following the schedule
+	SpeedAuto SpeedMode = "auto"
+)
+
+// ParseSpeedMode validates a speed mode override
+func ParseSpeedMode(s string) (SpeedMode, error) {
+	switch mode := SpeedMode(s); mode {
+	case SpeedNormal, SpeedAlternative, SpeedAuto:
+		return mode, nil
+	}
+	return "", fmt.Errorf("invalid speed mode %q", s)
+}
+
+var weekdays = []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"}
+
+// Window is a time of day range on some days of the week. A window
+// ending before it starts runs past midnight into the next day.
+type Window struct {
+	Days  [7]bool       // Indexed by time.Weekday
+	Start time.Duration // Since midnight
+	End   time.Duration
+}
+
+// ParseSchedule parses windows separated by semicolons, each made of days
+// and a time range such as "mon-fri 09:00-18:00; sat,sun 10:00-12:00".
+// Days may be "*" for every day.
+func ParseSchedule(s string) ([]Window, error) {
+	var windows []Window
+	for _, part := range strings.Split(s, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		w, err := parseWindow(part)
+		if err != nil {
+			return nil, err
+		}
+		windows = append(windows, w)
+	}
+	return windows, nil
+}
+
+func parseWindow(s string) (Window, error) {
+	var w Window
+	fields := strings.Fields(s)
+	if len(fields) != 2 {
+		return w, fmt.Errorf("invalid schedule window %q, expected days and a time range", s)
+	}
+
+	for _, days := range strings.Split(fields[0], ",") {
+		if days == "*" {
+			w.Days = [7]bool{true, true, true, true, true, true, true}
+			continue
+		}
+		first, last, isRange := strings.Cut(days, "-")
+		from, err := parseWeekday(first)
+		if err != nil {
+			return w, err
+		}
+		to := from
+		if isRange {
+			if to, err = parseWeekday(last); err != nil {
+				return w, err
+			}
+		}
+		for d := from; ; d = (d + 1) % 7 {
+			w.Days[d] = true
+			if d == to {
+				break
+			}
+		}
+	}
+
+	start, end, ok := strings.Cut(fields[1], "-")
+	if !ok {
+		return w, fmt.Errorf("invalid time range %q", fields[1])
+	}
+	var err error
+	if w.Start, err = parseClock(start); err != nil {
+		return w, err
+	}
+	if w.End, err = parseClock(end); err != nil {
+		return w, err
+	}
+	if w.Start == w.End {
+		return w, fmt.Errorf("empty time range %q", fields[1])
+	}
+	return w, nil
+}
+
+func parseWeekday(s string) (time.Weekday, error) {
+	for i, day := range weekdays {
+		if strings.EqualFold(s, day) {
+			return time.Weekday(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid weekday %q", s)
+}
+
+// parseClock parses a time of day as HH:MM
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
+
+// Contains reports whether now falls inside the window, in now's location
+func (w Window) Contains(now time.Time) bool {
+	clock := time.Duration(now.Hour())*time.Hour + time.Duration(now.Minute())*time.Minute + time.Duration(now.Second())*time.Second
+	today := now.Weekday()
+	yesterday := (today + 6) % 7
+	if w.Start < w.End {
+		return w.Days[today] && clock >= w.Start && clock < w.End
+	}
+	// Past midnight the window belongs to the day it started on
+	return (w.Days[today] && clock >= w.Start) || (w.Days[yesterday] && clock < w.End)
+}
+
+func (w Window) String() string {
+	var days []string
+	for d, on := range w.Days {
+		if on {
+			days = append(days, weekdays[d])
+		}
+	}
+	clock := func(d time.Duration) string {
+		return fmt.Sprintf("%02d:%02d", int(d.Hours()), int(d.Minutes())%60)
+	}
+	return fmt.Sprintf("%s %s-%s", strings.Join(days, ","), clock(w.Start), clock(w.End))
+}
+
+// MarshalText reports windows in the API the way they are configured
+func (w Window) MarshalText() ([]byte, error) {
+	return []byte(w.String()), nil
+}
+
+// SpeedStatus describes which session limits apply and why
+type SpeedStatus struct {
+	Mode      SpeedMode `json:"mode"`     // Normal or alternative, whichever applies now
+	Override  SpeedMode `json:"override"` // Auto when following the schedule
+	Schedule  []Window  `json:"schedule"`
+	Limits    Limits    `json:"limits"`
+	AltLimits Limits    `json:"alt_limits"`
+	Active    Limits    `json:"active_limits"`
+}
+
+// SpeedMode returns which session limits apply now
+func (m *Manager) SpeedMode() SpeedMode {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	return m.speedMode(time.Now())
+}
+
+// speedMode must be called with m.speedMu held
+func (m *Manager) speedMode(now time.Time) SpeedMode {
+	if m.override != SpeedAuto {
+		return m.override
+	}
+	for _, w := range m.altSchedule {
+		if w.Contains(now) {
+			return SpeedAlternative
+		}
+	}
+	return SpeedNormal
+}
+
+// SpeedStatus returns the speed mode together with both sets of limits
+func (m *Manager) SpeedStatus() SpeedStatus {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	status := SpeedStatus{
+		Mode:      m.speedMode(time.Now()),
+		Override:  m.override,
+		Schedule:  append([]Window{}, m.altSchedule...),
+		Limits:    m.limits,
+		AltLimits: m.altLimits,
+	}
+	status.Active = status.Limits
+	if status.Mode == SpeedAlternative {
+		status.Active = status.AltLimits
+	}
+	return status
+}
+
+// SetSpeedMode forces the normal or alternative limits, or with SpeedAuto
+// goes back to following the schedule
+func (m *Manager) SetSpeedMode(override SpeedMode) {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	m.override = override
+	m.applyLimits()
+}
+
+// SetAltSchedule changes when the alternative limits apply
+func (m *Manager) SetAltSchedule(schedule []Window) {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	m.altSchedule = schedule
+	m.applyLimits()
+}
+
+// followSchedule switches limits when the schedule says so
+func (m *Manager) followSchedule() {
+	m.speedMu.Lock()
+	defer m.speedMu.Unlock()
+	m.applyLimits()
+}
+
+// applyLimits sets the session's limiters to the limits of the current
+// mode. Must be called with m.speedMu held.
+func (m *Manager) applyLimits() {
+	mode := m.speedMode(time.Now())
+	limits := m.limits
+	if mode == SpeedAlternative {
+		limits = m.altLimits
+	}
+	if mode != m.appliedMode {
+		log.Printf("Switching to %s speed limits\n", mode)
+		m.appliedMode = mode
+	}
+	m.downloadLimiter.SetRate(limits.Download)
+	m.uploadLimiter.SetRate(limits.Upload)
+}
@@ -0,0 +1,89 @@
+package session
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// days returns the Days of a window open on the given weekdays
+func days(on ...time.Weekday) [7]bool {
+	var d [7]bool
+	for _, day := range on {
+		d[day] = true
+	}
+	return d
+}
+
+func TestParseSchedule(t *testing.T) {
+	weekdaysOnly := days(time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday)
+	every := days(time.Sunday, time.Monday, time.Tuesday, time.Wednesday, time.Thursday, time.Friday, time.Saturday)
+	tests := []struct {
+		name string
+		in   string
+		want []Window
+		err  bool
+	}{
+		{"empty", "", nil, false},
+		{"range of days", "mon-fri 09:00-18:00", []Window{{weekdaysOnly, 9 * time.Hour, 18 * time.Hour}}, false},
+		{"several windows", "mon-fri 09:00-18:00; sat,SUN 10:30-12:00;", []Window{
+			{weekdaysOnly, 9 * time.Hour, 18 * time.Hour},
+			{days(time.Saturday, time.Sunday), 10*time.Hour + 30*time.Minute, 12 * time.Hour},
+		}, false},
+		{"every day", "* 23:00-06:00", []Window{{every, 23 * time.Hour, 6 * time.Hour}}, false},
+		{"days wrapping the week", "fri-mon 00:00-01:00", []Window{
+			{days(time.Friday, time.Saturday, time.Sunday, time.Monday), 0, time.Hour},
+		}, false},
+		{"single day", "wed 12:00-13:00", []Window{{days(time.Wednesday), 12 * time.Hour, 13 * time.Hour}}, false},
+		{"missing time range", "mon-fri", nil, true},
+		{"unknown day", "funday 09:00-10:00", nil, true},
+		{"bad time", "mon 9am-10am", nil, true},
+		{"no range", "mon 09:00", nil, true},
+		{"out of range time", "mon 09:00-25:00", nil, true},
+		{"empty range", "mon 09:00-09:00", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ParseSchedule(tt.in)
+			if (err != nil) != tt.err {
+				t.Fatalf("ParseSchedule(%q) error = %v, want error %t", tt.in, err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ParseSchedule(%q) = %v, want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	office := Window{days(time.Monday, time.Tuesday), 9 * time.Hour, 18 * time.Hour}
+	night := Window{days(time.Friday), 23 * time.Hour, 6 * time.Hour}
+	// 2024-01-01 is a Monday
+	at := func(day, hour, minute int) time.Time {
+		return time.Date(2024, 1, day, hour, minute, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name   string
+		window Window
+		now    time.Time
+		want   bool
+	}{
+		{"inside", office, at(1, 12, 0), true},
+		{"at the start", office, at(2, 9, 0), true},
+		{"at the end", office, at(1, 18, 0), false},
+		{"before", office, at(1, 8, 59), false},
+		{"other day", office, at(3, 12, 0), false},
+		{"night, same day", night, at(5, 23, 30), true},
+		{"night, after midnight", night, at(6, 5, 59), true},
+		{"night, ended", night, at(6, 6, 0), false},
+		{"night, started on another day", night, at(5, 1, 0), false},
+		{"night, evening of another day", night, at(6, 23, 30), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.window.Contains(tt.now); got != tt.want {
+				t.Errorf("%v Contains(%v) = %t, want %t", tt.window, tt.now, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,51 @@
+package session
+
+import "fmt"
+
+// State is where a torrent is in its lifecycle
+type State string
+
+const (
+	// StateQueued torrents are waiting for their turn to start
+	StateQueued State = "queued"
+	// StateChecking torrents are verifying the data already on disk
+	StateChecking State = "checking"
+	// StateDownloading torrents are fetching pieces from peers
+	StateDownloading State = "downloading"
+	// StateSeeding torrents have every wanted piece
+	StateSeeding State = "seeding"
+	// StatePaused torrents were stopped by the user
+	StatePaused State = "paused"
+	// StateErrored torrents stopped because of an error
+	StateErrored State = "errored"
+)
+
+// transitions lists the states each state may move to
+var transitions = map[State][]State{
+	StateQueued:      {StateChecking, StatePaused},
+	StateChecking:    {StateDownloading, StateSeeding, StatePaused, StateErrored},
+	StateDownloading: {StateSeeding, StatePaused, StateErrored},
+	StateSeeding:     {StateQueued, StateChecking, StateDownloading, StatePaused, StateErrored},
+	StatePaused:      {StateQueued, StateChecking, StateDownloading, StateErrored},
+	StateErrored:     {StateQueued, StateChecking, StatePaused},
+}
+
+func (s State) canMoveTo(next State) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == next {
+			return true
+		}
+	}
+	return false
+}
+
+// TransitionError is returned when an operation is not valid in the
+// torrent's current state
+type TransitionError struct {
+	From State
+	To   State
+}
+
+func (e *TransitionError) Error() string {
+	return fmt.Sprintf("cannot move torrent from %s to %s", e.From, e.To)
+}
@@ -0,0 +1,144 @@
+package session
+
+import (
+	"bit_torrent/p2p"
+	"bit_torrent/storage"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+)
+
+// savedSession is the session file
+type savedSession struct {
+	Categories []Category     `json:"categories"`
+	Torrents   []savedTorrent `json:"torrents"`
+}
+
+// savedTorrent is a torrent as kept in the session file
+type savedTorrent struct {
+	InfoHash    string          `json:"infohash"`
+	Name        string          `json:"name"`
+	TorrentPath string          `json:"torrent_path"`
+	SavePath    string          `json:"save_path"`
+	Dirs        Dirs            `json:"dirs"`
+	Category    string          `json:"category,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+	Storage     storage.Options `json:"storage"`
+	Paused      bool            `json:"paused"` // Paused by the user, the rest are started on restore
+	Priorities  []p2p.Priority  `json:"priorities,omitempty"`
+	Sequential  bool            `json:"sequential,omitempty"`
+	Limits      Limits          `json:"limits"`
+	SeedGoals   *SeedGoals      `json:"seed_goals,omitempty"`
+	SeedingTime int64           `json:"seeding_time,omitempty"` // Seconds
+}
+
+func (t *Torrent) saved() savedTorrent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return savedTorrent{
+		InfoHash:    t.HexHash(),
+		Name:        t.Name,
+		TorrentPath: t.TorrentPath,
+		SavePath:    t.savePath,
+		Dirs:        t.dirs,
+		Category:    t.category,
+		Tags:        t.tags,
+		Storage:     t.Storage,
+		Paused:      t.userPaused,
+		Priorities:  t.priorities,
+		Sequential:  t.sequential,
+		Limits:      t.Limits(),
+		SeedGoals:   t.seedGoals,
+		SeedingTime: int64(t.seedingTime().Seconds()),
+	}
+}
+
+// save writes the categories, the torrent list and each torrent's settings
+// to the session file. Failures are logged, the session keeps working
+// without it.
+func (m *Manager) save() {
+	if m.cfg.StatePath == "" {
+		return
+	}
+	saved := savedSession{Categories: m.Categories(), Torrents: []savedTorrent{}}
+	for _, t := range m.List() {
+		saved.Torrents = append(saved.Torrents, t.saved())
+	}
+
+	m.saveMu.Lock()
+	defer m.saveMu.Unlock()
+	if err := writeJSON(m.cfg.StatePath, saved); err != nil {
+		log.Printf("Error saving session: %v", err)
+	}
+}
+
+// writeJSON writes v to path atomically by writing a temporary file next to
+// it and renaming it over the old one
+func writeJSON(path string, v interface{}) error {
+	data, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal session: %v", err)
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0644); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to write session file: %v", err)
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return fmt.Errorf("failed to replace session file: %v", err)
+	}
+	return nil
+}
+
+// Restore adds the torrents saved in the session file in their queue order
+// and queues the ones the user had not paused; their data is fast-resumed
+// or rechecked as they start. Torrents whose .torrent file has gone are dropped.
+func (m *Manager) Restore() error {
+	if m.cfg.StatePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(m.cfg.StatePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var saved savedSession
+	if err := json.Unmarshal(data, &saved); err != nil {
+		return fmt.Errorf("failed to parse session file: %v", err)
+	}
+
+	m.labelsMu.Lock()
+	for _, c := range saved.Categories {
+		m.categories[c.Name] = c
+	}
+	m.labelsMu.Unlock()
+	for _, s := range saved.Torrents {
+		t, err := m.add(s.TorrentPath, s.Name, AddOptions{Storage: s.Storage, Category: s.Category, Tags: s.Tags})
+		if err != nil {
+			log.Printf("Dropping %s from the session: %v\n", s.Name, err)
+			continue
+		}
+		if t.HexHash() != s.InfoHash {
+			log.Printf("Torrent file of %s changed since it was added\n", s.Name)
+		}
+		t.savePath = s.SavePath
+		t.dirs = s.Dirs
+		t.priorities = s.Priorities
+		t.sequential = s.Sequential
+		t.setLimits(s.Limits)
+		t.seedGoals = s.SeedGoals
+		t.seededFor = time.Duration(s.SeedingTime) * time.Second
+		if !s.Paused {
+			t.enqueue()
+		}
+	}
+	m.save()
+	m.schedule()
+	return nil
+}
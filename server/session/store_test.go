@@ -0,0 +1,59 @@
+package session
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestRestore(t *testing.T) {
+	root, tracker := t.TempDir(), newTracker(t)
+	cfg := Config{OutputDir: filepath.Join(root, "output"), StatePath: filepath.Join(root, "session.json")}
+	m := New(cfg)
+	download := startTorrent(t, m, root, tracker, "a", false)
+	seed := startTorrent(t, m, root, tracker, "b", true)
+	gone := startTorrent(t, m, root, tracker, "c", false)
+	waitState(t, download, StateDownloading)
+	waitState(t, seed, StateSeeding)
+	download.SetSequential(true)
+	if err := m.Pause(seed.InfoHash); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Move(seed.InfoHash, MoveTop); err != nil {
+		t.Fatal(err)
+	}
+	m.Shutdown()
+	if err := os.Remove(gone.TorrentPath); err != nil {
+		t.Fatal(err)
+	}
+
+	m = New(cfg)
+	defer m.Shutdown()
+	if err := m.Restore(); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, tor := range m.List() {
+		names = append(names, tor.Name)
+	}
+	if want := []string{"b", "a"}; !reflect.DeepEqual(names, want) {
+		t.Fatalf("restored %v, want %v", names, want)
+	}
+
+	// The download starts again, the seed the user paused stays paused
+	download, seed = m.List()[1], m.List()[0]
+	waitState(t, download, StateDownloading)
+	if running := download.Running(); running == nil || !running.Sequential {
+		t.Error("restored download is not running sequentially")
+	}
+	if state, _ := seed.State(); state != StatePaused {
+		t.Errorf("restored seed is %s, want paused", state)
+	}
+	if progress := seed.Progress().Progress; progress != 100 {
+		t.Errorf("restored seed progress = %v, want 100", progress)
+	}
+	if seed.SavePath() != filepath.Join(cfg.OutputDir, "b") {
+		t.Errorf("restored seed data at %s", seed.SavePath())
+	}
+}
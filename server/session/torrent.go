@@ -0,0 +1,309 @@
+package session
+
+import (
+	"bit_torrent/p2p"
+	"bit_torrent/ratelimit"
+	"bit_torrent/resume"
+	"bit_torrent/storage"
+	"bit_torrent/torrent"
+	"context"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrNotRunning is returned for operations that need a running download
+var ErrNotRunning = errors.New("session: torrent is not running")
+
+// Torrent is a torrent managed by the session
+type Torrent struct {
+	InfoHash    [20]byte
+	Name        string // Name of the torrent's upload folder, used by the HTTP API
+	Meta        torrent.TorrentFile
+	TorrentPath string
+	ResumePath  string
+	Storage     storage.Options
+
+	mu         sync.Mutex
+	savePath   string // Where the data is, changed when it moves
+	dirs       Dirs
+	category   string
+	tags       []string // Sorted
+	state      State
+	err        error
+	running    *p2p.Torrent  // Set while checking, downloading and seeding
+	announced  *p2p.Torrent  // The running download once it has announced to the tracker
+	done       chan struct{} // Closed when the current run ends
+	progress   p2p.ProgressData
+	priorities []p2p.Priority
+	sequential bool
+	userPaused bool      // Paused by the user rather than stopped by the session
+	lastActive time.Time // When the download last finished a piece
+	changed    func()    // Called when a setting kept in the session file changes
+
+	seedGoals    *SeedGoals    // Nil to follow the session's
+	seededFor    time.Duration // Seeding time before the current stint
+	seedingSince time.Time     // Start of the current stint
+	lastUpload   time.Time     // When seeding began or the upload total last grew
+	goalReached  string        // The seeding goal that ended seeding, until started again
+
+	downloadLimiter *ratelimit.Limiter
+	uploadLimiter   *ratelimit.Limiter
+}
+
+// Status is a snapshot of a torrent for the API
+type Status struct {
+	InfoHash      string   `json:"infohash"`
+	Name          string   `json:"name"`
+	State         State    `json:"state"`
+	Error         string   `json:"error,omitempty"`
+	Progress      float64  `json:"progress"`
+	Speed         float64  `json:"speed"`
+	RemainingTime float64  `json:"remaining_time"`
+	QueuePosition int      `json:"queue_position"`
+	Category      string   `json:"category,omitempty"`
+	Tags          []string `json:"tags,omitempty"`
+	Ratio         float64  `json:"ratio"`
+	SeedingTime   float64  `json:"seeding_time"` // Seconds
+	GoalReached   string   `json:"seed_goal_reached,omitempty"`
+
+	Stats *p2p.TransferStats `json:"stats,omitempty"`
+}
+
+// stop disconnects the torrent from its peers if it is running and waits
+// until it has saved its data
+func (t *Torrent) stop() {
+	t.mu.Lock()
+	done := t.done
+	if t.running != nil {
+		t.running.Stop()
+	}
+	t.mu.Unlock()
+	if done != nil {
+		<-done
+	}
+}
+
+// HexHash returns the infohash as the hex string used by the API
+func (t *Torrent) HexHash() string {
+	return hex.EncodeToString(t.InfoHash[:])
+}
+
+// State returns the torrent's state and, when errored, the error that stopped it
+func (t *Torrent) State() (State, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.state, t.err
+}
+
+// setState moves the torrent to next if its state machine allows it.
+// Must be called with t.mu held.
+func (t *Torrent) setState(next State, err error) error {
+	if t.state != next && !t.state.canMoveTo(next) {
+		return &TransitionError{From: t.state, To: next}
+	}
+	t.trackSeeding(next)
+	t.state, t.err = next, err
+	return nil
+}
+
+// moveTo is setState for transitions made by the session itself, which are
+// always expected to be valid
+func (t *Torrent) moveTo(next State, err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if transitionErr := t.setState(next, err); transitionErr != nil {
+		log.Printf("Torrent %s: %v\n", t.Name, transitionErr)
+	}
+}
+
+// Running returns the download behind the torrent, or nil when it is not running
+func (t *Torrent) Running() *p2p.Torrent {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.running
+}
+
+// Progress returns the last progress reported for the torrent, marked as
+// paused unless it is actively downloading
+func (t *Torrent) Progress() p2p.ProgressData {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	progress := t.progress
+	progress.Name = t.Name
+	progress.Paused = t.state != StateDownloading
+	if t.running == nil && progress.Stats != nil {
+		// Only the totals outlive a run
+		stats := p2p.TransferStats{Download: progress.Stats.Download, Upload: progress.Stats.Upload}
+		stats.Download.ShortRate, stats.Download.Rate = 0, 0
+		stats.Upload.ShortRate, stats.Upload.Rate = 0, 0
+		progress.Stats = &stats
+		progress.Speed, progress.RemainingTime = 0, 0
+	}
+	if t.err != nil {
+		progress.Error = t.err.Error()
+	}
+	return progress
+}
+
+func (t *Torrent) setProgress(progress p2p.ProgressData) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if progress.Progress > t.progress.Progress {
+		t.lastActive = time.Now()
+	}
+	if progress.Stats != nil && t.progress.Stats != nil && progress.Stats.Upload.Payload > t.progress.Stats.Upload.Payload {
+		t.lastUpload = time.Now()
+	}
+	t.progress = progress
+}
+
+// Status returns a snapshot of the torrent for the API
+func (t *Torrent) Status() Status {
+	progress := t.Progress()
+	state, _ := t.State()
+	t.mu.Lock()
+	ratio, seedingTime, goalReached := t.ratio(), t.seedingTime(), t.goalReached
+	category, tags := t.category, append([]string(nil), t.tags...)
+	t.mu.Unlock()
+	return Status{
+		InfoHash:      t.HexHash(),
+		Name:          t.Name,
+		State:         state,
+		Error:         progress.Error,
+		Progress:      progress.Progress,
+		Speed:         progress.Speed,
+		RemainingTime: progress.RemainingTime,
+		Category:      category,
+		Tags:          tags,
+		Ratio:         ratio,
+		SeedingTime:   seedingTime.Seconds(),
+		GoalReached:   goalReached,
+		Stats:         progress.Stats,
+	}
+}
+
+// loadProgress fills in the progress of a torrent that is not running from
+// its resume data
+func (t *Torrent) loadProgress() {
+	data, err := resume.Load(t.ResumePath)
+	if err != nil || data.InfoHash != t.InfoHash || data.NumPieces == 0 {
+		return
+	}
+	t.setProgress(p2p.ProgressData{
+		Progress: float64(data.CompletedPieces()) / float64(data.NumPieces) * 100,
+		Stats: &p2p.TransferStats{
+			Download: p2p.TransferTotals{Payload: data.Downloaded, Overhead: data.DownloadedOverhead},
+			Upload:   p2p.TransferTotals{Payload: data.Uploaded, Overhead: data.UploadedOverhead},
+		},
+	})
+}
+
+// Files lists the torrent's files with their priorities and progress
+func (t *Torrent) Files() []torrent.FileStatus {
+	t.mu.Lock()
+	running := t.running
+	var priorities []p2p.Priority
+	if running != nil {
+		priorities = running.Priorities()
+	} else if t.priorities != nil {
+		priorities = append(priorities, t.priorities...)
+	}
+	t.mu.Unlock()
+	return t.Meta.FileStatuses(running, priorities, t.ResumePath)
+}
+
+// FilePath returns where file i of the torrent is stored on disk
+func (t *Torrent) FilePath(i int) string {
+	return t.Meta.StorageInfo().Paths(t.SavePath())[i]
+}
+
+// SetFilePriority changes the priority of file i, applying it straight away
+// when the torrent is running and the next time it starts otherwise
+func (t *Torrent) SetFilePriority(i int, priority p2p.Priority) error {
+	if err := t.setFilePriority(i, priority); err != nil {
+		return err
+	}
+	t.changed()
+	return nil
+}
+
+func (t *Torrent) setFilePriority(i int, priority p2p.Priority) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	numFiles := len(t.Meta.StorageInfo().Files)
+	if i < 0 || i >= numFiles {
+		return fmt.Errorf("file index %d out of range", i)
+	}
+	if t.priorities == nil {
+		t.priorities = make([]p2p.Priority, numFiles)
+		for j := range t.priorities {
+			t.priorities[j] = p2p.PriorityNormal
+		}
+	}
+	t.priorities[i] = priority
+	if t.running != nil {
+		return t.running.SetFilePriority(i, priority)
+	}
+	return nil
+}
+
+// SetSequential switches the torrent between in-order and priority downloading
+func (t *Torrent) SetSequential(sequential bool) {
+	t.mu.Lock()
+	t.sequential = sequential
+	if t.running != nil {
+		t.running.SetSequential(sequential)
+	}
+	t.mu.Unlock()
+	t.changed()
+}
+
+// Peers describes the peers a running torrent is connected to, none when
+// it is not running
+func (t *Torrent) Peers() []p2p.PeerInfo {
+	running := t.Running()
+	if running == nil {
+		return []p2p.PeerInfo{}
+	}
+	return running.ConnectedPeers()
+}
+
+// PieceMap reports the state of every piece. A torrent that is not running
+// has no requested pieces or peers, its verified pieces come from its
+// resume data.
+func (t *Torrent) PieceMap() p2p.PieceMap {
+	if running := t.Running(); running != nil {
+		return running.PieceMap()
+	}
+	numPieces := len(t.Meta.PieceHashes)
+	states := make([]p2p.PieceState, numPieces)
+	data, err := resume.Load(t.ResumePath)
+	valid := err == nil && data.InfoHash == t.InfoHash && data.NumPieces == numPieces
+	for index := range states {
+		states[index] = p2p.PieceMissing
+		if valid && data.Bitfield.HasPiece(index) {
+			states[index] = p2p.PieceVerified
+		}
+	}
+	return p2p.NewPieceMap(states, make([]int, numPieces))
+}
+
+// NewFileReader streams file i of a running torrent. A skipped file is
+// switched back to normal priority first.
+func (t *Torrent) NewFileReader(ctx context.Context, i int) (*p2p.FileReader, error) {
+	running := t.Running()
+	if running == nil {
+		return nil, ErrNotRunning
+	}
+	if i >= 0 && i < len(running.Layout.Files) && running.Priorities()[i] == p2p.PrioritySkip {
+		if err := t.SetFilePriority(i, p2p.PriorityNormal); err != nil {
+			return nil, err
+		}
+	}
+	return running.NewFileReader(ctx, i)
+}
@@ -0,0 +1,27 @@
+package stats
+
+import "net"
+
+type conn struct {
+	net.Conn
+	read  *Meter
+	write *Meter
+}
+
+// NewConn wraps c so every byte read is counted in read and every byte
+// written in write
+func NewConn(c net.Conn, read *Meter, write *Meter) net.Conn {
+	return &conn{Conn: c, read: read, write: write}
+}
+
+func (c *conn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.read.Add(n)
+	return n, err
+}
+
+func (c *conn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.write.Add(n)
+	return n, err
+}
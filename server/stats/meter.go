@@ -0,0 +1,90 @@
+package stats
+
+import (
+	"sync"
+	"time"
+)
+
+// windowSeconds is the longest window Rate can average over
+const windowSeconds = 60
+
+// clock returns the current time, replaced in tests
+var clock = time.Now
+
+// Meter counts bytes and estimates their rate over a recent window. Bytes
+// added to a meter are added to its parent as well. The zero value is
+// ready to use.
+type Meter struct {
+	mu      sync.Mutex
+	total   int64
+	start   time.Time
+	buckets [windowSeconds + 1]int64 // Bytes per second, indexed by Unix second
+	last    int64                    // Unix second of the newest bucket
+	parent  *Meter
+}
+
+// NewMeter returns a meter adding everything it counts to parent, which may be nil
+func NewMeter(parent *Meter) *Meter {
+	return &Meter{parent: parent}
+}
+
+// Add counts n bytes
+func (m *Meter) Add(n int) {
+	if n <= 0 {
+		return
+	}
+	m.mu.Lock()
+	now := clock()
+	if m.start.IsZero() {
+		m.start = now
+	}
+	m.advance(now.Unix())
+	m.buckets[now.Unix()%int64(len(m.buckets))] += int64(n)
+	m.total += int64(n)
+	m.mu.Unlock()
+
+	if m.parent != nil {
+		m.parent.Add(n)
+	}
+}
+
+// Total returns every byte counted
+func (m *Meter) Total() int64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.total
+}
+
+// Rate returns the bytes per second over the last window of whole seconds,
+// at most a minute, or since the first byte when that is more recent
+func (m *Meter) Rate(window time.Duration) float64 {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.start.IsZero() {
+		return 0
+	}
+	now := clock()
+	m.advance(now.Unix())
+
+	seconds := int64(window / time.Second)
+	seconds = min(seconds, windowSeconds, int64(now.Sub(m.start)/time.Second))
+	seconds = max(seconds, 1)
+	var sum int64
+	for s := now.Unix() - seconds; s < now.Unix(); s++ {
+		sum += m.buckets[s%int64(len(m.buckets))]
+	}
+	return float64(sum) / float64(seconds)
+}
+
+// advance clears the buckets of the seconds since the newest one. Must be
+// called with m.mu held.
+func (m *Meter) advance(now int64) {
+	if now <= m.last {
+		return
+	}
+	from := max(m.last+1, now-int64(len(m.buckets))+1)
+	for s := from; s <= now; s++ {
+		m.buckets[s%int64(len(m.buckets))] = 0
+	}
+	m.last = now
+}
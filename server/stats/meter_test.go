@@ -0,0 +1,54 @@
+package stats
+
+import (
+	"testing"
+	"time"
+)
+
+func TestMeter(t *testing.T) {
+	now := time.Unix(1000, 200*int64(time.Millisecond))
+	clock = func() time.Time { return now }
+	defer func() { clock = time.Now }()
+
+	parent := NewMeter(nil)
+	m := NewMeter(parent)
+	if rate := m.Rate(time.Minute); rate != 0 {
+		t.Errorf("Rate() of an empty meter = %v", rate)
+	}
+
+	// Each step moves the clock on by wait, adds add bytes, then reads the
+	// rate over window
+	steps := []struct {
+		name   string
+		wait   time.Duration
+		add    int
+		window time.Duration
+		rate   float64
+		total  int64
+	}{
+		{"current second is not counted", 0, 100, 10 * time.Second, 0, 100},
+		{"only since the first byte", time.Second, 0, 10 * time.Second, 100, 100},
+		{"nothing added", 0, 0, 10 * time.Second, 100, 100},
+		{"negative ignored", 0, -50, 10 * time.Second, 100, 100},
+		{"second byte count", 300 * time.Millisecond, 300, 10 * time.Second, 100, 400},
+		{"over three seconds", 1700 * time.Millisecond, 0, 10 * time.Second, 400.0 / 3, 400},
+		{"last second only", 0, 0, time.Second, 0, 400},
+		{"shorter than a second", 0, 0, time.Millisecond, 0, 400},
+		{"full window", 60 * time.Second, 0, time.Minute, 0, 400},
+		{"after the window", 0, 600, time.Minute, 0, 1000},
+		{"window capped at a minute", 2 * time.Second, 0, time.Hour, 600.0 / 60, 1000},
+	}
+	for _, step := range steps {
+		now = now.Add(step.wait)
+		m.Add(step.add)
+		if rate := m.Rate(step.window); rate != step.rate {
+			t.Errorf("%s: Rate(%s) = %v, want %v", step.name, step.window, rate, step.rate)
+		}
+		if total := m.Total(); total != step.total {
+			t.Errorf("%s: Total() = %d, want %d", step.name, total, step.total)
+		}
+		if total := parent.Total(); total != step.total {
+			t.Errorf("%s: parent Total() = %d, want %d", step.name, total, step.total)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// Allocation selects how a torrent's files are created before downloading
+type Allocation string
+
+const (
+	// AllocNone creates files lazily and lets them grow as pieces arrive
+	AllocNone Allocation = "none"
+	// AllocSparse creates every file at its full length without reserving blocks
+	AllocSparse Allocation = "sparse"
+	// AllocFull reserves the blocks of every file up front
+	AllocFull Allocation = "full"
+)
+
+// ParseAllocation validates an allocation mode, defaulting to AllocNone when empty
+func ParseAllocation(s string) (Allocation, error) {
+	switch Allocation(s) {
+	case "":
+		return AllocNone, nil
+	case AllocNone, AllocSparse, AllocFull:
+		return Allocation(s), nil
+	}
+	return "", fmt.Errorf("unknown allocation mode %q", s)
+}
+
+// InsufficientSpaceError reports that a torrent does not fit on its filesystem
+type InsufficientSpaceError struct {
+	Path      string
+	Needed    int64
+	Available int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space for %s: need %d bytes, %d available", e.Path, e.Needed, e.Available)
+}
+
+// errSpaceUnknown is returned by availableSpace on platforms that cannot report it
+var errSpaceUnknown = errors.New("storage: free space unknown")
+
+// Prepare checks that the filesystem holding root has room for the parts of
+// the torrent that are not on disk yet, then creates its files according to
+// alloc. Files marked in skip are neither counted nor created. It is meant
+// to run before any peer is contacted so a torrent that cannot fit fails
+// straight away.
+func Prepare(root string, info Info, alloc Allocation, skip []bool) error {
+	paths := info.Paths(root)
+	skipped := func(i int) bool { return i < len(skip) && skip[i] }
+
+	var needed int64
+	for i, path := range paths {
+		if skipped(i) {
+			continue
+		}
+		if missing := info.Files[i].Length - allocatedSize(path); missing > 0 {
+			needed += missing
+		}
+	}
+	available, err := availableSpace(existingParent(root))
+	if err != nil && !errors.Is(err, errSpaceUnknown) {
+		return err
+	}
+	if err == nil && available < needed {
+		return &InsufficientSpaceError{Path: root, Needed: needed, Available: available}
+	}
+
+	if alloc == AllocNone || alloc == "" {
+		return nil
+	}
+	for i, path := range paths {
+		if skipped(i) {
+			continue
+		}
+		if err := allocateFile(path, info.Files[i].Length, alloc); err != nil {
+			return fmt.Errorf("failed to allocate %s: %v", path, err)
+		}
+	}
+	return nil
+}
+
+func allocateFile(path string, length int64, alloc Allocation) error {
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if alloc == AllocFull {
+		return preallocate(f, length)
+	}
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if stat.Size() < length {
+		return f.Truncate(length)
+	}
+	return nil
+}
+
+// existingParent walks up from path to the closest directory that exists,
+// since the torrent's own folder is usually created later
+func existingParent(path string) string {
+	for {
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return path
+		}
+		path = parent
+	}
+}
@@ -0,0 +1,17 @@
+//go:build !(linux || darwin || freebsd)
+
+package storage
+
+import "os"
+
+func availableSpace(path string) (int64, error) {
+	return 0, errSpaceUnknown
+}
+
+func allocatedSize(path string) int64 {
+	info, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return info.Size()
+}
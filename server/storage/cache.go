@@ -0,0 +1,258 @@
+package storage
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+)
+
+// CacheStats reports how well a Cache is doing
+type CacheStats struct {
+	Hits     int64   `json:"hits"`
+	Misses   int64   `json:"misses"`
+	HitRatio float64 `json:"hit_ratio"`
+	Size     int64   `json:"size"`  // Bytes currently cached
+	Dirty    int64   `json:"dirty"` // Bytes waiting to be written
+}
+
+// Cache is a write-back cache in front of another Storage. Whole pieces are
+// kept in memory until Flush, which writes runs of adjacent pieces with a
+// single sequential write. Pieces that were written or read recently stay
+// cached so uploads can be served without touching the disk.
+type Cache struct {
+	inner    Storage
+	info     Info
+	capacity int64
+
+	mu        sync.Mutex
+	dirty     map[int][]byte
+	completed map[int]bool // Dirty pieces marked complete before reaching disk
+	dirtySize int64
+	clean     map[int]*list.Element
+	lru       *list.List // Of *cachedPiece, most recently used at the front
+	cleanSize int64
+	hits      int64
+	misses    int64
+}
+
+type cachedPiece struct {
+	index int
+	buf   []byte
+}
+
+// NewCache wraps inner with a cache holding up to capacity bytes
+func NewCache(inner Storage, info Info, capacity int64) *Cache {
+	return &Cache{
+		inner:     inner,
+		info:      info,
+		capacity:  capacity,
+		dirty:     make(map[int][]byte),
+		completed: make(map[int]bool),
+		clean:     make(map[int]*list.Element),
+		lru:       list.New(),
+	}
+}
+
+func (c *Cache) pieceSize(index int) int {
+	begin := int64(index) * int64(c.info.PieceLength)
+	if rest := c.info.Length - begin; rest < int64(c.info.PieceLength) {
+		return int(rest)
+	}
+	return c.info.PieceLength
+}
+
+// cached returns the buffer of a cached piece, marking it as recently used
+func (c *Cache) cached(index int) []byte {
+	if buf, ok := c.dirty[index]; ok {
+		return buf
+	}
+	if elem, ok := c.clean[index]; ok {
+		c.lru.MoveToFront(elem)
+		return elem.Value.(*cachedPiece).buf
+	}
+	return nil
+}
+
+func (c *Cache) ReadAt(index int, p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if buf := c.cached(index); buf != nil && off+int64(len(p)) <= int64(len(buf)) {
+		c.hits++
+		return copy(p, buf[off:]), nil
+	}
+	c.misses++
+
+	// Pull the whole piece in so the following blocks are served from memory
+	buf := make([]byte, c.pieceSize(index))
+	if _, err := c.inner.ReadAt(index, buf, 0); err != nil {
+		return c.inner.ReadAt(index, p, off)
+	}
+	c.addClean(index, buf)
+	if off+int64(len(p)) > int64(len(buf)) {
+		return 0, ErrOutOfRange
+	}
+	return copy(p, buf[off:]), nil
+}
+
+func (c *Cache) WriteAt(index int, p []byte, off int64) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.removeClean(index)
+	if off != 0 || len(p) != c.pieceSize(index) {
+		// Only whole pieces are cached, write anything else straight through
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+		return c.inner.WriteAt(index, p, off)
+	}
+
+	if old, ok := c.dirty[index]; ok {
+		c.dirtySize -= int64(len(old))
+	}
+	buf := make([]byte, len(p))
+	copy(buf, p)
+	c.dirty[index] = buf
+	c.dirtySize += int64(len(buf))
+
+	if c.dirtySize > c.capacity/2 {
+		if err := c.flushLocked(); err != nil {
+			return 0, err
+		}
+	}
+	c.evict()
+	return len(p), nil
+}
+
+func (c *Cache) MarkComplete(index int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if _, ok := c.dirty[index]; ok {
+		c.completed[index] = true
+		return nil
+	}
+	return c.inner.MarkComplete(index)
+}
+
+// Flush writes every dirty piece to the underlying storage
+func (c *Cache) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.flushLocked()
+}
+
+func (c *Cache) flushLocked() error {
+	if len(c.dirty) == 0 {
+		return nil
+	}
+	indexes := make([]int, 0, len(c.dirty))
+	for index := range c.dirty {
+		indexes = append(indexes, index)
+	}
+	sort.Ints(indexes)
+
+	// Coalesce runs of adjacent pieces into one write each
+	for start := 0; start < len(indexes); {
+		end := start + 1
+		for end < len(indexes) && indexes[end] == indexes[end-1]+1 {
+			end++
+		}
+		run := indexes[start:end]
+		var buf []byte
+		if len(run) == 1 {
+			buf = c.dirty[run[0]]
+		} else {
+			for _, index := range run {
+				buf = append(buf, c.dirty[index]...)
+			}
+		}
+		if _, err := c.inner.WriteAt(run[0], buf, 0); err != nil {
+			return err
+		}
+		for _, index := range run {
+			if c.completed[index] {
+				if err := c.inner.MarkComplete(index); err != nil {
+					return err
+				}
+				delete(c.completed, index)
+			}
+			piece := c.dirty[index]
+			delete(c.dirty, index)
+			c.dirtySize -= int64(len(piece))
+			c.addClean(index, piece)
+		}
+		start = end
+	}
+	c.evict()
+	return nil
+}
+
+func (c *Cache) addClean(index int, buf []byte) {
+	c.removeClean(index)
+	c.clean[index] = c.lru.PushFront(&cachedPiece{index, buf})
+	c.cleanSize += int64(len(buf))
+	c.evict()
+}
+
+func (c *Cache) removeClean(index int) {
+	if elem, ok := c.clean[index]; ok {
+		c.lru.Remove(elem)
+		delete(c.clean, index)
+		c.cleanSize -= int64(len(elem.Value.(*cachedPiece).buf))
+	}
+}
+
+// evict drops the least recently used clean pieces until the cache fits
+func (c *Cache) evict() {
+	for c.dirtySize+c.cleanSize > c.capacity && c.lru.Len() > 0 {
+		c.removeClean(c.lru.Back().Value.(*cachedPiece).index)
+	}
+}
+
+// Stats returns the cache's hit ratio and size
+func (c *Cache) Stats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	stats := CacheStats{
+		Hits:   c.hits,
+		Misses: c.misses,
+		Size:   c.dirtySize + c.cleanSize,
+		Dirty:  c.dirtySize,
+	}
+	if total := c.hits + c.misses; total > 0 {
+		stats.HitRatio = float64(c.hits) / float64(total)
+	}
+	return stats
+}
+
+// Close flushes the cache and closes the underlying storage
+func (c *Cache) Close() error {
+	err := c.Flush()
+	if closeErr := c.inner.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// SkipFiles forwards the files not to create to the underlying storage
+func (c *Cache) SkipFiles(skip []bool) {
+	SkipFiles(c.inner, skip)
+}
+
+// Flush writes out anything s holds in memory, if it caches writes at all
+func Flush(s Storage) error {
+	if f, ok := s.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
+// SkipFiles tells s which files are not wanted, if it can avoid creating them
+func SkipFiles(s Storage, skip []bool) {
+	if f, ok := s.(interface{ SkipFiles([]bool) }); ok {
+		f.SkipFiles(skip)
+	}
+}
@@ -0,0 +1,125 @@
+package storage
+
+import (
+	"bytes"
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+// recordStorage records the calls that reach the storage behind a cache
+type recordStorage struct {
+	Storage
+	calls []string
+}
+
+func (s *recordStorage) WriteAt(index int, p []byte, off int64) (int, error) {
+	s.calls = append(s.calls, fmt.Sprintf("write %d+%d:%d", index, off, len(p)))
+	return s.Storage.WriteAt(index, p, off)
+}
+
+func (s *recordStorage) MarkComplete(index int) error {
+	s.calls = append(s.calls, fmt.Sprintf("complete %d", index))
+	return s.Storage.MarkComplete(index)
+}
+
+func newRecordedCache(t *testing.T, capacity int64) (*Cache, *recordStorage) {
+	t.Helper()
+	inner, err := Open(KindMemory, "", testInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := &recordStorage{Storage: inner}
+	return NewCache(rec, testInfo, capacity), rec
+}
+
+// piece returns the test data of a piece
+func piece(index int) []byte {
+	begin := index * testInfo.PieceLength
+	return testData[begin:min(begin+testInfo.PieceLength, len(testData))]
+}
+
+func TestCacheCoalescesWrites(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []int // Whole pieces written, each then marked complete
+		want   []string
+	}{
+		{"single piece", []int{2}, []string{"write 2+0:4", "complete 2"}},
+		{"adjacent pieces in one write", []int{1, 0, 2}, []string{"write 0+0:12", "complete 0", "complete 1", "complete 2"}},
+		{"separate runs", []int{3, 0, 1}, []string{"write 0+0:8", "complete 0", "complete 1", "write 3+0:2", "complete 3"}},
+		{"rewritten piece once", []int{1, 1}, []string{"write 1+0:4", "complete 1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c, rec := newRecordedCache(t, 1<<20)
+			for _, index := range tt.writes {
+				if _, err := c.WriteAt(index, piece(index), 0); err != nil {
+					t.Fatal(err)
+				}
+				if err := c.MarkComplete(index); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if len(rec.calls) != 0 {
+				t.Fatalf("reached storage before Flush: %v", rec.calls)
+			}
+			if err := c.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(rec.calls, tt.want) {
+				t.Errorf("calls = %v, want %v", rec.calls, tt.want)
+			}
+		})
+	}
+}
+
+func TestCachePartialWritesGoThrough(t *testing.T) {
+	c, rec := newRecordedCache(t, 1<<20)
+	c.WriteAt(0, piece(0), 0)
+	// Writing part of a piece flushes what is dirty first, keeping order
+	if _, err := c.WriteAt(1, piece(1)[:2], 0); err != nil {
+		t.Fatal(err)
+	}
+	want := []string{"write 0+0:4", "write 1+0:2"}
+	if !reflect.DeepEqual(rec.calls, want) {
+		t.Errorf("calls = %v, want %v", rec.calls, want)
+	}
+}
+
+func TestCacheFlushesWhenHalfFull(t *testing.T) {
+	// Room for two pieces, so the second dirty one triggers a flush
+	c, rec := newRecordedCache(t, 8)
+	c.WriteAt(0, piece(0), 0)
+	if len(rec.calls) != 0 {
+		t.Fatalf("flushed early: %v", rec.calls)
+	}
+	c.WriteAt(1, piece(1), 0)
+	if want := []string{"write 0+0:8"}; !reflect.DeepEqual(rec.calls, want) {
+		t.Errorf("calls = %v, want %v", rec.calls, want)
+	}
+	if stats := c.Stats(); stats.Dirty != 0 || stats.Size > 8 {
+		t.Errorf("Stats() = %+v, want nothing dirty within capacity", stats)
+	}
+}
+
+func TestCacheServesReads(t *testing.T) {
+	c, _ := newRecordedCache(t, 1<<20)
+	writePieces(t, c)
+
+	// Dirty pieces are read from memory
+	buf := make([]byte, 2)
+	if _, err := c.ReadAt(1, buf, 2); err != nil || !bytes.Equal(buf, piece(1)[2:]) {
+		t.Errorf("ReadAt() = %q, %v, want %q", buf, err, piece(1)[2:])
+	}
+	if err := c.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// And so are flushed ones, which stay cached clean
+	if got := readAll(t, c); !bytes.Equal(got, testData) {
+		t.Errorf("read %q, want %q", got, testData)
+	}
+	if stats := c.Stats(); stats.Misses != 0 || stats.Hits != 5 || stats.HitRatio != 1 {
+		t.Errorf("Stats() = %+v, want 5 hits and no misses", stats)
+	}
+}
@@ -0,0 +1,149 @@
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// fileStorage writes pieces into regular files, opening each one the first
+// time it is needed. Reads never create files, so checking a torrent that
+// was never downloaded leaves the disk untouched.
+type fileStorage struct {
+	info  Info
+	paths []string
+
+	mu      sync.Mutex
+	closed  bool
+	handles []*os.File
+	skip    []bool // Files not to create, see SkipFiles
+}
+
+// NewFile returns a storage writing a single file torrent to path
+func NewFile(path string, info Info) Storage {
+	return newFileStorage(path, info)
+}
+
+// NewMultiFile returns a storage laying a torrent's files out under dir
+func NewMultiFile(dir string, info Info) Storage {
+	return newFileStorage(dir, info)
+}
+
+func newFileStorage(root string, info Info) *fileStorage {
+	return &fileStorage{
+		info:    info,
+		paths:   info.Paths(root),
+		handles: make([]*os.File, len(info.Files)),
+	}
+}
+
+// SkipFiles marks files the user does not want. Writes that fall into a
+// skipped file which does not exist yet are dropped instead of creating it.
+func (s *fileStorage) SkipFiles(skip []bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skip = skip
+}
+
+// open returns the handle for file i, creating the file if create is set.
+// It returns a nil file when i is skipped and does not exist.
+func (s *fileStorage) open(i int, create bool) (*os.File, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, ErrClosed
+	}
+	if s.handles[i] != nil {
+		return s.handles[i], nil
+	}
+	flag := os.O_RDWR
+	if create && i < len(s.skip) && s.skip[i] {
+		if _, err := os.Stat(s.paths[i]); errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		create = false
+	}
+	if create {
+		flag |= os.O_CREATE
+		if err := os.MkdirAll(filepath.Dir(s.paths[i]), os.ModePerm); err != nil {
+			return nil, err
+		}
+	}
+	f, err := os.OpenFile(s.paths[i], flag, 0666)
+	if err != nil {
+		return nil, err
+	}
+	s.handles[i] = f
+	return f, nil
+}
+
+func (s *fileStorage) ReadAt(index int, p []byte, off int64) (int, error) {
+	segs, err := s.info.segments(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seg := range segs {
+		f, err := s.open(seg.file, false)
+		if err != nil {
+			return n, err
+		}
+		read, err := f.ReadAt(p[n:n+seg.length], seg.offset)
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *fileStorage) WriteAt(index int, p []byte, off int64) (int, error) {
+	segs, err := s.info.segments(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seg := range segs {
+		f, err := s.open(seg.file, true)
+		if err != nil {
+			return n, err
+		}
+		if f == nil {
+			// Part of a boundary piece belonging to a skipped file
+			n += seg.length
+			continue
+		}
+		written, err := f.WriteAt(p[n:n+seg.length], seg.offset)
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// MarkComplete is a no-op: completion is tracked by the resume data, which
+// is validated against the files' modification times
+func (s *fileStorage) MarkComplete(index int) error {
+	return nil
+}
+
+func (s *fileStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+
+	var firstErr error
+	for i, f := range s.handles {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+		s.handles[i] = nil
+	}
+	return firstErr
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"sync"
+)
+
+// memoryStorage keeps a whole torrent in a byte slice
+type memoryStorage struct {
+	info Info
+
+	mu   sync.RWMutex
+	data []byte
+}
+
+// NewMemory returns a storage that keeps the torrent in memory
+func NewMemory(info Info) Storage {
+	return &memoryStorage{info: info, data: make([]byte, info.Length)}
+}
+
+func (s *memoryStorage) bounds(index int, off int64, n int) (int64, error) {
+	begin := int64(index)*int64(s.info.PieceLength) + off
+	if index < 0 || off < 0 || begin+int64(n) > int64(len(s.data)) {
+		return 0, ErrOutOfRange
+	}
+	return begin, nil
+}
+
+func (s *memoryStorage) ReadAt(index int, p []byte, off int64) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	if s.data == nil {
+		return 0, ErrClosed
+	}
+	begin, err := s.bounds(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(p, s.data[begin:]), nil
+}
+
+func (s *memoryStorage) WriteAt(index int, p []byte, off int64) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.data == nil {
+		return 0, ErrClosed
+	}
+	begin, err := s.bounds(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return copy(s.data[begin:], p), nil
+}
+
+func (s *memoryStorage) MarkComplete(index int) error {
+	return nil
+}
+
+func (s *memoryStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.data = nil
+	return nil
+}
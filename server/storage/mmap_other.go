@@ -0,0 +1,10 @@
+//go:build !(linux || darwin || freebsd || openbsd)
+
+package storage
+
+import "errors"
+
+// NewMmap is not supported on this platform
+func NewMmap(root string, info Info) (Storage, error) {
+	return nil, errors.New("storage: mmap is not supported on this platform")
+}
@@ -0,0 +1,231 @@
+//go:build linux || darwin || freebsd || openbsd
+
+package storage
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// mmapStorage maps the files of a torrent into memory, opening each one the
+// first time it is needed. Like fileStorage, reads never create files: a
+// file shorter than its full length is read with positional reads until the
+// first write extends and maps it.
+type mmapStorage struct {
+	info  Info
+	paths []string
+
+	mu     sync.RWMutex // Held for reading while a mapping is in use
+	closed bool
+	files  []*os.File
+	maps   [][]byte
+	skip   []bool // Files not to create, see SkipFiles
+}
+
+// NewMmap returns a storage backed by memory mapped files under root
+func NewMmap(root string, info Info) (Storage, error) {
+	return &mmapStorage{
+		info:  info,
+		paths: info.Paths(root),
+		files: make([]*os.File, len(info.Files)),
+		maps:  make([][]byte, len(info.Files)),
+	}, nil
+}
+
+// SkipFiles marks files the user does not want. Writes that fall into a
+// skipped file which does not exist yet are dropped instead of creating it.
+func (s *mmapStorage) SkipFiles(skip []bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.skip = skip
+}
+
+// open returns file i and its mapping. With create set, the file is created
+// and extended to its full length if needed and then mapped. Otherwise a
+// file too short to map is returned without a mapping. It returns a nil file
+// when i is skipped and does not exist.
+func (s *mmapStorage) open(i int, create bool) (*os.File, []byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.closed {
+		return nil, nil, ErrClosed
+	}
+	if s.maps[i] != nil {
+		return s.files[i], s.maps[i], nil
+	}
+	f := s.files[i]
+	if f == nil {
+		flag := os.O_RDWR
+		if create && i < len(s.skip) && s.skip[i] {
+			if _, err := os.Stat(s.paths[i]); errors.Is(err, os.ErrNotExist) {
+				return nil, nil, nil
+			}
+			create = false
+		}
+		if create {
+			flag |= os.O_CREATE
+			if err := os.MkdirAll(filepath.Dir(s.paths[i]), os.ModePerm); err != nil {
+				return nil, nil, err
+			}
+		}
+		var err error
+		if f, err = os.OpenFile(s.paths[i], flag, 0666); err != nil {
+			return nil, nil, err
+		}
+		s.files[i] = f
+	}
+
+	// Empty files cannot be mapped and have nothing to store
+	length := s.info.Files[i].Length
+	if length == 0 {
+		return f, nil, nil
+	}
+	// Touching a mapping past the end of its file faults, so short files
+	// are only mapped once a write extends them
+	stat, err := f.Stat()
+	if err != nil {
+		return nil, nil, err
+	}
+	if stat.Size() < length {
+		if !create {
+			return f, nil, nil
+		}
+		if err := f.Truncate(length); err != nil {
+			return nil, nil, err
+		}
+	}
+	data, err := syscall.Mmap(int(f.Fd()), 0, int(length), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+	if err != nil {
+		return nil, nil, err
+	}
+	s.maps[i] = data
+	return f, data, nil
+}
+
+// copyMapped copies src to dst, one of which is a mapping, failing if the
+// storage was closed and its mappings released in the meantime
+func (s *mmapStorage) copyMapped(dst, src []byte) (int, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return 0, ErrClosed
+	}
+	return copy(dst, src), nil
+}
+
+func (s *mmapStorage) ReadAt(index int, p []byte, off int64) (int, error) {
+	segs, err := s.info.segments(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seg := range segs {
+		f, data, err := s.open(seg.file, false)
+		if err != nil {
+			return n, err
+		}
+		var read int
+		if data != nil {
+			read, err = s.copyMapped(p[n:n+seg.length], data[seg.offset:])
+		} else {
+			read, err = f.ReadAt(p[n:n+seg.length], seg.offset)
+		}
+		n += read
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+func (s *mmapStorage) WriteAt(index int, p []byte, off int64) (int, error) {
+	segs, err := s.info.segments(index, off, len(p))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, seg := range segs {
+		f, data, err := s.open(seg.file, true)
+		if err != nil {
+			return n, err
+		}
+		if f == nil {
+			// Part of a boundary piece belonging to a skipped file
+			n += seg.length
+			continue
+		}
+		written, err := s.copyMapped(data[seg.offset:seg.offset+int64(seg.length)], p[n:])
+		n += written
+		if err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// MarkComplete flushes the pages holding a verified piece back to disk
+func (s *mmapStorage) MarkComplete(index int) error {
+	length := s.info.PieceLength
+	if rest := s.info.Length - int64(index)*int64(length); rest < int64(length) {
+		length = int(rest)
+	}
+	segs, err := s.info.segments(index, 0, length)
+	if err != nil {
+		return err
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.closed {
+		return ErrClosed
+	}
+	pageSize := int64(os.Getpagesize())
+	for _, seg := range segs {
+		// Skipped parts of boundary pieces were never written
+		data := s.maps[seg.file]
+		if data == nil {
+			continue
+		}
+		begin := seg.offset - seg.offset%pageSize
+		region := data[begin : seg.offset+int64(seg.length)]
+		if len(region) == 0 {
+			continue
+		}
+		_, _, errno := syscall.Syscall(syscall.SYS_MSYNC, uintptr(unsafe.Pointer(&region[0])), uintptr(len(region)), syscall.MS_SYNC)
+		if errno != 0 {
+			return errno
+		}
+	}
+	return nil
+}
+
+func (s *mmapStorage) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var firstErr error
+	for _, data := range s.maps {
+		if data == nil {
+			continue
+		}
+		if err := syscall.Munmap(data); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	for _, f := range s.files {
+		if f == nil {
+			continue
+		}
+		if err := f.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	s.closed = true
+	s.maps, s.files = nil, nil
+	return firstErr
+}
@@ -0,0 +1,121 @@
+package storage
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+)
+
+// ErrDestinationExists is returned by Move when something is already at
+// the destination
+var ErrDestinationExists = errors.New("storage: destination already exists")
+
+// Move moves the data at from to to. It renames when both are on the same
+// filesystem, and otherwise copies, verifies the copy against the original
+// and only then deletes the original. Moving data that does not exist yet
+// does nothing.
+func Move(from, to string) error {
+	if _, err := os.Lstat(from); errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if _, err := os.Lstat(to); err == nil {
+		return fmt.Errorf("%w: %s", ErrDestinationExists, to)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), os.ModePerm); err != nil {
+		return err
+	}
+
+	err := os.Rename(from, to)
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+
+	// Different filesystems, copy instead
+	if err := copyTree(from, to); err != nil {
+		os.RemoveAll(to)
+		return fmt.Errorf("failed to copy %s to %s: %v", from, to, err)
+	}
+	return os.RemoveAll(from)
+}
+
+// copyTree copies the directories and regular files under from to to,
+// keeping their modification times so resume data stays valid
+func copyTree(from, to string) error {
+	return filepath.WalkDir(from, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(from, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(to, rel)
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		switch {
+		case d.IsDir():
+			return os.MkdirAll(target, info.Mode().Perm())
+		case info.Mode().IsRegular():
+			if err := copyFile(path, target, info.Mode().Perm()); err != nil {
+				return err
+			}
+			return os.Chtimes(target, info.ModTime(), info.ModTime())
+		}
+		return fmt.Errorf("cannot copy %s, not a regular file", path)
+	})
+}
+
+// copyFile copies a file and checks the copy on disk hashes the same
+func copyFile(from, to string, perm fs.FileMode) error {
+	src, err := os.Open(from)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	dst, err := os.OpenFile(to, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	hash := sha1.New()
+	_, err = io.Copy(dst, io.TeeReader(src, hash))
+	if err == nil {
+		err = dst.Sync()
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	copied, err := hashFile(to)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(copied, hash.Sum(nil)) {
+		return fmt.Errorf("copy of %s does not match the original", from)
+	}
+	return nil
+}
+
+func hashFile(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	hash := sha1.New()
+	if _, err := io.Copy(hash, f); err != nil {
+		return nil, err
+	}
+	return hash.Sum(nil), nil
+}
@@ -0,0 +1,14 @@
+package storage
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate reserves length bytes for f with fallocate
+func preallocate(f *os.File, length int64) error {
+	if length == 0 {
+		return nil
+	}
+	return syscall.Fallocate(int(f.Fd()), 0, 0, length)
+}
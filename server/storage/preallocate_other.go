@@ -0,0 +1,25 @@
+//go:build !linux
+
+package storage
+
+import "os"
+
+// preallocate writes zeros over the missing part of f where fallocate is not
+// available, so the blocks are reserved all the same
+func preallocate(f *os.File, length int64) error {
+	stat, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	zeros := make([]byte, 1<<20)
+	for offset := stat.Size(); offset < length; offset += int64(len(zeros)) {
+		chunk := zeros
+		if rest := length - offset; rest < int64(len(chunk)) {
+			chunk = chunk[:rest]
+		}
+		if _, err := f.WriteAt(chunk, offset); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,140 @@
+package storage
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+)
+
+// Storage keeps the pieces of a single torrent. Offsets passed to ReadAt and
+// WriteAt are relative to the start of the piece.
+type Storage interface {
+	ReadAt(index int, p []byte, off int64) (int, error)
+	WriteAt(index int, p []byte, off int64) (int, error)
+	// MarkComplete is called once a piece has passed its hash check
+	MarkComplete(index int) error
+	Close() error
+}
+
+// Kind selects a storage implementation for a torrent
+type Kind string
+
+const (
+	// KindFile stores pieces in regular files using positional reads and writes
+	KindFile Kind = "file"
+	// KindMmap stores pieces in memory mapped files
+	KindMmap Kind = "mmap"
+	// KindMemory keeps pieces in memory only, mainly for tests
+	KindMemory Kind = "memory"
+)
+
+// Options choose how a torrent is stored
+type Options struct {
+	Kind       Kind       `json:"kind"`
+	Allocation Allocation `json:"allocation"`
+	CacheSize  int64      `json:"cache_size"` // Bytes of write-back cache, 0 disables it
+}
+
+// ParseKind validates a storage kind, defaulting to KindFile when empty
+func ParseKind(s string) (Kind, error) {
+	switch Kind(s) {
+	case "":
+		return KindFile, nil
+	case KindFile, KindMmap, KindMemory:
+		return Kind(s), nil
+	}
+	return "", fmt.Errorf("unknown storage kind %q", s)
+}
+
+// File is a single file of a torrent. Path is relative to the torrent's root
+// and empty for single file torrents, where the root is the file itself.
+type File struct {
+	Path   string
+	Length int64
+}
+
+// Info describes how a torrent's pieces map onto its files
+type Info struct {
+	PieceLength int
+	Length      int64
+	Files       []File
+}
+
+// Paths returns the location of every file of the torrent under root
+func (info Info) Paths(root string) []string {
+	paths := make([]string, len(info.Files))
+	for i, f := range info.Files {
+		paths[i] = filepath.Join(root, f.Path)
+	}
+	return paths
+}
+
+// FilePieces returns the first and last piece overlapping file i. Empty
+// files overlap no piece and report ok as false.
+func (info Info) FilePieces(i int) (first, last int, ok bool) {
+	var begin int64
+	for _, f := range info.Files[:i] {
+		begin += f.Length
+	}
+	length := info.Files[i].Length
+	if length == 0 {
+		return 0, 0, false
+	}
+	first = int(begin / int64(info.PieceLength))
+	last = int((begin + length - 1) / int64(info.PieceLength))
+	return first, last, true
+}
+
+// Open creates the storage of the given kind for a torrent rooted at root
+func Open(kind Kind, root string, info Info) (Storage, error) {
+	switch kind {
+	case KindFile, "":
+		if len(info.Files) == 1 && info.Files[0].Path == "" {
+			return NewFile(root, info), nil
+		}
+		return NewMultiFile(root, info), nil
+	case KindMmap:
+		return NewMmap(root, info)
+	case KindMemory:
+		return NewMemory(info), nil
+	}
+	return nil, fmt.Errorf("unknown storage kind %q", kind)
+}
+
+// ErrOutOfRange is returned for reads and writes past the end of the torrent
+var ErrOutOfRange = errors.New("storage: offset out of range")
+
+// ErrClosed is returned when a storage is used after Close
+var ErrClosed = errors.New("storage: closed")
+
+// segment is the part of a read or write that falls within a single file
+type segment struct {
+	file   int
+	offset int64
+	length int
+}
+
+// segments splits n bytes at off within piece index into per file segments
+func (info Info) segments(index int, off int64, n int) ([]segment, error) {
+	begin := int64(index)*int64(info.PieceLength) + off
+	if index < 0 || off < 0 || begin+int64(n) > info.Length {
+		return nil, ErrOutOfRange
+	}
+
+	segs := []segment{}
+	var fileBegin int64
+	for i, f := range info.Files {
+		fileEnd := fileBegin + f.Length
+		if n > 0 && begin < fileEnd {
+			length := fileEnd - begin
+			if length > int64(n) {
+				length = int64(n)
+			}
+			segs = append(segs, segment{i, begin - fileBegin, int(length)})
+			begin += length
+			n -= int(length)
+		}
+		fileBegin = fileEnd
+	}
+	return segs, nil
+}
@@ -0,0 +1,245 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// testInfo is three files of 5, 0 and 9 bytes in pieces of 4, so pieces 1
+// and 3 straddle file boundaries and piece 1 also spans the empty file
+var testInfo = Info{
+	PieceLength: 4,
+	Length:      14,
+	Files: []File{
+		{Path: "a", Length: 5},
+		{Path: "empty", Length: 0},
+		{Path: filepath.Join("dir", "b"), Length: 9},
+	},
+}
+
+func TestSegments(t *testing.T) {
+	tests := []struct {
+		name  string
+		index int
+		off   int64
+		n     int
+		want  []segment
+		err   error
+	}{
+		{"first piece", 0, 0, 4, []segment{{0, 0, 4}}, nil},
+		{"across a boundary", 1, 0, 4, []segment{{0, 4, 1}, {2, 0, 3}}, nil},
+		{"offset into the second file", 1, 2, 2, []segment{{2, 1, 2}}, nil},
+		{"short last piece", 3, 0, 2, []segment{{2, 7, 2}}, nil},
+		{"empty read", 2, 0, 0, []segment{}, nil},
+		{"past the end", 3, 0, 3, nil, ErrOutOfRange},
+		{"negative offset", 1, -1, 1, nil, ErrOutOfRange},
+		{"negative index", -1, 0, 1, nil, ErrOutOfRange},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := testInfo.segments(tt.index, tt.off, tt.n)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("segments() error = %v, want %v", err, tt.err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("segments() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFilePieces(t *testing.T) {
+	tests := []struct {
+		file        int
+		first, last int
+		ok          bool
+	}{
+		{0, 0, 1, true},
+		{1, 0, 0, false},
+		{2, 1, 3, true},
+	}
+	for _, tt := range tests {
+		first, last, ok := testInfo.FilePieces(tt.file)
+		if first != tt.first || last != tt.last || ok != tt.ok {
+			t.Errorf("FilePieces(%d) = %d, %d, %t, want %d, %d, %t", tt.file, first, last, ok, tt.first, tt.last, tt.ok)
+		}
+	}
+}
+
+// testData is the torrent's whole content
+var testData = []byte("hello, world!\n")
+
+func writePieces(t *testing.T, s Storage) {
+	t.Helper()
+	for index := 0; index*testInfo.PieceLength < len(testData); index++ {
+		begin := index * testInfo.PieceLength
+		end := min(begin+testInfo.PieceLength, len(testData))
+		if n, err := s.WriteAt(index, testData[begin:end], 0); err != nil || n != end-begin {
+			t.Fatalf("WriteAt(%d) = %d, %v", index, n, err)
+		}
+		if err := s.MarkComplete(index); err != nil {
+			t.Fatalf("MarkComplete(%d): %v", index, err)
+		}
+	}
+}
+
+func readAll(t *testing.T, s Storage) []byte {
+	t.Helper()
+	got := make([]byte, 0, len(testData))
+	for index := 0; index*testInfo.PieceLength < len(testData); index++ {
+		begin := index * testInfo.PieceLength
+		buf := make([]byte, min(testInfo.PieceLength, len(testData)-begin))
+		if n, err := s.ReadAt(index, buf, 0); err != nil || n != len(buf) {
+			t.Fatalf("ReadAt(%d) = %d, %v", index, n, err)
+		}
+		got = append(got, buf...)
+	}
+	return got
+}
+
+func TestRoundTrip(t *testing.T) {
+	backends := []struct {
+		name  string
+		open  func(root string) (Storage, error)
+		files bool // Whether the data ends up on disk
+	}{
+		{"file", func(root string) (Storage, error) { return Open(KindFile, root, testInfo) }, true},
+		{"mmap", func(root string) (Storage, error) { return Open(KindMmap, root, testInfo) }, true},
+		{"memory", func(root string) (Storage, error) { return Open(KindMemory, root, testInfo) }, false},
+		{"cache", func(root string) (Storage, error) {
+			inner, err := Open(KindFile, root, testInfo)
+			if err != nil {
+				return nil, err
+			}
+			return NewCache(inner, testInfo, 8), nil
+		}, true},
+	}
+	for _, b := range backends {
+		t.Run(b.name, func(t *testing.T) {
+			root := t.TempDir()
+			s, err := b.open(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writePieces(t, s)
+			if got := readAll(t, s); !bytes.Equal(got, testData) {
+				t.Errorf("read back %q, want %q", got, testData)
+			}
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if !b.files {
+				return
+			}
+
+			// The data is on disk where a reopened storage finds it
+			if data, err := os.ReadFile(filepath.Join(root, "dir", "b")); err != nil || !bytes.Equal(data, testData[5:]) {
+				t.Errorf("dir/b = %q, %v, want %q", data, err, testData[5:])
+			}
+			s, err = b.open(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if got := readAll(t, s); !bytes.Equal(got, testData) {
+				t.Errorf("reopened read %q, want %q", got, testData)
+			}
+		})
+	}
+}
+
+func TestClosed(t *testing.T) {
+	for _, kind := range []Kind{KindFile, KindMmap, KindMemory} {
+		t.Run(string(kind), func(t *testing.T) {
+			s, err := Open(kind, t.TempDir(), testInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			writePieces(t, s)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := s.ReadAt(0, make([]byte, 4), 0); !errors.Is(err, ErrClosed) {
+				t.Errorf("ReadAt() after Close() error = %v, want ErrClosed", err)
+			}
+			if _, err := s.WriteAt(0, testData[:4], 0); !errors.Is(err, ErrClosed) {
+				t.Errorf("WriteAt() after Close() error = %v, want ErrClosed", err)
+			}
+		})
+	}
+}
+
+func TestReadsDoNotCreateFiles(t *testing.T) {
+	for _, kind := range []Kind{KindFile, KindMmap} {
+		t.Run(string(kind), func(t *testing.T) {
+			root := t.TempDir()
+			s, err := Open(kind, root, testInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			if _, err := s.ReadAt(0, make([]byte, 4), 0); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("ReadAt() error = %v, want os.ErrNotExist", err)
+			}
+			if entries, _ := os.ReadDir(root); len(entries) != 0 {
+				t.Errorf("reading created %d entries", len(entries))
+			}
+		})
+	}
+}
+
+func TestSkipFiles(t *testing.T) {
+	for _, kind := range []Kind{KindFile, KindMmap} {
+		t.Run(string(kind), func(t *testing.T) {
+			root := t.TempDir()
+			s, err := Open(kind, root, testInfo)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			SkipFiles(s, []bool{true, false, false})
+
+			// Piece 1 is mostly the wanted file, its head is dropped
+			if n, err := s.WriteAt(1, testData[4:8], 0); err != nil || n != 4 {
+				t.Fatalf("WriteAt() = %d, %v", n, err)
+			}
+			if err := s.MarkComplete(1); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(root, "a")); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("skipped file was created: %v", err)
+			}
+			buf := make([]byte, 3)
+			if _, err := s.ReadAt(1, buf, 1); err != nil || string(buf) != string(testData[5:8]) {
+				t.Errorf("ReadAt() = %q, %v", buf, err)
+			}
+		})
+	}
+}
+
+func TestMmapReadsShortFiles(t *testing.T) {
+	root := t.TempDir()
+	// A partly downloaded file is read without being extended
+	if err := os.WriteFile(filepath.Join(root, "a"), testData[:3], 0666); err != nil {
+		t.Fatal(err)
+	}
+	s, err := Open(KindMmap, root, testInfo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	buf := make([]byte, 4)
+	if n, _ := s.ReadAt(0, buf, 0); n != 3 || string(buf[:n]) != string(testData[:3]) {
+		t.Errorf("ReadAt() = %d %q", n, buf[:n])
+	}
+	if info, err := os.Stat(filepath.Join(root, "a")); err != nil {
+		t.Fatal(err)
+	} else if info.Size() != 3 {
+		t.Errorf("a read resized the file to %d bytes", info.Size())
+	}
+}
@@ -0,0 +1,87 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"strconv"
+)
+
+// maxDepth bounds the nesting of lists and dictionaries skipValue follows
+const maxDepth = 64
+
+var errMalformed = errors.New("malformed bencode")
+
+// infoBytes returns the encoded info dictionary of bencoded metainfo, as it
+// appears in data
+func infoBytes(data []byte) ([]byte, error) {
+	if len(data) == 0 || data[0] != 'd' {
+		return nil, errMalformed
+	}
+	pos := 1
+	for pos < len(data) && data[pos] != 'e' {
+		key, next, err := bencodeString(data, pos)
+		if err != nil {
+			return nil, err
+		}
+		end, err := skipValue(data, next, 0)
+		if err != nil {
+			return nil, err
+		}
+		if key == "info" {
+			return data[next:end], nil
+		}
+		pos = end
+	}
+	return nil, errors.New("no info dictionary")
+}
+
+// bencodeString decodes the string starting at pos, returning it and the
+// position after it
+func bencodeString(data []byte, pos int) (string, int, error) {
+	colon := bytes.IndexByte(data[pos:], ':')
+	if colon < 1 {
+		return "", 0, errMalformed
+	}
+	n, err := strconv.Atoi(string(data[pos : pos+colon]))
+	start := pos + colon + 1
+	if err != nil || n < 0 || n > len(data)-start {
+		return "", 0, errMalformed
+	}
+	return string(data[start : start+n]), start + n, nil
+}
+
+// skipValue returns the position after the value starting at pos
+func skipValue(data []byte, pos, depth int) (int, error) {
+	if pos >= len(data) || depth > maxDepth {
+		return 0, errMalformed
+	}
+	switch c := data[pos]; {
+	case c == 'i':
+		end := bytes.IndexByte(data[pos:], 'e')
+		if end < 2 {
+			return 0, errMalformed
+		}
+		return pos + end + 1, nil
+	case c == 'l' || c == 'd':
+		pos++
+		for pos < len(data) && data[pos] != 'e' {
+			var err error
+			if c == 'd' {
+				if _, pos, err = bencodeString(data, pos); err != nil {
+					return 0, err
+				}
+			}
+			if pos, err = skipValue(data, pos, depth+1); err != nil {
+				return 0, err
+			}
+		}
+		if pos >= len(data) {
+			return 0, errMalformed
+		}
+		return pos + 1, nil
+	case c >= '0' && c <= '9':
+		_, end, err := bencodeString(data, pos)
+		return end, err
+	}
+	return 0, errMalformed
+}
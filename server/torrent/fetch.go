@@ -0,0 +1,60 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Limits on .torrent files fetched from URLs
+const (
+	MaxFetchSize = 10 << 20
+	FetchTimeout = 30 * time.Second
+)
+
+var (
+	// ErrInvalidURL is returned by Fetch for URLs it will not fetch
+	ErrInvalidURL = errors.New("invalid torrent url")
+	// ErrTooLarge is returned by Fetch for files over MaxFetchSize
+	ErrTooLarge = errors.New("torrent file is too large")
+)
+
+var fetchClient = &http.Client{Timeout: FetchTimeout}
+
+// Fetch downloads a .torrent file from an http or https URL and checks
+// that it parses, returning its contents along with the parsed metainfo
+func Fetch(rawURL string) ([]byte, TorrentFile, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, TorrentFile{}, fmt.Errorf("%w: %q", ErrInvalidURL, rawURL)
+	}
+
+	res, err := fetchClient.Get(u.String())
+	if err != nil {
+		return nil, TorrentFile{}, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, TorrentFile{}, fmt.Errorf("fetching %s: %s", rawURL, res.Status)
+	}
+	if res.ContentLength > MaxFetchSize {
+		return nil, TorrentFile{}, fmt.Errorf("%w: over %d bytes", ErrTooLarge, MaxFetchSize)
+	}
+	data, err := io.ReadAll(io.LimitReader(res.Body, MaxFetchSize+1))
+	if err != nil {
+		return nil, TorrentFile{}, err
+	}
+	if len(data) > MaxFetchSize {
+		return nil, TorrentFile{}, fmt.Errorf("%w: over %d bytes", ErrTooLarge, MaxFetchSize)
+	}
+
+	meta, err := Parse(bytes.NewReader(data))
+	if err != nil {
+		return nil, TorrentFile{}, err
+	}
+	return data, meta, nil
+}
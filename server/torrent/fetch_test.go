@@ -0,0 +1,110 @@
+package torrent
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jackpal/bencode-go"
+)
+
+func testMetainfo(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	bto := bencodeTorrent{
+		Announce: "http://tracker.example/announce",
+		Info:     bencodeInfo{Pieces: strings.Repeat("x", 40), PieceLength: 16384, Length: 20000, Name: "debian.iso"},
+	}
+	if err := bencode.Marshal(&buf, bto); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestFetch(t *testing.T) {
+	metainfo := testMetainfo(t)
+	release := make(chan struct{})
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debian.torrent", func(w http.ResponseWriter, r *http.Request) {
+		w.Write(metainfo)
+	})
+	mux.HandleFunc("/missing.torrent", http.NotFound)
+	mux.HandleFunc("/page.torrent", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html><body>Not a torrent</body></html>"))
+	})
+	mux.HandleFunc("/declared-large.torrent", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "20000000")
+		w.Write(metainfo)
+	})
+	mux.HandleFunc("/large.torrent", func(w http.ResponseWriter, r *http.Request) {
+		// Written in chunks so no length is sent up front
+		chunk := make([]byte, 1<<20)
+		for i := 0; i <= MaxFetchSize>>20; i++ {
+			if _, err := w.Write(chunk); err != nil {
+				return
+			}
+			w.(http.Flusher).Flush()
+		}
+	})
+	mux.HandleFunc("/slow.torrent", func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	})
+	srv := httptest.NewServer(mux)
+	defer srv.Close()
+	defer close(release)
+
+	client := fetchClient
+	defer func() { fetchClient = client }()
+
+	tests := []struct {
+		name    string
+		url     string
+		err     error // Sentinel the error wraps, nil to only check that it fails
+		ok      bool
+		timeout time.Duration
+	}{
+		{"valid", srv.URL + "/debian.torrent", nil, true, 0},
+		{"not http", "ftp://example.com/debian.torrent", ErrInvalidURL, false, 0},
+		{"no host", "http:///debian.torrent", ErrInvalidURL, false, 0},
+		{"not found", srv.URL + "/missing.torrent", nil, false, 0},
+		{"not bencode", srv.URL + "/page.torrent", ErrInvalid, false, 0},
+		{"declared too large", srv.URL + "/declared-large.torrent", ErrTooLarge, false, 0},
+		{"too large", srv.URL + "/large.torrent", ErrTooLarge, false, 0},
+		{"slow server", srv.URL + "/slow.torrent", nil, false, 200 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetchClient = client
+			if tt.timeout > 0 {
+				fetchClient = &http.Client{Timeout: tt.timeout}
+			}
+			start := time.Now()
+			data, meta, err := Fetch(tt.url)
+			if took := time.Since(start); took > 5*time.Second {
+				t.Errorf("Fetch() took %s", took)
+			}
+			if tt.ok {
+				if err != nil {
+					t.Fatalf("Fetch() error = %v", err)
+				}
+				if !bytes.Equal(data, metainfo) || meta.Name != "debian.iso" || len(meta.PieceHashes) != 2 {
+					t.Errorf("Fetch() = %d bytes, %+v", len(data), meta)
+				}
+				return
+			}
+			if err == nil {
+				t.Fatal("Fetch() succeeded")
+			}
+			if tt.err != nil && !errors.Is(err, tt.err) {
+				t.Errorf("Fetch() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
@@ -1,32 +1,38 @@
 package torrent
 
 import (
+	"bit_torrent/bitfield"
 	"bit_torrent/p2p"
 	"bit_torrent/peers"
+	"bit_torrent/resume"
+	"bit_torrent/storage"
 	"bytes"
 	"crypto/rand"
 	"crypto/sha1"
 	"encoding/binary"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
 
 	"github.com/jackpal/bencode-go"
 )
 
 type bencodeInfo struct {
-	Pieces      string `bencode:"pieces"`
-	PieceLength int    `bencode:"piece length"`
-	Length      int    `bencode:"length"`
-	Name        string `bencode:"name"`
+	Pieces      string        `bencode:"pieces"`
+	PieceLength int           `bencode:"piece length"`
+	Length      int           `bencode:"length,omitempty"`
+	Files       []FileDetails `bencode:"files,omitempty"`
+	Name        string        `bencode:"name"`
 }
 
 type bencodeTorrent struct {
@@ -46,6 +52,7 @@ type TorrentFile struct {
 	PieceLength int
 	Length      int
 	Name        string
+	Files       []FileDetails // Empty for single file torrents
 }
 
 type bencodeTrackerResp struct {
@@ -53,44 +60,41 @@ type bencodeTrackerResp struct {
 	Peers    string `bencode:"peers"`
 }
 
-const Port uint16 = 6881
+// Port is the TCP port announced to trackers, where incoming peers connect
+var Port uint16 = 6881
 
-const udpPort uint16 = 6882
-
-// TorrentMap manages a thread-safe map of torrents
-type TorrentMap struct {
-	sync.Mutex
-	m map[string]*p2p.Torrent
-}
-
-// NewTorrentMap initializes and returns a new TorrentMap
-func NewTorrentMap() *TorrentMap {
-	return &TorrentMap{
-		m: make(map[string]*p2p.Torrent),
+func Open(path string) (TorrentFile, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return TorrentFile{}, err
 	}
+	defer file.Close()
+	return Parse(file)
 }
 
-func Open(path string) (TorrentFile, error) {
-	file, err := os.Open(path)
+// ErrInvalid is returned by Parse for data that is not valid metainfo
+var ErrInvalid = errors.New("invalid torrent file")
+
+// Parse reads bencoded metainfo. The infohash is taken over the info
+// dictionary exactly as it was encoded, keeping keys this client ignores.
+func Parse(r io.Reader) (TorrentFile, error) {
+	data, err := io.ReadAll(r)
 	if err != nil {
 		return TorrentFile{}, err
 	}
 	bto := bencodeTorrent{}
-	err1 := bencode.Unmarshal(file, &bto)
-	if err1 != nil {
-		return TorrentFile{}, err
+	if err := bencode.Unmarshal(bytes.NewReader(data), &bto); err != nil {
+		return TorrentFile{}, fmt.Errorf("%w: %v", ErrInvalid, err)
 	}
-	return bto.toTorrentFile()
-}
-
-func (i *bencodeInfo) hash() ([20]byte, error) {
-	var buf bytes.Buffer
-	err := bencode.Marshal(&buf, *i)
+	info, err := infoBytes(data)
 	if err != nil {
-		return [20]byte{}, err
+		return TorrentFile{}, fmt.Errorf("%w: %v", ErrInvalid, err)
 	}
-	h := sha1.Sum(buf.Bytes())
-	return h, nil
+	t, err := bto.toTorrentFile(sha1.Sum(info))
+	if err != nil {
+		return TorrentFile{}, fmt.Errorf("%w: %v", ErrInvalid, err)
+	}
+	return t, nil
 }
 
 func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
@@ -109,29 +113,70 @@ func (i *bencodeInfo) splitPieceHashes() ([][20]byte, error) {
 	return hashes, nil
 }
 
-func (bto *bencodeTorrent) toTorrentFile() (TorrentFile, error) {
-	infoHash, err := bto.Info.hash()
-	if err != nil {
-		return TorrentFile{}, err
-	}
+func (bto *bencodeTorrent) toTorrentFile(infoHash [20]byte) (TorrentFile, error) {
 	pieceHashes, err := bto.Info.splitPieceHashes()
 	if err != nil {
 		return TorrentFile{}, err
 	}
 
+	length := bto.Info.Length
+	for _, f := range bto.Info.Files {
+		if err := validateFilePath(f.Path); err != nil {
+			return TorrentFile{}, err
+		}
+		length += f.Length
+	}
+
 	t := TorrentFile{
 		Announce:    bto.Announce,
 		InfoHash:    infoHash,
 		PieceHashes: pieceHashes,
 		PieceLength: bto.Info.PieceLength,
-		Length:      bto.Info.Length,
+		Length:      length,
 		Name:        bto.Info.Name,
+		Files:       bto.Info.Files,
 	}
 
 	return t, nil
 }
 
-func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, error) {
+// validateFilePath rejects file paths that would escape the torrent's folder
+func validateFilePath(path []string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("received file with empty path")
+	}
+	for _, part := range path {
+		if part == "" || part == "." || part == ".." || strings.ContainsAny(part, "/\\") {
+			return fmt.Errorf("received unsafe file path %q", strings.Join(path, "/"))
+		}
+	}
+	return nil
+}
+
+// StorageInfo describes how the torrent's pieces map onto its files
+func (t *TorrentFile) StorageInfo() storage.Info {
+	info := storage.Info{PieceLength: t.PieceLength, Length: int64(t.Length)}
+	if len(t.Files) == 0 {
+		info.Files = []storage.File{{Length: int64(t.Length)}}
+		return info
+	}
+	for _, f := range t.Files {
+		info.Files = append(info.Files, storage.File{Path: filepath.Join(f.Path...), Length: int64(f.Length)})
+	}
+	return info
+}
+
+// Tracker events sent with an announce, a regular announce sends none
+const (
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventStopped   = "stopped"
+)
+
+// udpEvents maps tracker events to their codes in UDP announces
+var udpEvents = map[string]uint32{"": 0, EventCompleted: 1, EventStarted: 2, EventStopped: 3}
+
+func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16, event string, uploaded, downloaded, left int64) (string, error) {
 	base, err := url.Parse(t.Announce)
 	if err != nil {
 		return "", err
@@ -140,17 +185,20 @@ func (t *TorrentFile) buildTrackerURL(peerID [20]byte, port uint16) (string, err
 		"info_hash":  []string{string(t.InfoHash[:])},
 		"peer_id":    []string{string(peerID[:])},
 		"port":       []string{strconv.Itoa(int(port))},
-		"uploaded":   []string{"0"},
-		"downloaded": []string{"0"},
+		"uploaded":   []string{strconv.FormatInt(uploaded, 10)},
+		"downloaded": []string{strconv.FormatInt(downloaded, 10)},
 		"compact":    []string{"1"},
-		"left":       []string{strconv.Itoa(t.Length)},
+		"left":       []string{strconv.FormatInt(left, 10)},
+	}
+	if event != "" {
+		params.Set("event", event)
 	}
 	base.RawQuery = params.Encode()
 	return base.String(), nil
 }
 
-func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer, error) {
-	url, err := t.buildTrackerURL(peerID, port)
+func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16, event string, uploaded, downloaded, left int64) ([]peers.Peer, error) {
+	url, err := t.buildTrackerURL(peerID, port, event, uploaded, downloaded, left)
 	fmt.Println(url)
 	if err != nil {
 		return nil, err
@@ -173,95 +221,204 @@ func (t *TorrentFile) requestPeers(peerID [20]byte, port uint16) ([]peers.Peer,
 	return peers.Unmarshal([]byte(trackerResp.Peers))
 }
 
-func loadOrCreateDownloadStatus(filePath string) (p2p.DownloadStatus, error) {
-	var status p2p.DownloadStatus
-	status.Pieces = make(map[int]bool)
-
-	// Check if the file exists
-	if _, err := os.Stat(filePath); err == nil {
-		// File exists, load the status
-		file, err := os.Open(filePath)
-		if err != nil {
-			return status, fmt.Errorf("failed to open download status file: %v", err)
+// LoadResumeData restores the torrent's progress from its resume file. When
+// the file is missing, unreadable or stale but data already exists in the
+// torrent's storage, the data is rechecked instead of being trusted or
+// discarded, reporting to progressChan if it is not nil.
+func LoadResumeData(torrent *p2p.Torrent, resumeFilePath string, progressChan chan<- p2p.RecheckProgress) error {
+	torrent.SetStatus(make(map[int]bool))
+
+	data, err := resume.Load(resumeFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		if !anyFileExists(torrent.Files) {
+			// Nothing downloaded yet
+			return nil
 		}
-		defer file.Close()
+		log.Printf("No resume data for %s, rechecking existing data\n", torrent.Name)
+		return torrent.Recheck(progressChan, resumeFilePath)
+	}
+	if err == nil {
+		// Keep the transfer totals even if the pieces have to be rechecked
+		torrent.RestoreTotals(data)
 
-		decoder := json.NewDecoder(file)
-		if err := decoder.Decode(&status); err != nil {
-			return status, fmt.Errorf("failed to decode download status: %v", err)
+		files, statErr := resume.StatFiles(torrent.Files...)
+		if statErr != nil {
+			return statErr
 		}
-	} else if os.IsNotExist(err) {
-		// File does not exist, return empty status
-		return status, nil
-	} else {
-		return status, fmt.Errorf("error checking download status file: %v", err)
+		err = resume.Validate(data, torrent.InfoHash, len(torrent.PieceHashes), files)
+	}
+	if err != nil {
+		log.Printf("Rechecking %s: %v\n", torrent.Name, err)
+		return torrent.Recheck(progressChan, resumeFilePath)
 	}
 
-	return status, nil
+	status := make(map[int]bool)
+	for index := range torrent.PieceHashes {
+		if data.Bitfield.HasPiece(index) {
+			status[index] = true
+		}
+	}
+	torrent.SetStatus(status)
+	torrent.SetPartial(data.Partial)
+	return nil
 }
 
-func (t *TorrentFile) DownloadToFile(path string, progressChan chan<- p2p.ProgressData, torrentMap *TorrentMap, uploadFolderPath string, progressFilePath string) error {
-	var peerID [20]byte
-	_, err := rand.Read(peerID[:])
+// MarkComplete writes resume data marking every piece of the data at path
+// as verified without hashing it, for data known to be complete. It fails
+// unless every file is on disk at its full size.
+func (t *TorrentFile) MarkComplete(path string, resumeFilePath string) error {
+	info := t.StorageInfo()
+	paths := info.Paths(path)
+	files, err := resume.StatFiles(paths...)
 	if err != nil {
 		return err
 	}
-	p := []peers.Peer{}
-	if strings.HasPrefix(t.Announce, "udp") {
-		GetPeers(*t, func(peers []peers.Peer) {
-			p = peers
-		})
+	for i, f := range info.Files {
+		if files[i].Size != f.Length {
+			return fmt.Errorf("%s is missing or not %d bytes long", paths[i], f.Length)
+		}
+	}
 
-	} else {
-		p, err = t.requestPeers(peerID, Port)
-		if err != nil {
-			return err
+	bf := make(bitfield.Bitfield, (len(t.PieceHashes)+7)/8)
+	for index := range t.PieceHashes {
+		bf.SetPiece(index)
+	}
+	return resume.Save(resumeFilePath, &resume.Data{
+		InfoHash:  t.InfoHash,
+		NumPieces: len(t.PieceHashes),
+		Bitfield:  bf,
+		Files:     files,
+	})
+}
+
+// LoadTotals restores only the transfer totals from the resume file, for a
+// torrent whose pieces are about to be rechecked anyway
+func LoadTotals(torrent *p2p.Torrent, resumeFilePath string) {
+	if data, err := resume.Load(resumeFilePath); err == nil && data.InfoHash == torrent.InfoHash {
+		torrent.RestoreTotals(data)
+	}
+}
+
+func anyFileExists(paths []string) bool {
+	for _, path := range paths {
+		if _, err := os.Stat(path); err == nil {
+			return true
 		}
 	}
+	return false
+}
 
-	// Load or create the download status map
-	status, err := loadOrCreateDownloadStatus(progressFilePath)
+// NewTorrent prepares a p2p.Torrent whose data is kept at path in storage
+// described by opts. The caller must close its Storage.
+func (t *TorrentFile) NewTorrent(path string, opts storage.Options) (*p2p.Torrent, error) {
+	info := t.StorageInfo()
+	store, err := storage.Open(opts.Kind, path, info)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	if opts.CacheSize > 0 {
+		store = storage.NewCache(store, info, opts.CacheSize)
 	}
 
-	torrent := p2p.Torrent{
-		Peers:       p,
-		PeerID:      peerID,
+	torrent := &p2p.Torrent{
 		InfoHash:    t.InfoHash,
 		PieceHashes: t.PieceHashes,
 		PieceLength: t.PieceLength,
 		Length:      t.Length,
 		Name:        t.Name,
-		Status:      status.Pieces,
+		Storage:     store,
+		Layout:      info,
+	}
+	// Data kept in memory does not survive a restart, so never trust resume data for it
+	if opts.Kind != storage.KindMemory {
+		torrent.Files = info.Paths(path)
+	}
+	return torrent, nil
+}
+
+// RequestPeers tells the torrent's tracker that the client with peerID is
+// joining the swarm, reporting its transfer totals so far, and returns the
+// peers it knows
+func (t *TorrentFile) RequestPeers(peerID [20]byte, uploaded, downloaded, left int64) ([]peers.Peer, error) {
+	if strings.HasPrefix(t.Announce, "udp") {
+		return GetPeers(*t, peerID, udpEvents[EventStarted], uploaded, downloaded, left)
 	}
-	torrentMap.Lock()
-	torrentMap.m[t.Name] = &torrent
-	torrentMap.Unlock()
+	return t.requestPeers(peerID, Port, EventStarted, uploaded, downloaded, left)
+}
 
-	_, err = torrent.Download(progressChan, path, progressFilePath)
+// AnnounceStopped tells the tracker that the client with peerID is leaving
+// the swarm, reporting its final transfer totals
+func (t *TorrentFile) AnnounceStopped(peerID [20]byte, uploaded, downloaded, left int64) error {
+	if strings.HasPrefix(t.Announce, "udp") {
+		return t.announceUDP(peerID, udpEvents[EventStopped], uploaded, downloaded, left)
+	}
+
+	url, err := t.buildTrackerURL(peerID, Port, EventStopped, uploaded, downloaded, left)
 	if err != nil {
 		return err
 	}
-
+	c := &http.Client{Timeout: 15 * time.Second}
+	resp, err := c.Get(url)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("tracker responded with %s", resp.Status)
+	}
 	return nil
+}
 
+// FileStatus describes one file of a torrent for the file list API
+type FileStatus struct {
+	Index    int          `json:"index"`
+	Path     string       `json:"path"`
+	Length   int64        `json:"length"`
+	Priority p2p.Priority `json:"priority"`
+	Progress float64      `json:"progress"` // Percentage of the file's pieces verified
 }
 
-func PauseTorrentDownload(filePath string, torrentMap *TorrentMap, w http.ResponseWriter) bool {
-	torrentMap.Lock()
-	torrent, ok := torrentMap.m[filePath]
-	torrentMap.Unlock()
-	fmt.Println(torrent)
-	if !ok {
-		http.Error(w, "Torrent not found", http.StatusNotFound)
-		return false
+// FileStatuses lists the files of the torrent with the given priorities and
+// their progress, taken from the running download if there is one and from
+// the resume data otherwise. A nil priorities means every file is normal.
+func (t *TorrentFile) FileStatuses(running *p2p.Torrent, priorities []p2p.Priority, resumeFilePath string) []FileStatus {
+	info := t.StorageInfo()
+	hasPiece := func(index int) bool { return false }
+	if priorities == nil {
+		priorities = make([]p2p.Priority, len(info.Files))
+		for i := range priorities {
+			priorities[i] = p2p.PriorityNormal
+		}
+	}
+
+	if running != nil {
+		hasPiece = running.HasPiece
+	} else if data, err := resume.Load(resumeFilePath); err == nil && data.InfoHash == t.InfoHash {
+		hasPiece = data.Bitfield.HasPiece
 	}
 
-	// Assuming the Torrent struct has a method to pause
-	torrent.Pause()
+	files := make([]FileStatus, len(info.Files))
+	for i, f := range info.Files {
+		path := f.Path
+		if path == "" {
+			path = t.Name
+		}
+		files[i] = FileStatus{Index: i, Path: filepath.ToSlash(path), Length: f.Length, Priority: priorities[i]}
 
-	return true
+		first, last, ok := info.FilePieces(i)
+		if !ok {
+			files[i].Progress = 100
+			continue
+		}
+		done := 0
+		for index := first; index <= last; index++ {
+			if hasPiece(index) {
+				done++
+			}
+		}
+		files[i].Progress = float64(done) / float64(last-first+1) * 100
+	}
+	return files
 }
 
 func SaveToJSONFile(torrent *p2p.Torrent, filename string) error {
@@ -287,24 +444,27 @@ func SaveToJSONFile(torrent *p2p.Torrent, filename string) error {
 	return nil
 }
 
-// GetPeers initiates the connection to the UDP tracker and retrieves peers.
-func GetPeers(torrent TorrentFile, callback func([]peers.Peer)) {
+// GetPeers initiates the connection to the UDP tracker and retrieves peers,
+// announcing event for the client with peerID and its transfer totals.
+func GetPeers(torrent TorrentFile, peerID [20]byte, event uint32, uploaded, downloaded, left int64) ([]peers.Peer, error) {
 	// Parse the announce URL
 	announceUrl, err := url.Parse(torrent.Announce)
 	if err != nil {
-		log.Fatalf("Failed to parse URL: %v", err)
+		return nil, fmt.Errorf("failed to parse URL: %w", err)
 	}
 
 	// Create a UDP connection
 	conn, err := net.Dial("udp", announceUrl.Host)
 	if err != nil {
-		log.Fatalf("Failed to dial UDP connection: %v", err)
+		return nil, fmt.Errorf("failed to dial UDP connection: %w", err)
 	}
 	defer conn.Close()
 
 	// Step 1: Send connect request
 	connReq := buildConnReq()
-	udpSend(conn, connReq)
+	if err := udpSend(conn, connReq); err != nil {
+		return nil, err
+	}
 
 	// Buffer to read UDP responses
 	resp := make([]byte, 1024)
@@ -313,37 +473,75 @@ func GetPeers(torrent TorrentFile, callback func([]peers.Peer)) {
 		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
 		n, err := conn.Read(resp)
 		if err != nil {
-			log.Fatalf("Failed to read UDP response: %v", err)
+			return nil, fmt.Errorf("failed to read UDP response: %w", err)
 		}
 
-		if respType(resp[:n]) == "connect" {
+		switch respType(resp[:n]) {
+		case "connect":
+			if n < 16 {
+				return nil, errors.New("short UDP connect response")
+			}
 			connResp := parseConnResp(resp[:n])
 
 			// Step 3: Send announce request
-			announceReq := buildAnnounceReq(connResp.ConnectionID, torrent, udpPort)
-			udpSend(conn, announceReq)
-		} else if respType(resp[:n]) == "announce" {
+			announceReq := buildAnnounceReq(connResp.ConnectionID, torrent, peerID[:], event, uploaded, downloaded, left, Port)
+			if err := udpSend(conn, announceReq); err != nil {
+				return nil, err
+			}
+		case "announce":
+			if n < 20 {
+				return nil, errors.New("short UDP announce response")
+			}
 			// Step 4: Parse announce response
-			announceResp := parseAnnounceResp(resp[:n])
-			fmt.Println(announceResp.Peers)
-
-			// Step 5: Return peers to callback
-			callback(announceResp.Peers)
-			break
+			return parseAnnounceResp(resp[:n]).Peers, nil
 		}
 	}
 }
 
-// // udpSend sends the message to the UDP tracker.
-func udpSend(conn net.Conn, message []byte) {
-	_, err := conn.Write(message)
+// announceUDP sends a single announce carrying event to a UDP tracker,
+// without waiting for peers
+func (t *TorrentFile) announceUDP(peerID [20]byte, event uint32, uploaded, downloaded, left int64) error {
+	announceUrl, err := url.Parse(t.Announce)
+	if err != nil {
+		return err
+	}
+	conn, err := net.Dial("udp", announceUrl.Host)
 	if err != nil {
-		log.Fatalf("Failed to send UDP message: %v", err)
+		return err
 	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(15 * time.Second))
+
+	if _, err := conn.Write(buildConnReq()); err != nil {
+		return err
+	}
+	resp := make([]byte, 1024)
+	n, err := conn.Read(resp)
+	if err != nil {
+		return err
+	}
+	if n < 16 || respType(resp[:n]) != "connect" {
+		return errors.New("unexpected response to UDP connect request")
+	}
+	connResp := parseConnResp(resp[:n])
+
+	_, err = conn.Write(buildAnnounceReq(connResp.ConnectionID, *t, peerID[:], event, uploaded, downloaded, left, Port))
+	return err
+}
+
+// // udpSend sends the message to the UDP tracker.
+func udpSend(conn net.Conn, message []byte) error {
+	if _, err := conn.Write(message); err != nil {
+		return fmt.Errorf("failed to send UDP message: %w", err)
+	}
+	return nil
 }
 
 // respType determines the type of response (connect or announce).
 func respType(resp []byte) string {
+	if len(resp) < 4 {
+		return ""
+	}
 	action := binary.BigEndian.Uint32(resp[:4])
 	if action == 0 {
 		return "connect"
@@ -379,7 +577,7 @@ func parseConnResp(resp []byte) (connResp ConnResp) {
 }
 
 // // buildAnnounceReq builds an announce request for peers.
-func buildAnnounceReq(connID []byte, torrent TorrentFile, port uint16) []byte {
+func buildAnnounceReq(connID []byte, torrent TorrentFile, peerID []byte, event uint32, uploaded, downloaded, left int64, port uint16) []byte {
 	fmt.Println(torrent.Length)
 	fmt.Println(torrent.PieceLength)
 	buf := new(bytes.Buffer)
@@ -395,16 +593,15 @@ func buildAnnounceReq(connID []byte, torrent TorrentFile, port uint16) []byte {
 	// Info hash
 	buf.Write(torrent.InfoHash[:])
 	// Peer ID
-	peerID := generatePeerID()
 	buf.Write(peerID)
 	// Downloaded
-	binary.Write(buf, binary.BigEndian, uint64(0))
-	// Left (torrent size)
-	binary.Write(buf, binary.BigEndian, uint64(torrent.Length))
+	binary.Write(buf, binary.BigEndian, uint64(downloaded))
+	// Left
+	binary.Write(buf, binary.BigEndian, uint64(left))
 	// Uploaded
-	binary.Write(buf, binary.BigEndian, uint64(0))
-	// Event (none = 0)
-	binary.Write(buf, binary.BigEndian, uint32(0))
+	binary.Write(buf, binary.BigEndian, uint64(uploaded))
+	// Event (none = 0, completed = 1, started = 2, stopped = 3)
+	binary.Write(buf, binary.BigEndian, event)
 	// IP address (default = 0)
 	binary.Write(buf, binary.BigEndian, uint32(0))
 	// Key
@@ -429,7 +626,7 @@ func parseAnnounceResp(resp []byte) AnnounceResp {
 
 	// Parse peers
 	peerBytes := resp[20:]
-	for i := 0; i < len(peerBytes); i += 6 {
+	for i := 0; i+6 <= len(peerBytes); i += 6 {
 		ip := net.IP(peerBytes[i : i+4])
 		port := binary.BigEndian.Uint16(peerBytes[i+4 : i+6])
 		announceResp.Peers = append(announceResp.Peers, peers.Peer{IP: ip, Port: port})
@@ -438,14 +635,6 @@ func parseAnnounceResp(resp []byte) AnnounceResp {
 	return announceResp
 }
 
-// // generatePeerID generates a random peer ID.
-func generatePeerID() []byte {
-	peerID := make([]byte, 20)
-	copy(peerID[:], "-GO0001-")
-	rand.Read(peerID[8:])
-	return peerID
-}
-
 // // TorrentMeta and Peer are placeholder structures for torrent metadata and peers.
 type TorrentMeta struct {
 	Announce string
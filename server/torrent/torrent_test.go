@@ -0,0 +1,202 @@
+package torrent
+
+import (
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+var testPeerID = [20]byte{'-', 'T', 'E', '0', '0', '0', '1', '-', 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12}
+
+func TestParse(t *testing.T) {
+	pieces := strings.Repeat("x", 20)
+	// Keys this client has no field for are part of the infohash
+	info := "d6:lengthi100e4:name6:debian12:piece lengthi16384e6:pieces20:" + pieces + "7:privatei1e6:sourcel1:a1:bee"
+	tests := []struct {
+		name string
+		data string
+		err  bool
+	}{
+		{"info first", "d4:info" + info + "8:announce9:udp://a:1e", false},
+		{"info last", "d8:announce9:udp://a:1" + "4:info" + info + "e", false},
+		{"not bencode", "<html></html>", true},
+		{"no info", "d8:announce9:udp://a:1e", true},
+		{"bad pieces", "d4:infod4:name6:debian6:pieces3:abcee", true},
+		{"unsafe path", "d4:infod5:filesld6:lengthi1e4:pathl2:..eee4:name1:x12:piece lengthi1e6:pieces0:ee", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			meta, err := Parse(strings.NewReader(tt.data))
+			if tt.err {
+				if !errors.Is(err, ErrInvalid) {
+					t.Errorf("Parse() error = %v, want %v", err, ErrInvalid)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if meta.InfoHash != sha1.Sum([]byte(info)) {
+				t.Errorf("InfoHash = %x, want the hash of the info dictionary as encoded", meta.InfoHash)
+			}
+			if meta.Name != "debian" || meta.Length != 100 || meta.Announce != "udp://a:1" || len(meta.PieceHashes) != 1 {
+				t.Errorf("Parse() = %+v", meta)
+			}
+		})
+	}
+}
+
+func TestHTTPAnnounces(t *testing.T) {
+	var queries []url.Values
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		w.Write([]byte("d8:intervali900e5:peers6:\x7f\x00\x00\x01\x1a\xe1e"))
+	}))
+	defer srv.Close()
+	meta := TorrentFile{Announce: srv.URL + "/announce", InfoHash: [20]byte{1}, Length: 5000}
+
+	found, err := meta.RequestPeers(testPeerID, 100, 2000, 3000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(found) != 1 || found[0].Port != 6881 {
+		t.Errorf("RequestPeers() = %v, want the one peer on port 6881", found)
+	}
+	if err := meta.AnnounceStopped(testPeerID, 200, 5000, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []map[string]string{
+		{"event": "started", "uploaded": "100", "downloaded": "2000", "left": "3000"},
+		{"event": "stopped", "uploaded": "200", "downloaded": "5000", "left": "0"},
+	}
+	if len(queries) != len(want) {
+		t.Fatalf("%d announces, want %d", len(queries), len(want))
+	}
+	for i, query := range queries {
+		if got := query.Get("peer_id"); got != string(testPeerID[:]) {
+			t.Errorf("announce %d peer_id = %q, want %q", i, got, testPeerID[:])
+		}
+		for key, value := range want[i] {
+			if got := query.Get(key); got != value {
+				t.Errorf("announce %d %s = %q, want %q", i, key, got, value)
+			}
+		}
+	}
+}
+
+// udpAnnounce is what a UDP tracker received in an announce request
+type udpAnnounce struct {
+	peerID                     [20]byte
+	downloaded, left, uploaded uint64
+	event                      uint32
+}
+
+// newUDPTracker answers connect and announce requests without any peers
+// and sends each announce it receives to announces
+func newUDPTracker(t *testing.T, announces chan<- udpAnnounce) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1024)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			req := buf[:n]
+			switch {
+			case n == 16 && binary.BigEndian.Uint32(req[8:12]) == 0:
+				resp := binary.BigEndian.AppendUint32(nil, 0)
+				resp = append(resp, req[12:16]...)
+				resp = binary.BigEndian.AppendUint64(resp, 42)
+				conn.WriteTo(resp, addr)
+			case n >= 98 && binary.BigEndian.Uint32(req[8:12]) == 1:
+				var a udpAnnounce
+				copy(a.peerID[:], req[36:56])
+				a.downloaded = binary.BigEndian.Uint64(req[56:64])
+				a.left = binary.BigEndian.Uint64(req[64:72])
+				a.uploaded = binary.BigEndian.Uint64(req[72:80])
+				a.event = binary.BigEndian.Uint32(req[80:84])
+				announces <- a
+				resp := binary.BigEndian.AppendUint32(nil, 1)
+				resp = append(resp, req[12:16]...)
+				resp = append(resp, make([]byte, 12)...) // Interval, leechers and seeders
+				conn.WriteTo(resp, addr)
+			}
+		}
+	}()
+	return "udp://" + conn.LocalAddr().String()
+}
+
+func TestUDPAnnounces(t *testing.T) {
+	announces := make(chan udpAnnounce, 2)
+	meta := TorrentFile{Announce: newUDPTracker(t, announces), InfoHash: [20]byte{1}, Length: 5000}
+
+	if _, err := meta.RequestPeers(testPeerID, 100, 2000, 3000); err != nil {
+		t.Fatal(err)
+	}
+	if err := meta.AnnounceStopped(testPeerID, 200, 5000, 0); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []udpAnnounce{
+		{testPeerID, 2000, 3000, 100, udpEvents[EventStarted]},
+		{testPeerID, 5000, 0, 200, udpEvents[EventStopped]},
+	}
+	for i, w := range want {
+		if got := <-announces; got != w {
+			t.Errorf("announce %d = %+v, want %+v", i, got, w)
+		}
+	}
+}
+
+func TestUDPTrackerErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		resp []byte // Sent back to every request, nil for no tracker at all
+	}{
+		{"no tracker", nil},
+		{"short connect response", binary.BigEndian.AppendUint32(nil, 0)},
+		{"short announce response", append(binary.BigEndian.AppendUint32(nil, 1), 0, 0, 0, 0)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+			if err != nil {
+				t.Fatal(err)
+			}
+			announce := "udp://" + conn.LocalAddr().String()
+			if tt.resp == nil {
+				conn.Close()
+			} else {
+				defer conn.Close()
+				go func() {
+					buf := make([]byte, 1024)
+					for {
+						_, addr, err := conn.ReadFrom(buf)
+						if err != nil {
+							return
+						}
+						conn.WriteTo(tt.resp, addr)
+					}
+				}()
+			}
+
+			meta := TorrentFile{Announce: announce, InfoHash: [20]byte{1}, Length: 5000}
+			if found, err := meta.RequestPeers(testPeerID, 0, 0, 5000); err == nil {
+				t.Errorf("RequestPeers() = %v, want an error", found)
+			}
+		})
+	}
+}
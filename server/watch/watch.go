@@ -0,0 +1,191 @@
+package watch
+
+import (
+	"bit_torrent/session"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// What happens to a source file once it has been added
+const (
+	AfterMove   = "move"
+	AfterDelete = "delete"
+)
+
+// DefaultInterval is how often folders are scanned when no interval is set
+const DefaultInterval = 5 * time.Second
+
+// Folder is a directory watched for .torrent and .magnet files. Torrents
+// found there are added with its save directory and category, and the
+// source file is then moved into MoveTo, by default an "added" folder
+// inside Dir, or deleted. A .magnet file holds a magnet link, added once
+// its metadata has been fetched from peers, which holds up the scan for as
+// long as fetching takes.
+type Folder struct {
+	Dir      string `json:"dir"`
+	SaveDir  string `json:"save_dir,omitempty"`
+	Category string `json:"category,omitempty"`
+	After    string `json:"after,omitempty"` // AfterMove or AfterDelete, AfterMove when empty
+	MoveTo   string `json:"move_to,omitempty"`
+}
+
+// Load reads a JSON list of watched folders
+func Load(path string) ([]Folder, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var folders []Folder
+	if err := json.Unmarshal(data, &folders); err != nil {
+		return nil, fmt.Errorf("failed to parse watch folders file: %v", err)
+	}
+	for i, f := range folders {
+		if f.Dir == "" {
+			return nil, fmt.Errorf("watch folder %d has no dir", i)
+		}
+		switch f.After {
+		case "":
+			folders[i].After = AfterMove
+		case AfterMove, AfterDelete:
+		default:
+			return nil, fmt.Errorf("invalid action %q after adding from %s", f.After, f.Dir)
+		}
+		if folders[i].After == AfterMove && f.MoveTo == "" {
+			folders[i].MoveTo = filepath.Join(f.Dir, "added")
+		}
+	}
+	return folders, nil
+}
+
+// AddFunc adds the torrent or magnet file at path with the folder's
+// settings. It returns an error wrapping session.ErrExists only for
+// torrents the session already has, by infohash, and any other error for
+// files it cannot add.
+type AddFunc func(path string, folder Folder) error
+
+// A Watcher scans folders on an interval and adds the files it finds
+type Watcher struct {
+	folders  []Folder
+	interval time.Duration
+	add      AddFunc
+
+	sizes  map[string]int64     // Size of each new file at the last scan
+	failed map[string]time.Time // Files that failed to add, by modification time
+}
+
+// New returns a Watcher for folders
+func New(folders []Folder, interval time.Duration, add AddFunc) *Watcher {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Watcher{
+		folders:  folders,
+		interval: interval,
+		add:      add,
+		sizes:    make(map[string]int64),
+		failed:   make(map[string]time.Time),
+	}
+}
+
+// Run creates the folders that do not exist and scans them until quit is closed
+func (w *Watcher) Run(quit <-chan struct{}) {
+	for _, folder := range w.folders {
+		if err := os.MkdirAll(folder.Dir, os.ModePerm); err != nil {
+			log.Printf("Failed to create watch folder %s: %v", folder.Dir, err)
+		}
+	}
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+	for {
+		w.scan()
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// scan adds the files that have stopped growing since the last scan, so
+// files still being written are left for later
+func (w *Watcher) scan() {
+	seen := make(map[string]bool)
+	for _, folder := range w.folders {
+		entries, err := os.ReadDir(folder.Dir)
+		if err != nil {
+			log.Printf("Failed to read watch folder %s: %v", folder.Dir, err)
+			continue
+		}
+		for _, entry := range entries {
+			ext := strings.ToLower(filepath.Ext(entry.Name()))
+			if entry.IsDir() || (ext != ".torrent" && ext != ".magnet") {
+				continue
+			}
+			path := filepath.Join(folder.Dir, entry.Name())
+			info, err := entry.Info()
+			if err != nil {
+				continue
+			}
+			seen[path] = true
+			if failedAt, ok := w.failed[path]; ok && failedAt.Equal(info.ModTime()) {
+				continue
+			}
+			if size, ok := w.sizes[path]; !ok || size != info.Size() || size == 0 {
+				w.sizes[path] = info.Size()
+				continue
+			}
+			delete(w.sizes, path)
+			w.handle(path, folder, info.ModTime())
+		}
+	}
+
+	// Forget files that have gone
+	for path := range w.sizes {
+		if !seen[path] {
+			delete(w.sizes, path)
+		}
+	}
+	for path := range w.failed {
+		if !seen[path] {
+			delete(w.failed, path)
+		}
+	}
+}
+
+func (w *Watcher) handle(path string, folder Folder, modTime time.Time) {
+	err := w.add(path, folder)
+	switch {
+	case errors.Is(err, session.ErrExists):
+		log.Printf("Ignoring %s from watch folder, already added", filepath.Base(path))
+	case err != nil:
+		log.Printf("Failed to add %s from watch folder: %v", path, err)
+		w.failed[path] = modTime
+		return
+	default:
+		log.Printf("Added %s from watch folder %s", filepath.Base(path), folder.Dir)
+	}
+
+	if folder.After == AfterDelete {
+		err = os.Remove(path)
+	} else {
+		err = moveFile(path, folder.MoveTo)
+	}
+	if err != nil {
+		log.Printf("Failed to clear %s from watch folder: %v", path, err)
+		w.failed[path] = modTime
+	}
+}
+
+// moveFile moves path into dir, replacing any file of the same name
+func moveFile(path, dir string) error {
+	if err := os.MkdirAll(dir, os.ModePerm); err != nil {
+		return err
+	}
+	return os.Rename(path, filepath.Join(dir, filepath.Base(path)))
+}
@@ -0,0 +1,129 @@
+package watch
+
+import (
+	"bit_torrent/session"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "watch.json")
+	data := `[{"dir":"/w/a"},{"dir":"/w/b","after":"delete"},{"dir":"/w/c","move_to":"/w/done","category":"linux"}]`
+	if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	folders, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Folder{
+		{Dir: "/w/a", After: AfterMove, MoveTo: "/w/a/added"},
+		{Dir: "/w/b", After: AfterDelete},
+		{Dir: "/w/c", After: AfterMove, MoveTo: "/w/done", Category: "linux"},
+	}
+	if !reflect.DeepEqual(folders, want) {
+		t.Errorf("Load() = %+v, want %+v", folders, want)
+	}
+
+	for _, bad := range []string{`[{"after":"move"}]`, `[{"dir":"/w","after":"copy"}]`, `{`} {
+		if err := os.WriteFile(path, []byte(bad), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := Load(path); err == nil {
+			t.Errorf("Load(%s) succeeded", bad)
+		}
+	}
+}
+
+func TestWatcher(t *testing.T) {
+	tests := []struct {
+		name    string
+		after   string
+		addErr  error
+		adds    int    // Calls to the AddFunc over three scans
+		left    bool   // Whether the file stays in the folder
+		movedTo string // Folder the file is moved into, if any
+	}{
+		{"moved", AfterMove, nil, 1, false, "added"},
+		{"deleted", AfterDelete, nil, 1, false, ""},
+		{"already added", AfterMove, fmt.Errorf("%w: debian", session.ErrExists), 1, false, "added"},
+		{"failed once", AfterMove, errors.New("bad torrent"), 1, true, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			folder := Folder{Dir: dir, After: tt.after, SaveDir: "/data", Category: "linux"}
+			if tt.after == AfterMove {
+				folder.MoveTo = filepath.Join(dir, "added")
+			}
+			path := filepath.Join(dir, "debian.torrent")
+			if err := os.WriteFile(path, []byte("d4:infod4:name6:debianee"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			// Files of other kinds are left alone
+			other := filepath.Join(dir, "notes.txt")
+			if err := os.WriteFile(other, []byte("notes"), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			var added []string
+			w := New([]Folder{folder}, 0, func(p string, f Folder) error {
+				if f != folder {
+					t.Errorf("added with folder %+v, want %+v", f, folder)
+				}
+				added = append(added, p)
+				return tt.addErr
+			})
+			w.scan()
+			if len(added) != 0 {
+				t.Fatalf("added %v on the first scan, before the size was seen to settle", added)
+			}
+			w.scan()
+			w.scan()
+			if len(added) != tt.adds || (tt.adds > 0 && added[0] != path) {
+				t.Errorf("added %v, want %s %d times", added, path, tt.adds)
+			}
+
+			if _, err := os.Stat(path); (err == nil) != tt.left {
+				t.Errorf("file left in the folder = %v, want %v", err == nil, tt.left)
+			}
+			if tt.movedTo != "" {
+				if _, err := os.Stat(filepath.Join(dir, tt.movedTo, "debian.torrent")); err != nil {
+					t.Errorf("file not moved: %v", err)
+				}
+			}
+			if _, err := os.Stat(other); err != nil {
+				t.Errorf("other file: %v", err)
+			}
+		})
+	}
+}
+
+func TestWatcherWaitsForGrowingFiles(t *testing.T) {
+	dir := t.TempDir()
+	folder := Folder{Dir: dir, After: AfterDelete}
+	var added int
+	w := New([]Folder{folder}, 0, func(string, Folder) error {
+		added++
+		return nil
+	})
+
+	path := filepath.Join(dir, "debian.TORRENT")
+	for _, size := range []int{0, 0, 10, 20} {
+		if err := os.WriteFile(path, make([]byte, size), 0644); err != nil {
+			t.Fatal(err)
+		}
+		w.scan()
+		if added != 0 {
+			t.Fatalf("added a file of %d bytes that is still growing", size)
+		}
+	}
+	w.scan()
+	if added != 1 {
+		t.Errorf("added %d times once the file stopped growing, want 1", added)
+	}
+}